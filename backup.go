@@ -0,0 +1,394 @@
+package goleveldb
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// BackupEngine keeps incremental backups of a DB in a directory:
+//
+//	shared/   tables and blob files, named by file number, checksum and size
+//	private/  the logs and the manifest of every backup, by backup id
+//	meta/     the description of every backup, by backup id
+//
+// A table is copied by the first backup holding it and shared with the later ones.
+type BackupEngine struct {
+	dir     string
+	env     Env // Env of the backup directory
+	backups map[uint32]*backupMeta
+	nextID  uint32
+
+	// checksums of the tables and blob files backed up so far, which are
+	// never changed once written
+	checksums map[checksumKey]uint32
+}
+
+// checksumKey identifies a table or blob file of an open DB. File numbers
+// start over in a DB created again in the same directory, so the directory
+// does not tell its files from those of the DB before.
+type checksumKey struct {
+	instance uint64 // DB.instance
+	name     string
+	size     uint64
+}
+
+// BackupInfo describes a backup.
+type BackupInfo struct {
+	ID        uint32
+	Timestamp int64  // Unix time in seconds when the backup was created
+	Size      uint64 // Bytes of all files of the backup, shared ones included
+	NumFiles  uint32
+}
+
+// backupFile is a file of the DB directory kept in the backup directory.
+type backupFile struct {
+	name     string // Name in the DB directory
+	path     string // Path relative to the backup directory
+	size     uint64
+	checksum uint32
+}
+
+// backupMeta is stored in meta/<id>:
+//
+//	timestamp: fixed64
+//	num_files: fixed32
+//	files: num_files times
+//	  name: length prefixed
+//	  path: length prefixed
+//	  size: fixed64
+//	  checksum: fixed32
+type backupMeta struct {
+	id        uint32
+	timestamp int64
+	files     []backupFile
+}
+
+const (
+	kBackupSharedDirName  = "shared"
+	kBackupPrivateDirName = "private"
+	kBackupMetaDirName    = "meta"
+)
+
+// OpenBackupEngine opens the backups in dir of DefaultEnv, creating it if needed.
+func OpenBackupEngine(dir string) (*BackupEngine, error) {
+	return OpenBackupEngineWithEnv(dir, DefaultEnv)
+}
+
+// OpenBackupEngineWithEnv opens the backups in dir of env, creating it if needed.
+func OpenBackupEngineWithEnv(dir string, env Env) (*BackupEngine, error) {
+	be := &BackupEngine{dir: dir, env: env, backups: make(map[uint32]*backupMeta), nextID: 1}
+	be.checksums = make(map[checksumKey]uint32)
+	for _, sub := range []string{kBackupSharedDirName, kBackupPrivateDirName, kBackupMetaDirName} {
+		if err := env.CreateDir(filepath.Join(dir, sub)); err != nil {
+			return nil, err
+		}
+	}
+	names, err := env.GetChildren(filepath.Join(dir, kBackupMetaDirName))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		id, err := strconv.ParseUint(name, 10, 32)
+		if err != nil {
+			continue
+		}
+		data, err := readFile(env, filepath.Join(dir, kBackupMetaDirName, name))
+		if err != nil {
+			return nil, err
+		}
+		meta, err := decodeBackupMeta(uint32(id), data)
+		if err != nil {
+			return nil, err
+		}
+		be.backups[meta.id] = meta
+		if meta.id >= be.nextID {
+			be.nextID = meta.id + 1
+		}
+	}
+	return be, nil
+}
+
+// CreateBackup backs up a checkpoint of db. Only the tables and blob files
+// not held by an earlier backup are copied.
+// The checkpoint is taken in the backup directory, but in the Env of db.
+func (be *BackupEngine) CreateBackup(db *DB) error {
+	id := be.nextID
+	db_env := db.option.env()
+	tmpDir := filepath.Join(be.dir, fmt.Sprintf("%d.checkpoint", id))
+	if err := removeDir(db_env, tmpDir); err != nil {
+		return err
+	}
+	// linked where possible, so the shared files are copied only once below
+	if err := db.Checkpoint(tmpDir); err != nil {
+		return err
+	}
+	defer removeDir(db_env, tmpDir)
+
+	meta := &backupMeta{id: id, timestamp: time.Now().Unix()}
+	privateDir := filepath.Join(be.dir, kBackupPrivateDirName, strconv.FormatUint(uint64(id), 10))
+	if err := be.env.CreateDir(privateDir); err != nil {
+		return err
+	}
+	names, err := db_env.GetChildren(tmpDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		src := filepath.Join(tmpDir, name)
+		number, ext, ok := parseFileName(name)
+		shared := ok && (ext == "ldb" || ext == "blob")
+		var size uint64
+		var checksum uint32
+		if shared {
+			size, checksum, err = be.sharedFileChecksum(db, src, name)
+		} else {
+			size, checksum, err = fileChecksum(db_env, src)
+		}
+		if err != nil {
+			return err
+		}
+		file := backupFile{name: name, size: size, checksum: checksum}
+		if shared {
+			file.path = filepath.Join(kBackupSharedDirName, fmt.Sprintf("%06d_%d_%d.%s", number, checksum, size, ext))
+			if be.env.FileExists(filepath.Join(be.dir, file.path)) {
+				// held by an earlier backup
+				meta.files = append(meta.files, file)
+				continue
+			}
+		} else {
+			file.path = filepath.Join(kBackupPrivateDirName, strconv.FormatUint(uint64(id), 10), name)
+		}
+		// a shared file is complete once it has its name
+		dst := filepath.Join(be.dir, file.path)
+		if err := copyFile(db_env, src, be.env, dst+".tmp"); err != nil {
+			return err
+		}
+		if err := be.env.RenameFile(dst+".tmp", dst); err != nil {
+			return err
+		}
+		meta.files = append(meta.files, file)
+	}
+
+	// the backup exists once its meta file does
+	path := filepath.Join(be.dir, kBackupMetaDirName, strconv.FormatUint(uint64(id), 10))
+	if err := writeFile(be.env, path+".tmp", meta.encodeTo()); err != nil {
+		return err
+	}
+	if err := be.env.RenameFile(path+".tmp", path); err != nil {
+		return err
+	}
+	be.backups[id] = meta
+	be.nextID++
+	return nil
+}
+
+// GetBackupInfo returns the backups, oldest first.
+func (be *BackupEngine) GetBackupInfo() []BackupInfo {
+	var infos []BackupInfo
+	for _, meta := range be.sortedBackups() {
+		info := BackupInfo{ID: meta.id, Timestamp: meta.timestamp, NumFiles: uint32(len(meta.files))}
+		for _, file := range meta.files {
+			info.Size += file.size
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// VerifyBackup checks the size and the checksum of every file of the backup id.
+// It returns ErrCorruption if a file is missing or damaged.
+func (be *BackupEngine) VerifyBackup(id uint32) error {
+	meta, ok := be.backups[id]
+	if !ok {
+		return ErrBackupNotFound
+	}
+	for _, file := range meta.files {
+		size, checksum, err := fileChecksum(be.env, filepath.Join(be.dir, file.path))
+		if os.IsNotExist(err) {
+			return ErrCorruption
+		} else if err != nil {
+			return err
+		}
+		if size != file.size || checksum != file.checksum {
+			return ErrCorruption
+		}
+	}
+	return nil
+}
+
+// DeleteBackup deletes the backup id, and the shared files no other backup holds.
+func (be *BackupEngine) DeleteBackup(id uint32) error {
+	if _, ok := be.backups[id]; !ok {
+		return ErrBackupNotFound
+	}
+	if err := be.env.RemoveFile(filepath.Join(be.dir, kBackupMetaDirName, strconv.FormatUint(uint64(id), 10))); err != nil {
+		return err
+	}
+	delete(be.backups, id)
+	if err := removeDir(be.env, filepath.Join(be.dir, kBackupPrivateDirName, strconv.FormatUint(uint64(id), 10))); err != nil {
+		return err
+	}
+	return be.deleteUnreferencedFiles()
+}
+
+// PurgeOldBackups deletes all backups but the numToKeep latest ones.
+func (be *BackupEngine) PurgeOldBackups(numToKeep int) error {
+	backups := be.sortedBackups()
+	for i := 0; i < len(backups)-numToKeep; i++ {
+		if err := be.DeleteBackup(backups[i].id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreDBFromBackup restores the backup id into option.DirPath of option.Env,
+// which must not hold a DB. The files are verified while they are copied.
+func (be *BackupEngine) RestoreDBFromBackup(id uint32, option Options) error {
+	meta, ok := be.backups[id]
+	if !ok {
+		return ErrBackupNotFound
+	}
+	env := option.env()
+	dir := option.DirPath
+	if names, err := env.GetChildren(dir); err == nil && len(names) > 0 {
+		return os.ErrExist
+	}
+	if err := env.CreateDir(dir); err != nil {
+		return err
+	}
+	for _, file := range meta.files {
+		dst := filepath.Join(dir, file.name)
+		if err := copyFile(be.env, filepath.Join(be.dir, file.path), env, dst); err != nil {
+			return err
+		}
+		size, checksum, err := fileChecksum(env, dst)
+		if err != nil {
+			return err
+		}
+		if size != file.size || checksum != file.checksum {
+			return ErrCorruption
+		}
+	}
+	return nil
+}
+
+// RestoreDBFromLatestBackup restores the latest backup into option.DirPath.
+func (be *BackupEngine) RestoreDBFromLatestBackup(option Options) error {
+	backups := be.sortedBackups()
+	if len(backups) == 0 {
+		return ErrBackupNotFound
+	}
+	return be.RestoreDBFromBackup(backups[len(backups)-1].id, option)
+}
+
+func (be *BackupEngine) sortedBackups() []*backupMeta {
+	backups := make([]*backupMeta, 0, len(be.backups))
+	for _, meta := range be.backups {
+		backups = append(backups, meta)
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].id < backups[j].id })
+	return backups
+}
+
+// deleteUnreferencedFiles deletes the shared files no backup holds any more.
+func (be *BackupEngine) deleteUnreferencedFiles() error {
+	referenced := make(map[string]bool)
+	for _, meta := range be.backups {
+		for _, file := range meta.files {
+			referenced[file.path] = true
+		}
+	}
+	names, err := be.env.GetChildren(filepath.Join(be.dir, kBackupSharedDirName))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		path := filepath.Join(kBackupSharedDirName, name)
+		if referenced[path] {
+			continue
+		}
+		if err := be.env.RemoveFile(filepath.Join(be.dir, path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (meta *backupMeta) encodeTo() []byte {
+	buf := make([]byte, 12)
+	EncodeFixed64(buf, uint64(meta.timestamp))
+	EncodeFixed32(buf[8:], uint32(len(meta.files)))
+	for _, file := range meta.files {
+		buf = append(buf, PutLengthPrefixedSlice([]byte(file.name))...)
+		buf = append(buf, PutLengthPrefixedSlice([]byte(file.path))...)
+		tmp := make([]byte, 12)
+		EncodeFixed64(tmp, file.size)
+		EncodeFixed32(tmp[8:], file.checksum)
+		buf = append(buf, tmp...)
+	}
+	return buf
+}
+
+func decodeBackupMeta(id uint32, data []byte) (meta *backupMeta, err error) {
+	if len(data) < 12 {
+		return nil, ErrCorruption
+	}
+	// the lengths in a damaged file may point anywhere
+	defer func() {
+		if recover() != nil {
+			meta, err = nil, ErrCorruption
+		}
+	}()
+	meta = &backupMeta{id: id, timestamp: int64(DecodeFixed64(data))}
+	num := DecodeFixed32(data[8:])
+	offset := uint32(12)
+	for i := uint32(0); i < num; i++ {
+		var file backupFile
+		name, n := GetLengthPrefixedSlice(data[offset:])
+		offset += n
+		path, n := GetLengthPrefixedSlice(data[offset:])
+		offset += n
+		file.name, file.path = string(name), string(path)
+		file.size = DecodeFixed64(data[offset:])
+		file.checksum = DecodeFixed32(data[offset+8:])
+		offset += 12
+		meta.files = append(meta.files, file)
+	}
+	return meta, nil
+}
+
+// sharedFileChecksum returns the size and the crc32 of the table or blob file
+// name of db, linked or copied to src. Such a file never changes, so it is
+// read only by the first backup holding it.
+func (be *BackupEngine) sharedFileChecksum(db *DB, src, name string) (uint64, uint32, error) {
+	env := db.option.env()
+	size, err := env.GetFileSize(src)
+	if err != nil {
+		return 0, 0, err
+	}
+	key := checksumKey{instance: db.instance, name: name, size: size}
+	if checksum, ok := be.checksums[key]; ok {
+		return size, checksum, nil
+	}
+	size, checksum, err := fileChecksum(env, src)
+	if err != nil {
+		return 0, 0, err
+	}
+	be.checksums[checksumKey{instance: db.instance, name: name, size: size}] = checksum
+	return size, checksum, nil
+}
+
+// fileChecksum returns the size and the crc32 of the file at path of env.
+func fileChecksum(env Env, path string) (uint64, uint32, error) {
+	data, err := readFile(env, path)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint64(len(data)), crc32.ChecksumIEEE(data), nil
+}
@@ -0,0 +1,195 @@
+package goleveldb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// readCountingEnv counts the tables opened for reading.
+type readCountingEnv struct {
+	Env
+	mu         sync.Mutex
+	tableReads int
+}
+
+func (env *readCountingEnv) NewRandomAccessFile(name string) (RandomAccessFile, error) {
+	if filepath.Ext(name) == ".ldb" {
+		env.mu.Lock()
+		env.tableReads++
+		env.mu.Unlock()
+	}
+	return env.Env.NewRandomAccessFile(name)
+}
+
+func TestBackupEngine(t *testing.T) {
+	path := "/tmp/goleveldb-mydb"
+	backup_dir := "/tmp/goleveldb-backup"
+	restore_path := "/tmp/goleveldb-restore"
+	for _, dir := range []string{path, backup_dir, restore_path} {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+	option := DefaultOptions()
+	option.DirPath = path
+	option.MemTableSize = 1024 * 64
+	env := &readCountingEnv{Env: DefaultEnv}
+	option.Env = env
+
+	db, err := Open(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	be, err := OpenBackupEngine(backup_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(from, to int, value string) {
+		for i := from; i < to; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("%s%06d", value, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	shared := func() int {
+		entries, err := os.ReadDir(filepath.Join(backup_dir, kBackupSharedDirName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	for i := 0; i < 3; i++ {
+		put(i*5000, (i+1)*5000, fmt.Sprintf("value%d_", i))
+		waitForBackgroundWork(db)
+		if err := be.CreateBackup(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// no table is copied or read again
+	before := shared()
+	env.tableReads = 0
+	if err := be.CreateBackup(db); err != nil {
+		t.Fatal(err)
+	}
+	if shared() != before {
+		t.Fatalf("Expect %d shared files, but get %d\n", before, shared())
+	}
+	if env.tableReads != 0 {
+		t.Fatalf("backup read %d tables already backed up", env.tableReads)
+	}
+	infos := be.GetBackupInfo()
+	if len(infos) != 4 {
+		t.Fatalf("Expect 4 backups, but get %d\n", len(infos))
+	}
+	for _, info := range infos {
+		if err := be.VerifyBackup(info.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// backups are recovered by a new engine
+	if be, err = OpenBackupEngine(backup_dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.PurgeOldBackups(2); err != nil {
+		t.Fatal(err)
+	}
+	infos = be.GetBackupInfo()
+	if len(infos) != 2 || infos[0].ID != 3 {
+		t.Fatalf("Expect backups 3 and 4, but get %v\n", infos)
+	}
+	if err := be.VerifyBackup(1); err != ErrBackupNotFound {
+		t.Fatalf("Expect: %v, but get %v\n", ErrBackupNotFound, err)
+	}
+
+	restore_option := *option
+	restore_option.DirPath = restore_path
+	if err := be.RestoreDBFromBackup(3, restore_option); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.RestoreDBFromLatestBackup(restore_option); err != os.ErrExist {
+		t.Fatalf("Expect: %v, but get %v\n", os.ErrExist, err)
+	}
+	restored, err := Open(restore_option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 15000; i++ {
+		value, err := restored.Get([]byte(fmt.Sprintf("%06d", i)))
+		if err != nil || string(value) != fmt.Sprintf("value%d_%06d", i/5000, i) {
+			t.Fatalf("Get %06d: %v", i, err)
+		}
+	}
+	if _, err := restored.Get([]byte(fmt.Sprintf("%06d", 15000))); err != ErrKeyNotFound {
+		t.Fatalf("Expect: %v, but get %v\n", ErrKeyNotFound, err)
+	}
+	restored.Close()
+
+	// a damaged file is reported
+	file := be.backups[4].files[0]
+	if err := os.WriteFile(filepath.Join(backup_dir, file.path), []byte("damaged"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.VerifyBackup(4); err != ErrCorruption {
+		t.Fatalf("Expect: %v, but get %v\n", ErrCorruption, err)
+	}
+}
+
+func TestBackupEngine_RecreatedDB(t *testing.T) {
+	env := NewMemEnv()
+	option := DefaultOptions()
+	option.DirPath = "/tmp/goleveldb-mydb"
+	option.Env = env
+	option.MemTableSize = 1024 * 64
+	be, err := OpenBackupEngineWithEnv("/tmp/goleveldb-backup", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the DB created again has files of the same names and sizes,
+	// but other contents
+	test_num := 5000
+	for _, value := range []string{"old", "new"} {
+		db, err := Open(*option)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < test_num; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("%s%06d", value, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		waitForBackgroundWork(db)
+		if err := be.CreateBackup(db); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := DestroyDB(*option); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := be.VerifyBackup(2); err != nil {
+		t.Fatal(err)
+	}
+
+	restore_option := *option
+	restore_option.DirPath = "/tmp/goleveldb-restore"
+	if err := be.RestoreDBFromLatestBackup(restore_option); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := Open(restore_option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	for i := 0; i < test_num; i++ {
+		value, err := restored.Get([]byte(fmt.Sprintf("%06d", i)))
+		expectValue(t, value, err, fmt.Sprintf("new%06d", i))
+	}
+}
@@ -12,7 +12,10 @@ import (
 var db *goleveldb.DB
 
 func openDB() func() {
-	options := goleveldb.DefaultOptions()
+	return openDBWithOptions(goleveldb.DefaultOptions())
+}
+
+func openDBWithOptions(options *goleveldb.Options) func() {
 	options.DirPath = "/tmp/golevel-bench"
 
 	os.RemoveAll(options.DirPath)
@@ -55,4 +58,36 @@ func TestRandomPut(t *testing.T) {
 	fmt.Printf("Latency: %.3f micros/op; %.1f MB/s\n", latency, write_speed)
 	fmt.Printf("Spatial amplification: %.3f, real data size: %.3f (MB), raw data size: %.3f (MB)\n",
 		float64(real_data_size)/float64(raw_data_size), real_data_size, raw_data_size)
+	fmt.Printf("Write amplification: %.3f\n", db.WriteAmplification())
+}
+
+func TestWriteAmplification(t *testing.T) {
+	styles := []struct {
+		name  string
+		style goleveldb.CompactionStyle
+	}{
+		{"Leveled", goleveldb.CompactionStyleLevel},
+		{"Universal", goleveldb.CompactionStyleUniversal},
+	}
+
+	putNum := 200000
+	for _, s := range styles {
+		options := goleveldb.DefaultOptions()
+		options.MemTableSize = 1 * goleveldb.MB
+		options.CompactionStyle = s.style
+		destroy := openDBWithOptions(options)
+
+		startTime := time.Now()
+		for i := 0; i < putNum; i++ {
+			err := db.Put(GetTestKey(randStr.Intn(putNum)), RandomValue(100))
+			if err != nil {
+				panic(err)
+			}
+		}
+		elapsedTime := time.Since(startTime) / time.Millisecond // ms
+
+		fmt.Printf("%s compaction, Entries: %d, Elapsed: %d ms, Write amplification: %.3f\n",
+			s.name, putNum, elapsedTime, db.WriteAmplification())
+		destroy()
+	}
 }
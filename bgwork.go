@@ -1,10 +1,43 @@
 package goleveldb
 
 import (
+	"bytes"
 	"time"
 )
 
+// startBackgroundWork launches the flush and compaction worker pools.
+// Flushes have their own workers so a long compaction never delays
+// turning an immutable memtable into a level-0 table.
+func (db *DB) startBackgroundWork() {
+	for i := uint32(0); i < db.option.MaxBackgroundFlushes; i++ {
+		db.bgWork.Add(1)
+		go db.backgroundFlush()
+	}
+	for i := uint32(0); i < db.option.MaxBackgroundCompactions; i++ {
+		db.bgWork.Add(1)
+		go db.backgroundCompaction()
+	}
+}
+
+func (db *DB) backgroundFlush() {
+	defer db.bgWork.Done()
+	for {
+		select {
+		case <-db.dbCloseCh:
+			return
+		case imm := <-db.flushCh:
+			if db.backgroundError() != nil {
+				continue
+			}
+			if err := db.compactMemTable(imm); err != nil {
+				db.setBackgroundError(err)
+			}
+		}
+	}
+}
+
 func (db *DB) backgroundCompaction() {
+	defer db.bgWork.Done()
 	interval := db.option.CompactionInterval
 	timer := time.NewTimer(time.Millisecond * time.Duration(interval))
 	var err error
@@ -12,151 +45,497 @@ func (db *DB) backgroundCompaction() {
 		select {
 		case <-db.dbCloseCh:
 			return
-		case <-db.immExistCh:
-			err = db.compactMemTable()
+		case <-db.compactionCh:
+			err = db.maybeScheduleCompaction()
 		case <-timer.C:
 			err = db.maybeScheduleCompaction()
 		}
 		if err != nil {
-			panic(err.Error())
+			db.setBackgroundError(err)
 		}
 		timer.Reset(time.Millisecond * time.Duration(interval))
 	}
 }
 
-func (db *DB) compactMemTable() error {
+// compactMemTable writes imm to a level-0 table and installs it.
+// Several flush workers may build tables at the same time.
+func (db *DB) compactMemTable(imm *memTable) error {
+	meta, err := db.writeLevel0Table(imm.family, imm)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
 	db.muCompaction.Lock()
-	defer db.muCompaction.Unlock()
-	if db.imm == nil {
+	imm.flushed = meta
+	err = db.installFlushResults(imm.family)
+	db.muCompaction.Unlock()
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// level 0 has grown, wake up a compaction worker
+	select {
+	case db.compactionCh <- true:
+	default:
+	}
+	return nil
+}
+
+// installFlushResults retires flushed memtables of cfd strictly oldest first,
+// so a read never finds an older memtable in front of a newer level-0 table.
+// REQUIRES: db.mu and db.muCompaction held.
+func (db *DB) installFlushResults(cfd *columnFamilyData) error {
+	var installed []*memTable
+	for len(cfd.imms) > 0 && cfd.imms[0].flushed != nil {
+		imm := cfd.imms[0]
+		cfd.current.addFile(0, imm.flushed)
+		if imm.flushed.blobFile != 0 {
+			cfd.blobFiles = append(cfd.blobFiles, imm.flushed.blobFile)
+		}
+		db.flushedBytes += imm.flushed.fileSize
+		cfd.flushedBytes += imm.flushed.fileSize
+		db.option.Statistics.record(tickerFlushBytesWritten, imm.flushed.fileSize)
+		cfd.imms = cfd.imms[1:]
+		installed = append(installed, imm)
+	}
+	if len(installed) == 0 {
 		return nil
 	}
-	if err := db.writeLevel0Table(db.imm, db.current); err != nil {
+
+	// logs are deleted once the manifest no longer needs them
+	if err := db.saveManifestFile(); err != nil {
 		return err
 	}
-	wal_path := db.imm.getLogPath()
-	db.imm = nil
-	if err := RemoveFile(wal_path); err != nil {
-		return err
+	for _, imm := range installed {
+		if db.logInUse(imm.getLogPath()) {
+			continue
+		}
+		if err := db.removeObsoleteFile(imm.getLogPath()); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// logInUse reports whether a memtable of any column family still needs the log at logPath.
+// REQUIRES: db.mu and db.muCompaction held.
+func (db *DB) logInUse(logPath string) bool {
+	for _, cfd := range db.families {
+		for i := 0; i < len(cfd.imms); i++ {
+			if cfd.imms[i].getLogPath() == logPath {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// maybeScheduleCompaction runs at most one compaction in every column family.
 func (db *DB) maybeScheduleCompaction() error {
+	if db.backgroundError() != nil {
+		return nil
+	}
 	db.muCompaction.Lock()
-	if db.imm != nil {
-		db.muCompaction.Unlock()
-		return db.compactMemTable()
+	families := make([]*columnFamilyData, 0, len(db.families))
+	for _, cfd := range db.families {
+		families = append(families, cfd)
 	}
+	db.muCompaction.Unlock()
 
-	defer db.muCompaction.Unlock()
-	c := db.current.pickCompaction()
-	if c == nil {
-		return nil
-	} else if c.isTrivialMove() {
-		db.current.deleteFile(c.level, c.inputs[0][0], false)
-		db.current.addFile(c.level+1, c.inputs[0][0])
-	} else {
-		if err := db.doCompaction(c); err != nil {
+	for i := 0; i < len(families); i++ {
+		if err := db.compactColumnFamily(families[i]); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (db *DB) doCompaction(c *compaction) error {
-	var list []*fileMetaData
-	iter, err := db.makeInputIterator(c)
+func (db *DB) compactColumnFamily(cfd *columnFamilyData) error {
+	// db.mu is needed as well to save the manifest
+	db.mu.Lock()
+	db.muCompaction.Lock()
+	c := cfd.current.pickCompaction()
+	if c == nil {
+		db.muCompaction.Unlock()
+		db.mu.Unlock()
+		return nil
+	} else if c.isTrivialMove() {
+		cfd.current.deleteFile(c.level, c.inputs[0][0], false)
+		cfd.current.addFile(c.outputLevel, c.inputs[0][0])
+		err := db.saveManifestFile()
+		db.muCompaction.Unlock()
+		db.mu.Unlock()
+		return err
+	} else if c.deletion {
+		err := db.installCompactionResults(cfd, c, nil)
+		db.muCompaction.Unlock()
+		db.mu.Unlock()
+		return err
+	}
+	c.markBeingCompacted(true)
+	db.muCompaction.Unlock()
+	db.mu.Unlock()
+
+	// Merge without holding the lock, so reads, flushes and
+	// compactions of other files can go on meanwhile.
+	outputs, err := db.doCompaction(cfd, c)
+
+	db.mu.Lock()
+	db.muCompaction.Lock()
+	defer db.mu.Unlock()
+	defer db.muCompaction.Unlock()
+	c.markBeingCompacted(false)
 	if err != nil {
 		return err
 	}
+	return db.installCompactionResults(cfd, c, outputs)
+}
+
+// doCompaction merges the inputs of c into new sstables and returns them.
+// The inputs must have been reserved, the version is left untouched.
+func (db *DB) doCompaction(cfd *columnFamilyData, c *compaction) ([]*fileMetaData, error) {
+	var list []*fileMetaData
+	smallest_snapshot := db.smallestSnapshot()
+	iter, tombstones, err := db.makeInputIterator(cfd, c, smallest_snapshot)
+	if err != nil {
+		return nil, err
+	}
 	var prev_user_key []byte = nil
 	var current_user_key []byte = nil
+	filter := cfd.newCompactionFilter(c)
 
-	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
-		var meta fileMetaData
-		meta.number = db.current.nextFileNumber
-		db.current.nextFileNumber++
-		file, err := NewLinuxFile(sstableFileName(db.option.DirPath, meta.number))
+	var meta *fileMetaData
+	var builder *tableBuilder
+	var output_lower UserKey // first user key the current output may hold
+	openOutput := func() error {
+		meta = &fileMetaData{number: db.newFileNumber(), creationTime: uint64(time.Now().Unix())}
+		name := sstableFileName(db.option.DirPath, meta.number)
+		var file WritableFile
+		var err error
+		if cfd.option.UseDirectIOForCompaction {
+			file, err = createDirectFile(db.option.env(), name)
+		} else {
+			file, err = db.option.env().NewWritableFile(name)
+		}
 		if err != nil {
 			return err
 		}
-		builder := newTableBuilder(&db.option, file)
-
-		meta.smallest = iter.Key()
-		for ; iter.Valid(); iter.Next() {
-			internal_key := InternalKey(iter.Key())
-			current_user_key = internal_key.ExtractUserKey()
-			if prev_user_key != nil {
-				res := UserKeyCompare(prev_user_key, current_user_key)
-				if res == 0 {
-					continue
-				} else if res > 0 {
-					return ErrInvalidKey
+		builder = newTableBuilder(&cfd.option, file, db.option.RateLimiter, IOPriorityLow, false)
+		return nil
+	}
+	add := func(internal_key InternalKey, value []byte) error {
+		if builder == nil {
+			if err := openOutput(); err != nil {
+				return err
+			}
+		}
+		// the bounds are copied, as the version outlives the input tables
+		if meta.smallest == nil {
+			meta.smallest = append(InternalKey(nil), internal_key...)
+		}
+		meta.largest = internal_key
+		builder.add(internal_key, value)
+		return nil
+	}
+	// Range tombstones are kept unless nothing older is left and every
+	// snapshot sees them.
+	keepTombstone := func(t *rangeTombstone) bool {
+		return !c.bottommost || t.seq > smallest_snapshot
+	}
+	// finishOutput completes the current output, which holds the user keys
+	// before upper. Each output takes the part of the range tombstones
+	// within its own key range.
+	finishOutput := func(upper UserKey) error {
+		meta.largest = append(InternalKey(nil), meta.largest...)
+		for i := 0; i < len(tombstones); i++ {
+			if !keepTombstone(&tombstones[i]) {
+				continue
+			}
+			if t, ok := tombstones[i].clip(output_lower, upper); ok {
+				builder.addRangeTombstone(t)
+				meta.extendRange(&t)
+			}
+		}
+		if err := builder.finish(); err != nil {
+			return err
+		}
+		meta.fileSize = builder.fileSize()
+		list = append(list, meta)
+		builder = nil
+		output_lower = upper
+		return nil
+	}
+
+	// keep writes the newest entry of a user key, unless nothing needs it
+	keep := func(internal_key InternalKey, value []byte) error {
+		user_key := internal_key.ExtractUserKey()
+		if isHidden(internal_key.ExtractValueType(), value) {
+			if c.bottommost {
+				// There is no older data left to shadow
+				return nil
+			}
+			if internal_key.ExtractValueType() == KTypeValueWithTTL {
+				// An expired value still hides older versions below
+				internal_key = NewInternalKey(user_key, internal_key.ExtractSequenceNumber(), KTypeDeletion)
+				value = []byte{}
+			}
+		} else if filter != nil {
+			filtered := value
+			if internal_key.ExtractValueType() == KTypeBlobIndex {
+				// the filter sees the value stored in the blob file
+				var err error
+				if filtered, err = db.blobs.get(value); err != nil {
+					return err
+				}
+			}
+			new_value, removed := applyCompactionFilter(filter, c, internal_key, filtered)
+			if removed {
+				if c.bottommost {
+					return nil
+				}
+				// Older versions below must stay hidden
+				internal_key = NewInternalKey(user_key, internal_key.ExtractSequenceNumber(), KTypeDeletion)
+				value = []byte{}
+			} else if internal_key.ExtractValueType() != KTypeBlobIndex {
+				value = new_value
+			} else if !bytes.Equal(new_value, filtered) {
+				// a changed value is written inline
+				internal_key = NewInternalKey(user_key, internal_key.ExtractSequenceNumber(), KTypeValue)
+				value = new_value
+			}
+		}
+		return add(internal_key, value)
+	}
+
+	// Merge operands of the current user key whose base value is not found yet
+	var merging *mergeContext
+	// finishMerge writes the operands left once all versions of their key are read
+	finishMerge := func() error {
+		defer func() { merging = nil }()
+		if (c.bottommost || merging.tombstone > 0) && merging.operator != nil {
+			// Nothing older is visible, so the operands make the full value
+			value, err := merging.finish()
+			if err != nil {
+				return err
+			}
+			return keep(merging.mergedEntry(value))
+		}
+		keys, operands := merging.partialMerge()
+		for i := 0; i < len(keys); i++ {
+			if err := add(keys[i], operands[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// A single deletion waits for the entry below it, the Put it deletes
+	var single_delete InternalKey
+
+	// Entries newer than the oldest snapshot are copied as they are, since
+	// the snapshot may still need the older versions below them.
+	// key_seen is set once the newest older entry of the key is handled.
+	key_seen := false
+
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		internal_key := InternalKey(iter.Key())
+		current_user_key = internal_key.ExtractUserKey()
+		res := 1
+		if prev_user_key != nil {
+			res = UserKeyCompare(current_user_key, prev_user_key)
+			if res < 0 {
+				return nil, ErrInvalidKey
+			}
+		}
+		if res > 0 {
+			if merging != nil {
+				if err := finishMerge(); err != nil {
+					return nil, err
+				}
+			}
+			if single_delete != nil {
+				// the Put is in an older level, the deletion goes on
+				if err := keep(single_delete, []byte{}); err != nil {
+					return nil, err
+				}
+				single_delete = nil
+			}
+			// all versions of a user key stay in one file, so that lookups
+			// of merge operands find them together
+			if builder != nil && builder.fileSize() > uint64(cfd.option.MaxFileSize) {
+				if err := finishOutput(current_user_key); err != nil {
+					return nil, err
 				}
 			}
 			prev_user_key = current_user_key
-			meta.largest = internal_key
-			builder.add(internal_key, iter.Value())
-			if builder.fileSize() > uint64(db.option.MaxFileSize) {
+			key_seen = false
+		}
+
+		if internal_key.ExtractSequenceNumber() > smallest_snapshot {
+			if err := add(internal_key, iter.Value()); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if key_seen {
+			if single_delete != nil {
+				t := internal_key.ExtractValueType()
+				paired := t == KTypeValue || t == KTypeValueWithTTL
+				if t == KTypeBlobIndex {
+					// blob garbage collection copies a Put to a newer entry,
+					// so another copy may be in a file left out of c
+					db.muCompaction.Lock()
+					paired = !cfd.current.keyInOtherFiles(c, current_user_key)
+					db.muCompaction.Unlock()
+				}
+				if !paired {
+					if err := keep(single_delete, []byte{}); err != nil {
+						return nil, err
+					}
+				}
+				// otherwise both the deletion and the Put are dropped
+				single_delete = nil
+			}
+			if merging != nil {
+				done, value, err := merging.add(internal_key, iter.Value())
+				if err != nil {
+					return nil, err
+				}
+				if done {
+					// operands merged with their base value
+					key, value := merging.mergedEntry(value)
+					merging = nil
+					if err := keep(key, value); err != nil {
+						return nil, err
+					}
+				}
+			}
+			// Hidden by a newer entry for the same user key
+			continue
+		}
+		key_seen = true
+
+		// only tombstones every snapshot sees may drop entries
+		tombstone := tombstones.maxCoveringSeq(current_user_key, smallest_snapshot)
+		if internal_key.ExtractSequenceNumber() < tombstone {
+			// Deleted by a range tombstone, as are the older versions
+			continue
+		}
+		if internal_key.ExtractValueType() == KTypeMerge {
+			merging = newMergeContext(cfd.option.MergeOperator, current_user_key)
+			merging.blobs = db.blobs
+			merging.tombstone = tombstone
+			merging.add(internal_key, iter.Value())
+			continue
+		}
+		if internal_key.ExtractValueType() == KTypeSingleDeletion {
+			single_delete = internal_key
+			continue
+		}
+		if err := keep(internal_key, iter.Value()); err != nil {
+			return nil, err
+		}
+	}
+	if merging != nil {
+		if err := finishMerge(); err != nil {
+			return nil, err
+		}
+	}
+	if single_delete != nil {
+		if err := keep(single_delete, []byte{}); err != nil {
+			return nil, err
+		}
+	}
+	if builder == nil {
+		for i := 0; i < len(tombstones); i++ {
+			if keepTombstone(&tombstones[i]) {
+				// every key was deleted, but the tombstones are still needed
+				if err := openOutput(); err != nil {
+					return nil, err
+				}
 				break
 			}
 		}
-		builder.finish()
-		meta.fileSize = builder.fileSize()
-		list = append(list, &meta)
 	}
-
-	for i := 0; i < len(c.inputs[0]); i++ {
-		if err := db.current.deleteFile(c.level, c.inputs[0][i], true); err != nil {
-			return err
+	if builder != nil {
+		if err := finishOutput(nil); err != nil {
+			return nil, err
 		}
 	}
-	for i := 0; i < len(c.inputs[1]); i++ {
-		if err = db.current.deleteFile(c.level+1, c.inputs[1][i], true); err != nil {
-			return err
+	return list, nil
+}
+
+// installCompactionResults replaces the inputs of c by outputs in the current version.
+// REQUIRES: db.mu and db.muCompaction held.
+func (db *DB) installCompactionResults(cfd *columnFamilyData, c *compaction, outputs []*fileMetaData) error {
+	// a run may share its file list with the version, which is changed below
+	var runs []sortedRun
+	for _, run := range c.sortedRuns() {
+		runs = append(runs, sortedRun{level: run.level, files: append([]*fileMetaData(nil), run.files...)})
+	}
+	stats := db.option.Statistics
+	for i := 0; i < len(runs); i++ {
+		for j := 0; j < len(runs[i].files); j++ {
+			cfd.current.deleteFile(runs[i].level, runs[i].files[j], false)
+			if !c.deletion {
+				stats.record(tickerCompactionBytesRead, runs[i].files[j].fileSize)
+			}
 		}
 	}
-	for i := 0; i < len(list); i++ {
-		db.current.addFile(c.level+1, list[i])
+	for i := 0; i < len(outputs); i++ {
+		cfd.current.addFile(c.outputLevel, outputs[i])
+		db.compactedBytes += outputs[i].fileSize
+		cfd.compactedBytes += outputs[i].fileSize
+		stats.record(tickerCompactionBytesWritten, outputs[i].fileSize)
+	}
+
+	// inputs are deleted once the manifest no longer refers to them
+	if err := db.saveManifestFile(); err != nil {
+		return err
+	}
+	for i := 0; i < len(runs); i++ {
+		for j := 0; j < len(runs[i].files); j++ {
+			number := runs[i].files[j].number
+			db.cache.evict(number)
+			if err := db.removeObsoleteFile(sstableFileName(db.option.DirPath, number)); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
-func (db *DB) makeInputIterator(c *compaction) (Iterator, error) {
+// makeInputIterator returns an iterator over all entries of the inputs of c,
+// along with their range tombstones. Input files whose keys are all deleted
+// by a range tombstone of a newer input, visible at snapshot, are left out.
+func (db *DB) makeInputIterator(cfd *columnFamilyData, c *compaction, snapshot SequenceNumber) (Iterator, rangeTombstones, error) {
 	list := make([][]Iterator, 0)
-	// first level
-	if c.level == 0 {
-		for i := 0; i < len(c.inputs[0]); i++ {
-			table, err := db.cache.getTable(c.inputs[0][i].number)
-			if err != nil {
-				return nil, err
-			}
-			tmp := make([]Iterator, 0)
-			tmp = append(tmp, newSSTableIterator(table))
-			list = append(list, tmp)
-		}
-	} else {
+	var tombstones rangeTombstones
+	cache := db.cache.withOption(&cfd.option)
+	// every sorted run is merged through its own level iterator
+	runs := c.sortedRuns()
+	for i := 0; i < len(runs); i++ {
 		tmp := make([]Iterator, 0)
-		for i := 0; i < len(c.inputs[0]); i++ {
-			table, err := db.cache.getTable(c.inputs[0][i].number)
+		var run_tombstones rangeTombstones
+		for j := 0; j < len(runs[i].files); j++ {
+			meta := runs[i].files[j]
+			table, err := cache.getCompactionInput(meta.number)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
+			}
+			if i > 0 && tombstones.coversRange(meta.smallest.ExtractUserKey(), meta.largest.ExtractUserKey(), table.largestSeq(), snapshot) {
+				continue
 			}
 			tmp = append(tmp, newSSTableIterator(table))
+			run_tombstones = append(run_tombstones, table.tombstones...)
 		}
 		list = append(list, tmp)
+		tombstones = append(tombstones, run_tombstones...)
 	}
 
-	// second level
-	tmp := make([]Iterator, 0)
-	for i := 0; i < len(c.inputs[1]); i++ {
-		table, err := db.cache.getTable(c.inputs[1][i].number)
-		if err != nil {
-			return nil, err
-		}
-		tmp = append(tmp, newSSTableIterator(table))
-	}
-	list = append(list, tmp)
-
-	return newDeduplicationIterator(newMergeIterator(list)), nil
+	// doCompaction sees every version of a key, deletions included
+	return newMergeIterator(list), tombstones, nil
 }
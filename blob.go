@@ -0,0 +1,423 @@
+package goleveldb
+
+import (
+	"sync"
+)
+
+// Values of at least Options.MinBlobSize bytes are moved out of the LSM tree
+// when their memtable is flushed. They are appended to a blob file, and the
+// sstables keep a KTypeBlobIndex entry pointing to them instead, so that
+// compactions no longer rewrite them.
+//
+// A blob file is a sequence of records, never modified once written:
+//
+//	key: length prefixed user key
+//	value: length prefixed
+//
+// The key lets garbage collection find out whether the value is still live.
+
+const (
+	kBlobIndexSize = 20
+	// kRelocatedBlobIndexSize is the size of the index of a value moved by
+	// garbage collection, which also holds the sequence number of its write.
+	kRelocatedBlobIndexSize = kBlobIndexSize + 8
+)
+
+// blobIndex locates a value in a blob file.
+type blobIndex struct {
+	fileNumber uint64
+	offset     uint64 // Offset of the value in the file
+	size       uint32 // Size of the value in bytes
+
+	// written is the sequence number of the write of the value if garbage
+	// collection moved it, zero otherwise. The entry pointing to the new
+	// place gets a new sequence number, so that it is newer than the entry
+	// it replaces, but transactions only conflict with the original write.
+	written SequenceNumber
+}
+
+func (index *blobIndex) encodeTo() []byte {
+	size := kBlobIndexSize
+	if index.written != 0 {
+		size = kRelocatedBlobIndexSize
+	}
+	buf := make([]byte, size)
+	EncodeFixed64(buf[0:8], index.fileNumber)
+	EncodeFixed64(buf[8:16], index.offset)
+	EncodeFixed32(buf[16:20], index.size)
+	if index.written != 0 {
+		EncodeFixed64(buf[20:28], uint64(index.written))
+	}
+	return buf
+}
+
+func (index *blobIndex) decodeFrom(data []byte) error {
+	if len(data) != kBlobIndexSize && len(data) != kRelocatedBlobIndexSize {
+		return ErrByteCoding
+	}
+	index.fileNumber = DecodeFixed64(data[0:8])
+	index.offset = DecodeFixed64(data[8:16])
+	index.size = DecodeFixed32(data[16:20])
+	index.written = 0
+	if len(data) == kRelocatedBlobIndexSize {
+		index.written = SequenceNumber(DecodeFixed64(data[20:28]))
+	}
+	return nil
+}
+
+// writtenSequence returns the sequence number of the write of the version
+// key holds, which differs from the one of key for relocated blob values.
+func writtenSequence(key InternalKey, value []byte) SequenceNumber {
+	if key.ExtractValueType() == KTypeBlobIndex && len(value) == kRelocatedBlobIndexSize {
+		return SequenceNumber(DecodeFixed64(value[20:28]))
+	}
+	return key.ExtractSequenceNumber()
+}
+
+// blobFileBuilder appends values to a new blob file.
+type blobFileBuilder struct {
+	file        WritableFile
+	number      uint64
+	offset      uint64
+	rateLimiter *RateLimiter // Options.RateLimiter, may be nil
+	priority    IOPriority   // Of the writes, for rateLimiter
+}
+
+func newBlobFileBuilder(env Env, dirpath string, number uint64, rate_limiter *RateLimiter, priority IOPriority) (*blobFileBuilder, error) {
+	var builder blobFileBuilder
+	var err error
+	builder.file, err = env.NewWritableFile(blobFileName(dirpath, number))
+	if err != nil {
+		return nil, err
+	}
+	builder.number = number
+	builder.rateLimiter = rate_limiter
+	builder.priority = priority
+	return &builder, nil
+}
+
+// add appends a record and returns where its value is stored.
+func (builder *blobFileBuilder) add(key UserKey, value []byte) (blobIndex, error) {
+	record := PutLengthPrefixedSlice(key)
+	record = append(record, PutLengthPrefixedSlice(value)...)
+	if builder.rateLimiter != nil {
+		builder.rateLimiter.Request(int64(len(record)), builder.priority)
+	}
+	if err := builder.file.Append(string(record)); err != nil {
+		return blobIndex{}, err
+	}
+	index := blobIndex{
+		fileNumber: builder.number,
+		offset:     builder.offset + uint64(len(record)-len(value)),
+		size:       uint32(len(value)),
+	}
+	builder.offset += uint64(len(record))
+	return index, nil
+}
+
+func (builder *blobFileBuilder) finish() error {
+	if err := builder.file.Sync(); err != nil {
+		builder.file.Close()
+		return err
+	}
+	return builder.file.Close()
+}
+
+// blobRecord is a record read back from a blob file.
+type blobRecord struct {
+	key   UserKey
+	index blobIndex
+}
+
+// readBlobFile returns all records of the blob file number.
+func readBlobFile(env Env, dirpath string, number uint64) ([]blobRecord, error) {
+	data, err := readFile(env, blobFileName(dirpath, number))
+	if err != nil {
+		return nil, err
+	}
+
+	var records []blobRecord
+	offset := uint32(0)
+	for offset < uint32(len(data)) {
+		key, n := GetLengthPrefixedSlice(data[offset:])
+		offset += n
+		value, n := GetLengthPrefixedSlice(data[offset:])
+		records = append(records, blobRecord{
+			key: key,
+			index: blobIndex{
+				fileNumber: number,
+				offset:     uint64(offset + n - uint32(len(value))),
+				size:       uint32(len(value)),
+			},
+		})
+		offset += n
+	}
+	return records, nil
+}
+
+// blobCache keeps blob files open for reading values.
+type blobCache struct {
+	env     Env
+	dirPath string
+
+	mu    sync.Mutex
+	files map[uint64]RandomAccessFile
+}
+
+func newBlobCache(env Env, dirPath string) *blobCache {
+	var bc blobCache
+	bc.env = env
+	bc.dirPath = dirPath
+	bc.files = make(map[uint64]RandomAccessFile)
+	return &bc
+}
+
+// get returns the value the encoded blob index points to.
+func (bc *blobCache) get(encoded []byte) ([]byte, error) {
+	var index blobIndex
+	if err := index.decodeFrom(encoded); err != nil {
+		return nil, err
+	}
+	bc.mu.Lock()
+	file, ok := bc.files[index.fileNumber]
+	if !ok {
+		var err error
+		file, err = bc.env.NewRandomAccessFile(blobFileName(bc.dirPath, index.fileNumber))
+		if err != nil {
+			bc.mu.Unlock()
+			return nil, err
+		}
+		bc.files[index.fileNumber] = file
+	}
+	bc.mu.Unlock()
+	return file.Read(index.offset, index.size)
+}
+
+// evict closes the blob file number if it is open.
+func (bc *blobCache) evict(fileNumber uint64) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if file, ok := bc.files[fileNumber]; ok {
+		file.Close()
+		delete(bc.files, fileNumber)
+	}
+}
+
+func (bc *blobCache) close() {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	for number, file := range bc.files {
+		file.Close()
+		delete(bc.files, number)
+	}
+}
+
+// encodeBlobFilesTo encodes the blob files of every column family.
+//
+//	num_files: fixed32
+//	files: num_files times
+//	  column_family_id: fixed32
+//	  number: fixed64
+func (db *DB) encodeBlobFilesTo() []byte {
+	buf := make([]byte, 4)
+	num := uint32(0)
+	for id := uint32(0); id < db.nextFamilyID; id++ {
+		cfd, ok := db.families[id]
+		if !ok {
+			continue
+		}
+		for _, number := range cfd.blobFiles {
+			tmp := make([]byte, 12)
+			EncodeFixed32(tmp[0:4], cfd.id)
+			EncodeFixed64(tmp[4:12], number)
+			buf = append(buf, tmp...)
+			num++
+		}
+	}
+	EncodeFixed32(buf, num)
+	return buf
+}
+
+func (db *DB) decodeBlobFilesFrom(data []byte) {
+	if len(data) == 0 {
+		// written before blob files existed
+		return
+	}
+	num := DecodeFixed32(data)
+	offset := 4
+	for i := uint32(0); i < num; i++ {
+		id := DecodeFixed32(data[offset:])
+		number := DecodeFixed64(data[offset+4:])
+		offset += 12
+		if cfd, ok := db.families[id]; ok {
+			cfd.blobFiles = append(cfd.blobFiles, number)
+		}
+	}
+}
+
+// GarbageCollectBlobs reclaims the space of overwritten and deleted values in
+// blob files. A blob file in which at least Options.BlobGCRatio of the bytes
+// are garbage is rewritten: its live values are copied to a new blob file and
+// their keys updated to point there. The old
+// file is deleted once no snapshot or open iterator can read it any more,
+// possibly by a later call.
+func (db *DB) GarbageCollectBlobs() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	db.muGC.Lock()
+	defer db.muGC.Unlock()
+
+	db.mu.Lock()
+	families := make([]*columnFamilyData, 0, len(db.families))
+	for _, cfd := range db.families {
+		families = append(families, cfd)
+	}
+	db.mu.Unlock()
+
+	for _, cfd := range families {
+		db.muCompaction.Lock()
+		numbers := append([]uint64(nil), cfd.blobFiles...)
+		db.muCompaction.Unlock()
+		for _, number := range numbers {
+			if err := db.collectBlobFile(cfd, number); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (db *DB) collectBlobFile(cfd *columnFamilyData, number uint64) error {
+	records, err := readBlobFile(db.option.env(), db.option.DirPath, number)
+	if err != nil {
+		return err
+	}
+	var live []blobRecord
+	var total_size, live_size uint64
+	for _, record := range records {
+		total_size += uint64(record.index.size)
+		ok, _, pinned, err := db.blobLive(cfd, &record)
+		if err != nil {
+			return err
+		}
+		if pinned {
+			return nil
+		}
+		if ok {
+			live = append(live, record)
+			live_size += uint64(record.index.size)
+		}
+	}
+	if float64(total_size-live_size) < cfd.option.BlobGCRatio*float64(total_size) {
+		return nil
+	}
+
+	// copy the live values to a new blob file
+	var indexes []blobIndex
+	if len(live) > 0 {
+		new_number := db.newFileNumber()
+		builder, err := newBlobFileBuilder(db.option.env(), db.option.DirPath, new_number, db.option.RateLimiter, IOPriorityLow)
+		if err != nil {
+			return err
+		}
+		for _, record := range live {
+			value, err := db.blobs.get(record.index.encodeTo())
+			if err != nil {
+				return err
+			}
+			index, err := builder.add(record.key, value)
+			if err != nil {
+				return err
+			}
+			indexes = append(indexes, index)
+		}
+		if err := builder.finish(); err != nil {
+			return err
+		}
+		db.mu.Lock()
+		db.muCompaction.Lock()
+		cfd.blobFiles = append(cfd.blobFiles, new_number)
+		err = db.saveManifestFile()
+		db.muCompaction.Unlock()
+		db.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	// point the keys to their new place, unless they were written meanwhile.
+	// The new entries are newer than the old ones, but keep the sequence
+	// numbers of their writes for transactions.
+	db.muWrite.Lock()
+	var relocated WriteBatch
+	keep_file := false
+	for i := 0; i < len(live); i++ {
+		ok, seq, pinned, err := db.blobLive(cfd, &live[i])
+		if err != nil {
+			db.muWrite.Unlock()
+			return err
+		}
+		keep_file = keep_file || pinned
+		if ok {
+			indexes[i].written = seq
+			relocated.add(cfd.id, KTypeBlobIndex, live[i].key, indexes[i].encodeTo())
+		}
+	}
+	err = db.writeBatch(&relocated)
+	db.mu.Lock()
+	last_sequence := db.lastSequence()
+	db.mu.Unlock()
+	db.muWrite.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if keep_file || db.smallestSnapshot() < last_sequence {
+		// the file is still read from, a later collection deletes it
+		return nil
+	}
+	db.mu.Lock()
+	db.muCompaction.Lock()
+	for i, n := range cfd.blobFiles {
+		if n == number {
+			cfd.blobFiles = append(cfd.blobFiles[:i], cfd.blobFiles[i+1:]...)
+			break
+		}
+	}
+	err = db.saveManifestFile()
+	db.muCompaction.Unlock()
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	db.blobs.evict(number)
+	return db.removeObsoleteFile(blobFileName(db.option.DirPath, number))
+}
+
+// blobLive reports whether the value of record is the current value of its
+// key, along with the sequence number of the write of that version. pinned is set if merge
+// operands are stacked on a value in a blob file, which can then not be moved.
+func (db *DB) blobLive(cfd *columnFamilyData, record *blobRecord) (bool, SequenceNumber, bool, error) {
+	// without blob resolution the blob index comes back as the value
+	ctx := newMergeContext(nil, record.key)
+	value, err := db.lookup(cfd, record.key, nil, ctx)
+	if len(ctx.operands) > 0 {
+		return false, 0, ctx.found == KTypeBlobIndex, nil
+	}
+	if err == ErrKeyNotFound {
+		return false, 0, false, nil
+	} else if err != nil {
+		return false, 0, false, err
+	}
+	if ctx.found != KTypeBlobIndex {
+		return false, 0, false, nil
+	}
+	var index blobIndex
+	if err := index.decodeFrom(value); err != nil {
+		return false, 0, false, err
+	}
+	// a live value is the newest version, newer than the tombstones covering it
+	same_place := index.fileNumber == record.index.fileNumber && index.offset == record.index.offset && index.size == record.index.size
+	return same_place, ctx.latest, false, nil
+}
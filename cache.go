@@ -4,14 +4,16 @@ import lru "github.com/hashicorp/golang-lru"
 
 // cache sstable in memory
 type tableCache struct {
-	option *Options
-	cache  *lru.Cache
+	option   *Options
+	dbOption *Options // Of the DB, for the options all column families share
+	cache    *lru.Cache
 }
 
 func newTableCache(option *Options) (*tableCache, error) {
 	var tc tableCache
 	var err error
 	tc.option = option
+	tc.dbOption = option
 	tc.cache, err = lru.New(int(option.MaxOpenFiles))
 	if err != nil {
 		return nil, err
@@ -19,24 +21,54 @@ func newTableCache(option *Options) (*tableCache, error) {
 	return &tc, nil
 }
 
-func (tc *tableCache) get(fileNumber uint64, key InternalKey) ([]byte, error) {
+// withOption returns a view of tc sharing its cached tables, used by the
+// versions of column families with their own options.
+func (tc *tableCache) withOption(option *Options) *tableCache {
+	return &tableCache{option: option, dbOption: tc.dbOption, cache: tc.cache}
+}
+
+func (tc *tableCache) get(fileNumber uint64, key InternalKey, ctx *mergeContext) ([]byte, error) {
 	table, err := tc.getTable(fileNumber)
 	if err != nil {
 		return nil, err
 	}
-	return table.get(key)
+	return table.get(key, ctx)
 }
 
 func (tc *tableCache) evict(fileNumber uint64) bool {
 	return tc.cache.Remove(fileNumber)
 }
 
+// getCompactionInput returns the table fileNumber for a compaction. A table
+// not in the cache is read at the pace of Options.RateLimiter, if it limits
+// reads. With Options.UseDirectIOForCompaction, it is read around the page
+// cache and left out of the table cache, as it is about to be replaced.
+func (tc *tableCache) getCompactionInput(fileNumber uint64) (*sstable, error) {
+	if table, ok := tc.cache.Peek(fileNumber); ok {
+		return table.(*sstable), nil
+	}
+	name := sstableFileName(tc.option.DirPath, fileNumber)
+	if rl := tc.dbOption.RateLimiter; rl != nil && rl.limitReads {
+		size, err := tc.option.env().GetFileSize(name)
+		if err != nil {
+			return nil, err
+		}
+		rl.Request(int64(size), IOPriorityLow)
+	}
+	if !tc.option.UseDirectIOForCompaction {
+		return tc.getTable(fileNumber)
+	}
+	return openDirectSSTable(tc.option.env(), name)
+}
+
 func (tc *tableCache) getTable(fileNumber uint64) (*sstable, error) {
 	table, ok := tc.cache.Get(fileNumber)
 	if ok {
+		tc.dbOption.Statistics.record(tickerTableCacheHits, 1)
 		return table.(*sstable), nil
 	} else {
-		table, err := openSSTable(sstableFileName(tc.option.DirPath, fileNumber))
+		tc.dbOption.Statistics.record(tickerTableCacheMisses, 1)
+		table, err := openSSTable(tc.option.env(), sstableFileName(tc.option.DirPath, fileNumber), tc.option.UseMmapReads)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,138 @@
+package goleveldb
+
+import "os"
+
+// Checkpoint creates in dir, which must not exist, a consistent copy of the DB
+// that can be opened as an independent DB. Tables and blob files are hard linked
+// where possible, the logs not yet flushed are copied.
+// Writes wait only while the files of the checkpoint are listed, obsolete
+// files are not deleted until the checkpoint is taken.
+func (db *DB) Checkpoint(dir string) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	env := db.option.env()
+	if env.FileExists(dir) {
+		return os.ErrExist
+	}
+	// built aside, so that a failed checkpoint leaves nothing behind
+	tmpDir := dir + ".tmp"
+	if err := removeDir(env, tmpDir); err != nil {
+		return err
+	}
+	if err := env.CreateDir(tmpDir); err != nil {
+		return err
+	}
+
+	db.pauseFileDeletions()
+	err := db.checkpointTo(tmpDir)
+	if resume_err := db.resumeFileDeletions(); err == nil {
+		err = resume_err
+	}
+	if err != nil {
+		removeDir(env, tmpDir)
+		return err
+	}
+	return env.RenameFile(tmpDir, dir)
+}
+
+// checkpointTo lists the files of the current state under the locks, and
+// links or copies them to dir without holding the locks.
+// REQUIRES: file deletions paused.
+func (db *DB) checkpointTo(dir string) error {
+	env := db.option.env()
+	db.muWrite.Lock()
+	db.mu.Lock()
+	db.muCompaction.Lock()
+	var tables, blobs []uint64
+	for _, cfd := range db.families {
+		for level := 0; level < int(NumLevels); level++ {
+			for _, meta := range cfd.current.files[level] {
+				tables = append(tables, meta.number)
+			}
+		}
+		blobs = append(blobs, cfd.blobFiles...)
+	}
+	manifest := db.encodeManifest()
+	min_log := db.minLogNumber()
+	db.muCompaction.Unlock()
+	db.mu.Unlock()
+
+	// the current log is still appended to, so the logs are copied up to
+	// their size while writes wait
+	logs := make(map[uint64]uint64)
+	err := db.logWriter.syncWrites()
+	var names []string
+	if err == nil {
+		names, err = env.GetChildren(db.option.DirPath)
+	}
+	for _, name := range names {
+		number, ext, ok := parseFileName(name)
+		if err != nil || !ok || ext != "log" || number < min_log {
+			continue
+		}
+		logs[number], err = env.GetFileSize(walFileName(db.option.DirPath, number))
+	}
+	db.muWrite.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, number := range tables {
+		if err := linkFile(env, sstableFileName(db.option.DirPath, number), sstableFileName(dir, number)); err != nil {
+			return err
+		}
+	}
+	for _, number := range blobs {
+		if err := linkFile(env, blobFileName(db.option.DirPath, number), blobFileName(dir, number)); err != nil {
+			return err
+		}
+	}
+	for number, size := range logs {
+		if err := copyFilePrefix(env, walFileName(db.option.DirPath, number), size, env, walFileName(dir, number)); err != nil {
+			return err
+		}
+	}
+	return writeManifest(env, dir, manifest)
+}
+
+// pauseFileDeletions keeps the files that become obsolete from now on
+// until resumeFileDeletions is called as often.
+func (db *DB) pauseFileDeletions() {
+	db.muDeletion.Lock()
+	defer db.muDeletion.Unlock()
+	db.deletionsPaused++
+}
+
+// resumeFileDeletions deletes the files kept since the matching call of
+// pauseFileDeletions, unless deletions are still paused by another caller.
+func (db *DB) resumeFileDeletions() error {
+	db.muDeletion.Lock()
+	db.deletionsPaused--
+	var pending []string
+	if db.deletionsPaused == 0 {
+		pending, db.pendingDeletions = db.pendingDeletions, nil
+	}
+	db.muDeletion.Unlock()
+
+	var result error
+	for _, name := range pending {
+		if err := db.option.env().RemoveFile(name); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// removeObsoleteFile deletes the file name, which the DB no longer needs,
+// or keeps it until file deletions resume.
+func (db *DB) removeObsoleteFile(name string) error {
+	db.muDeletion.Lock()
+	if db.deletionsPaused > 0 {
+		db.pendingDeletions = append(db.pendingDeletions, name)
+		db.muDeletion.Unlock()
+		return nil
+	}
+	db.muDeletion.Unlock()
+	return db.option.env().RemoveFile(name)
+}
@@ -0,0 +1,30 @@
+// Command repair rebuilds the manifest of a goleveldb directory whose
+// manifest is lost or damaged. See goleveldb.Repair.
+//
+//	repair -dir /path/to/db
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/huayichai/goleveldb"
+)
+
+func main() {
+	dir := flag.String("dir", "", "directory of the DB to repair")
+	flag.Parse()
+	if *dir == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	options := goleveldb.DefaultOptions()
+	options.DirPath = *dir
+	if err := goleveldb.Repair(*options); err != nil {
+		fmt.Fprintf(os.Stderr, "repair %s: %v\n", *dir, err)
+		os.Exit(1)
+	}
+	fmt.Printf("repaired %s\n", *dir)
+}
@@ -0,0 +1,215 @@
+package goleveldb
+
+import "encoding/binary"
+
+// DefaultColumnFamilyName is the column family used by DB.Put, DB.Get,
+// DB.Delete, DB.Scan and the other methods not taking a handle.
+const DefaultColumnFamilyName = "default"
+
+const kDefaultColumnFamilyID uint32 = 0
+
+// ColumnFamilyHandle refers to a column family of an open DB.
+type ColumnFamilyHandle struct {
+	cfd *columnFamilyData
+}
+
+// Name returns the name the column family was created with.
+func (handle *ColumnFamilyHandle) Name() string {
+	return handle.cfd.name
+}
+
+// ID returns the identifier stored with the records of the column family.
+func (handle *ColumnFamilyHandle) ID() uint32 {
+	return handle.cfd.id
+}
+
+// columnFamilyData is a keyspace with its own memtables, levels and options.
+// All column families share the write ahead log, the sequence numbers, the
+// file numbers and the table cache of their DB.
+type columnFamilyData struct {
+	id     uint32
+	name   string
+	option Options
+
+	mem  *memTable   // Memtable
+	imms []*memTable // Memtables waiting to be flushed, oldest first
+
+	// File numbers and sequence numbers are allocated from the version of
+	// the default column family only.
+	current *version
+
+	blobFiles []uint64 // Blob files holding values of the sstables, guarded by muCompaction
+
+	flushedBytes   uint64 // Bytes of level-0 tables written by flushes, guarded by muCompaction
+	compactedBytes uint64 // Bytes of tables written by compactions, guarded by muCompaction
+}
+
+func (db *DB) newColumnFamilyData(id uint32, name string, option Options) *columnFamilyData {
+	var cfd columnFamilyData
+	cfd.id = id
+	cfd.name = name
+	cfd.option = option
+	// files of every column family live in the DB directory, and are read
+	// and written like those of the DB
+	cfd.option.DirPath = db.option.DirPath
+	cfd.option.Env = db.option.Env
+	cfd.option.Sync = db.option.Sync
+	cfd.option.MaxOpenFiles = db.option.MaxOpenFiles
+	cfd.option.UseMmapReads = db.option.UseMmapReads
+	cfd.option.UseDirectIOForCompaction = db.option.UseDirectIOForCompaction
+	cfd.option.DropPageCacheAfterFlush = db.option.DropPageCacheAfterFlush
+	cfd.option.RateLimiter = db.option.RateLimiter
+	cfd.option.Statistics = db.option.Statistics
+	cfd.option.CompactionInterval = db.option.CompactionInterval
+	cfd.option.MaxBackgroundFlushes = db.option.MaxBackgroundFlushes
+	cfd.option.MaxBackgroundCompactions = db.option.MaxBackgroundCompactions
+	cfd.current = newVersion(db.cache.withOption(&cfd.option))
+	return &cfd
+}
+
+// newMemTable returns an empty memtable of cfd, logged to the log logNumber.
+func (cfd *columnFamilyData) newMemTable(logNumber uint64) *memTable {
+	mem := newMemTable(walFileName(cfd.option.DirPath, logNumber))
+	mem.logNumber = logNumber
+	mem.family = cfd
+	return mem
+}
+
+// CreateColumnFamily adds a column family using option. Only the options
+// about memtables, sstables, compaction and merging apply to a column family.
+// The others, such as Env, Sync, UseMmapReads, RateLimiter and Statistics,
+// are those of the DB.
+// The column family is recorded in the manifest before it is returned, and
+// recovered by Open with the options in Options.ColumnFamilyOptions.
+func (db *DB) CreateColumnFamily(name string, option Options) (*ColumnFamilyHandle, error) {
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+	db.mu.Lock()
+	db.muCompaction.Lock()
+	defer db.mu.Unlock()
+	defer db.muCompaction.Unlock()
+
+	if db.findColumnFamily(name) != nil {
+		return nil, ErrColumnFamilyExists
+	}
+	cfd := db.newColumnFamilyData(db.nextFamilyID, name, option)
+	db.nextFamilyID++
+	cfd.mem = cfd.newMemTable(db.currentLogFileNumber)
+	db.families[cfd.id] = cfd
+	// recorded at once, so that the records of cfd are recovered
+	if err := db.saveManifestFile(); err != nil {
+		return nil, err
+	}
+	return &ColumnFamilyHandle{cfd: cfd}, nil
+}
+
+// GetColumnFamily returns the handle of the column family called name.
+func (db *DB) GetColumnFamily(name string) (*ColumnFamilyHandle, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	cfd := db.findColumnFamily(name)
+	if cfd == nil {
+		return nil, ErrColumnFamilyNotFound
+	}
+	return &ColumnFamilyHandle{cfd: cfd}, nil
+}
+
+// DefaultColumnFamily returns the handle of the default column family.
+func (db *DB) DefaultColumnFamily() *ColumnFamilyHandle {
+	return &ColumnFamilyHandle{cfd: db.defaultFamily}
+}
+
+// REQUIRES: db.mu held.
+func (db *DB) findColumnFamily(name string) *columnFamilyData {
+	for _, cfd := range db.families {
+		if cfd.name == name {
+			return cfd
+		}
+	}
+	return nil
+}
+
+// familyOptions returns the options a recovered column family is opened with.
+func (db *DB) familyOptions(name string) Options {
+	if option, ok := db.option.ColumnFamilyOptions[name]; ok {
+		return option
+	}
+	return db.option
+}
+
+// encodeColumnFamiliesTo encodes the column families other than the default one.
+//
+//	num_families: fixed32
+//	families: num_families times
+//	  id: fixed32
+//	  name: length prefixed
+//	  files: see version.encodeFilesTo
+func (db *DB) encodeColumnFamiliesTo() []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(len(db.families)-1))
+	for id := uint32(0); id < db.nextFamilyID; id++ {
+		cfd, ok := db.families[id]
+		if !ok || id == kDefaultColumnFamilyID {
+			continue
+		}
+		tmp := make([]byte, 4)
+		binary.LittleEndian.PutUint32(tmp, cfd.id)
+		buf = append(buf, tmp...)
+		buf = append(buf, PutLengthPrefixedSlice([]byte(cfd.name))...)
+		buf = append(buf, cfd.current.encodeFilesTo()...)
+	}
+	return buf
+}
+
+// decodeColumnFamiliesFrom decodes the column families written by
+// encodeColumnFamiliesTo in the manifest format, and returns the number of bytes read.
+func (db *DB) decodeColumnFamiliesFrom(data []byte, format uint32) uint32 {
+	if len(data) == 0 {
+		// written before column families existed
+		return 0
+	}
+	num := binary.LittleEndian.Uint32(data)
+	offset := uint32(4)
+	for i := uint32(0); i < num; i++ {
+		id := binary.LittleEndian.Uint32(data[offset:])
+		offset += 4
+		name, n := GetLengthPrefixedSlice(data[offset:])
+		offset += n
+		cfd := db.newColumnFamilyData(id, string(name), db.familyOptions(string(name)))
+		offset += cfd.current.decodeFilesFrom(data[offset:], format)
+		db.families[id] = cfd
+		if id >= db.nextFamilyID {
+			db.nextFamilyID = id + 1
+		}
+	}
+	return offset
+}
+
+// PutCF sets the value for key in the column family cf.
+func (db *DB) PutCF(cf *ColumnFamilyHandle, key, value []byte) error {
+	return db.write(cf.cfd, KTypeValue, key, value)
+}
+
+// DeleteCF deletes key from the column family cf.
+func (db *DB) DeleteCF(cf *ColumnFamilyHandle, key []byte) error {
+	return db.write(cf.cfd, KTypeDeletion, key, []byte{})
+}
+
+// GetCF returns the value for key in the column family cf.
+func (db *DB) GetCF(cf *ColumnFamilyHandle, key []byte) ([]byte, error) {
+	return db.get(cf.cfd, key, nil)
+}
+
+// GetPropertyCF returns the value of the property name of the column family cf,
+// see DB.GetProperty.
+func (db *DB) GetPropertyCF(cf *ColumnFamilyHandle, name string) (string, bool) {
+	return db.getProperty(cf.cfd, name)
+}
+
+// ScanCF returns an iterator over the column family cf, positioned at the first key not less than key.
+// The iterator must be closed after use.
+func (db *DB) ScanCF(cf *ColumnFamilyHandle, key []byte) (*DBIterator, error) {
+	return db.newDBIterator(cf.cfd, key, db.acquireSnapshot())
+}
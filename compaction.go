@@ -1,33 +1,124 @@
 package goleveldb
 
+import "sort"
+
 type compaction struct {
-	level  int
-	inputs [2][]*fileMetaData
+	level       int
+	inputs      [2][]*fileMetaData
+	outputLevel int
+
+	// bottommost is set if no file below outputLevel overlaps the inputs,
+	// so deletion markers can be dropped instead of being written out.
+	bottommost bool
+
+	// deletion is set if the inputs are dropped without being merged.
+	deletion bool
+
+	// runs holds the inputs of a universal compaction, newest first.
+	// Leveled compactions only use level and inputs.
+	runs []sortedRun
+}
+
+// sortedRun is a set of files whose key ranges do not overlap:
+// either a single level-0 file or all files of a deeper level.
+type sortedRun struct {
+	level int
+	files []*fileMetaData
 }
 
 // Is this a trivial compaction that can be implemented by just
 // moving a single input file to the next level (no merging or splitting)
 func (c *compaction) isTrivialMove() bool {
-	return len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0
+	return c.runs == nil && len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0
+}
+
+// sortedRuns returns the inputs of c grouped into sorted runs, newest first.
+func (c *compaction) sortedRuns() []sortedRun {
+	if c.runs != nil {
+		return c.runs
+	}
+	var runs []sortedRun
+	if c.level == 0 {
+		// Files in level 0 may overlap each other, so each one is a run.
+		// Newer files have higher numbers.
+		files := append([]*fileMetaData(nil), c.inputs[0]...)
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].number > files[j].number
+		})
+		for i := 0; i < len(files); i++ {
+			runs = append(runs, sortedRun{level: 0, files: []*fileMetaData{files[i]}})
+		}
+	} else {
+		runs = append(runs, sortedRun{level: c.level, files: c.inputs[0]})
+	}
+	runs = append(runs, sortedRun{level: c.level + 1, files: c.inputs[1]})
+	return runs
 }
 
+// pickCompaction picks a compaction whose input files are not reserved by
+// any running compaction. Levels are tried in descending score order, so a
+// busy level does not prevent other levels from being compacted concurrently.
+// The next compaction of the input level starts after the picked inputs.
+// REQUIRES: db.muCompaction held.
 func (v *version) pickCompaction() *compaction {
-	var c compaction
-	c.level, _ = v.pickCompactionLevel()
-	if c.level < 0 {
-		return nil
+	c := v.chooseCompaction()
+	if c != nil && c.runs == nil && !c.deletion {
+		_, largest := v.getRange(c.inputs[0])
+		v.compactPointer[c.level] = largest
+	}
+	return c
+}
+
+// needsCompaction reports whether pickCompaction would pick a compaction,
+// without moving on the compaction pointers.
+// REQUIRES: db.muCompaction held.
+func (v *version) needsCompaction() bool {
+	return v.chooseCompaction() != nil
+}
+
+// chooseCompaction returns the compaction pickCompaction picks, leaving
+// v untouched.
+func (v *version) chooseCompaction() *compaction {
+	switch v.cache.option.CompactionStyle {
+	case CompactionStyleUniversal:
+		return v.pickUniversalCompaction()
+	case CompactionStyleFIFO:
+		return v.pickFIFOCompaction()
+	}
+	for _, level := range v.pickCompactionLevels() {
+		if c := v.pickLevelCompaction(level); c != nil {
+			return c
+		}
 	}
+	return nil
+}
+
+func (v *version) pickLevelCompaction(level int) *compaction {
+	var c compaction
+	c.level = level
+	c.outputLevel = level + 1
 
-	// Pick the first file that comes after compact_pointer_[level]
+	// Pick the first free file that comes after compact_pointer_[level]
 	for i := 0; i < len(v.files[c.level]); i++ {
 		f := v.files[c.level][i]
+		if f.beingCompacted {
+			continue
+		}
 		if v.compactPointer[c.level] == nil || InternalKeyCompare(f.largest, v.compactPointer[c.level]) > 0 {
 			c.inputs[0] = append(c.inputs[0], f)
 			break
 		}
 	}
 	if len(c.inputs[0]) == 0 {
-		c.inputs[0] = append(c.inputs[0], v.files[c.level][0])
+		for i := 0; i < len(v.files[c.level]); i++ {
+			if f := v.files[c.level][i]; !f.beingCompacted {
+				c.inputs[0] = append(c.inputs[0], f)
+				break
+			}
+		}
+	}
+	if len(c.inputs[0]) == 0 {
+		return nil
 	}
 
 	// Files in level 0 may overlap each other, so pick up all overlapping ones
@@ -35,15 +126,26 @@ func (v *version) pickCompaction() *compaction {
 		smallest, largest := v.getRange(c.inputs[0])
 		c.inputs[0] = v.getOverlappingInputs(0, smallest, largest)
 	}
+	if anyBeingCompacted(c.inputs[0]) {
+		return nil
+	}
 
 	v.setupOtherInputs(&c)
+	if anyBeingCompacted(c.inputs[1]) {
+		return nil
+	}
+	c.bottommost = v.isBottommost(&c)
 
 	return &c
 }
 
-func (v *version) pickCompactionLevel() (int, float64) {
-	best_level := -1
-	best_score := 0.0
+// pickCompactionLevels returns the levels that need compaction, best score first.
+func (v *version) pickCompactionLevels() []int {
+	type levelScore struct {
+		level int
+		score float64
+	}
+	var candidates []levelScore
 	for level := 0; level < int(NumLevels-1); level++ {
 		var score float64
 		file_num := len(v.files[level])
@@ -62,6 +164,14 @@ func (v *version) pickCompactionLevel() (int, float64) {
 			// file size is small (perhaps because of a small write-buffer
 			// setting, or very high compression ratios, or lots of
 			// overwrites/deletions).
+			//
+			// Files already being compacted do not count, otherwise we
+			// would keep scheduling level-0 work that cannot be picked.
+			for i := 0; i < file_num; i++ {
+				if v.files[level][i].beingCompacted {
+					file_num--
+				}
+			}
 			score = float64(file_num) / float64(L0_CompactionTrigger)
 		} else {
 			if file_num == 0 {
@@ -71,12 +181,18 @@ func (v *version) pickCompactionLevel() (int, float64) {
 				score = tmp_score
 			}
 		}
-		if score > best_score {
-			best_level = level
-			best_score = score
+		if score > 0 {
+			candidates = append(candidates, levelScore{level, score})
 		}
 	}
-	return best_level, best_score
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+	levels := make([]int, len(candidates))
+	for i := 0; i < len(candidates); i++ {
+		levels[i] = candidates[i].level
+	}
+	return levels
 }
 
 // Stores the minimal range that covers all entries in inputs in
@@ -103,8 +219,9 @@ func (v *version) getRange(metas []*fileMetaData) (InternalKey, InternalKey) {
 func (v *version) getOverlappingInputs(level int, begin, end InternalKey) []*fileMetaData {
 	user_begin, user_end := begin.ExtractUserKey(), end.ExtractUserKey()
 	outputs := make([]*fileMetaData, 0)
-	for i := 0; i < len(v.files[level]); i++ {
+	for i := 0; i < len(v.files[level]); {
 		f := v.files[level][i]
+		i++
 		file_start := f.smallest.ExtractUserKey()
 		file_limit := f.largest.ExtractUserKey()
 		if UserKeyCompare(file_limit, user_begin) < 0 {
@@ -134,7 +251,68 @@ func (v *version) getOverlappingInputs(level int, begin, end InternalKey) []*fil
 func (v *version) setupOtherInputs(c *compaction) {
 	smallest, largest := v.getRange(c.inputs[0])
 	c.inputs[1] = v.getOverlappingInputs(c.level+1, smallest, largest)
-	v.compactPointer[c.level] = largest
+}
+
+// isBottommost reports whether no file in a level below c.outputLevel
+// overlaps the key range of the inputs of c.
+func (v *version) isBottommost(c *compaction) bool {
+	var files []*fileMetaData
+	runs := c.sortedRuns()
+	for i := 0; i < len(runs); i++ {
+		files = append(files, runs[i].files...)
+	}
+	smallest, largest := v.getRange(files)
+	for level := c.outputLevel + 1; level < int(NumLevels); level++ {
+		if len(v.getOverlappingInputs(level, smallest, largest)) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// keyInOtherFiles reports whether a file that is no input of c may hold
+// entries of user_key.
+// REQUIRES: db.muCompaction held.
+func (v *version) keyInOtherFiles(c *compaction, user_key UserKey) bool {
+	inputs := make(map[uint64]bool)
+	runs := c.sortedRuns()
+	for i := 0; i < len(runs); i++ {
+		for j := 0; j < len(runs[i].files); j++ {
+			inputs[runs[i].files[j].number] = true
+		}
+	}
+	for level := 0; level < int(NumLevels); level++ {
+		for _, meta := range v.files[level] {
+			if inputs[meta.number] {
+				continue
+			}
+			if UserKeyCompare(meta.smallest.ExtractUserKey(), user_key) <= 0 && UserKeyCompare(meta.largest.ExtractUserKey(), user_key) >= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func anyBeingCompacted(files []*fileMetaData) bool {
+	for i := 0; i < len(files); i++ {
+		if files[i].beingCompacted {
+			return true
+		}
+	}
+	return false
+}
+
+// markBeingCompacted reserves or releases the input files of c, so that
+// concurrent compactions never pick the same inputs.
+// REQUIRES: db.muCompaction held.
+func (c *compaction) markBeingCompacted(reserved bool) {
+	runs := c.sortedRuns()
+	for i := 0; i < len(runs); i++ {
+		for j := 0; j < len(runs[i].files); j++ {
+			runs[i].files[j].beingCompacted = reserved
+		}
+	}
 }
 
 func totalFileSize(files []*fileMetaData) uint64 {
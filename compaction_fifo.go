@@ -0,0 +1,36 @@
+package goleveldb
+
+import (
+	"sort"
+	"time"
+)
+
+// pickFIFOCompaction picks the oldest level-0 files to delete, while the
+// total size of the files exceeds FIFOMaxTableFilesSize or while the oldest
+// file is older than TTL. Nothing is merged, the picked files are dropped.
+// REQUIRES: db.muCompaction held.
+func (v *version) pickFIFOCompaction() *compaction {
+	option := v.cache.option
+	files := append([]*fileMetaData{}, v.files[0]...)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].number < files[j].number
+	})
+
+	var c compaction
+	total_size := totalFileSize(files)
+	now := uint64(time.Now().Unix())
+	for i := 0; i < len(files); i++ {
+		f := files[i]
+		expired := option.TTL > 0 && f.creationTime+uint64(option.TTL) <= now
+		if total_size <= option.FIFOMaxTableFilesSize && !expired {
+			break
+		}
+		c.runs = append(c.runs, sortedRun{level: 0, files: []*fileMetaData{f}})
+		total_size -= f.fileSize
+	}
+	if len(c.runs) == 0 {
+		return nil
+	}
+	c.deletion = true
+	return &c
+}
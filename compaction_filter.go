@@ -0,0 +1,77 @@
+package goleveldb
+
+// CompactionFilterDecision tells compaction what to do with an entry.
+type CompactionFilterDecision uint8
+
+const (
+	// CompactionFilterKeep writes the entry unchanged.
+	CompactionFilterKeep CompactionFilterDecision = iota
+
+	// CompactionFilterRemove drops the entry, as if the key had been deleted.
+	CompactionFilterRemove
+
+	// CompactionFilterChangeValue writes the entry with the returned value.
+	CompactionFilterChangeValue
+)
+
+// CompactionFilter lets applications drop or rewrite records while they are
+// compacted. Filter is called for the newest visible version of each user key
+// in the compaction, with the level the compaction reads from. Deleted and
+// expired keys are not passed to the filter. Records still in memtables or
+// never compacted again are not filtered.
+type CompactionFilter interface {
+	Filter(level int, key, value []byte) (CompactionFilterDecision, []byte)
+}
+
+// CompactionFilterContext describes the compaction a filter is created for.
+type CompactionFilterContext struct {
+	// Level is the level the compaction reads from.
+	Level int
+
+	// OutputLevel is the level the compaction writes to.
+	OutputLevel int
+
+	// Bottommost is set if no older data lies below OutputLevel.
+	Bottommost bool
+}
+
+// CompactionFilterFactory creates a new CompactionFilter for every compaction,
+// so a filter can keep state without being shared by concurrent compactions.
+type CompactionFilterFactory interface {
+	CreateCompactionFilter(context CompactionFilterContext) CompactionFilter
+}
+
+// newCompactionFilter returns the filter used by compaction c, or nil.
+func (cfd *columnFamilyData) newCompactionFilter(c *compaction) CompactionFilter {
+	if cfd.option.CompactionFilterFactory != nil {
+		return cfd.option.CompactionFilterFactory.CreateCompactionFilter(CompactionFilterContext{
+			Level:       c.level,
+			OutputLevel: c.outputLevel,
+			Bottommost:  c.bottommost,
+		})
+	}
+	return cfd.option.CompactionFilter
+}
+
+// applyCompactionFilter runs filter on a visible entry of compaction c.
+// It returns the value to write, with any ttl kept, or removed set if the
+// entry has to be treated as deleted.
+func applyCompactionFilter(filter CompactionFilter, c *compaction, key InternalKey, value []byte) ([]byte, bool) {
+	user_value := value
+	if key.ExtractValueType() == KTypeValueWithTTL {
+		_, user_value = decodeTTLValue(value)
+	}
+
+	decision, new_value := filter.Filter(c.level, key.ExtractUserKey(), user_value)
+	switch decision {
+	case CompactionFilterRemove:
+		return nil, true
+	case CompactionFilterChangeValue:
+		if key.ExtractValueType() == KTypeValueWithTTL {
+			expire_at, _ := decodeTTLValue(value)
+			return encodeTTLValue(expire_at, new_value), false
+		}
+		return new_value, false
+	}
+	return value, false
+}
@@ -0,0 +1,171 @@
+package goleveldb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestFileMetaData(number uint64, smallest, largest string) *fileMetaData {
+	return &fileMetaData{
+		number:   number,
+		fileSize: 1024,
+		smallest: NewInternalKey([]byte(smallest), SequenceNumber(number), KTypeValue),
+		largest:  NewInternalKey([]byte(largest), SequenceNumber(number), KTypeValue),
+	}
+}
+
+func newTestVersion(option *Options) *version {
+	cache, err := newTableCache(option)
+	if err != nil {
+		panic(err)
+	}
+	return newVersion(cache)
+}
+
+func Test_pickCompaction_reservation(t *testing.T) {
+	v := newTestVersion(DefaultOptions())
+	for i := 0; i < int(L0_CompactionTrigger); i++ {
+		v.addFile(0, newTestFileMetaData(uint64(i+1), fmt.Sprintf("%03da", i), fmt.Sprintf("%03dz", i)))
+	}
+	v.addFile(1, newTestFileMetaData(10, "000b", "000c"))
+
+	c1 := v.pickCompaction()
+	if c1 == nil {
+		t.Fatal("expect a level-0 compaction")
+	}
+	c1.markBeingCompacted(true)
+
+	// every remaining level-0 file is disjoint from c1, so another
+	// compaction can run concurrently but must not share any input
+	for c2 := v.pickCompaction(); c2 != nil; c2 = v.pickCompaction() {
+		for which := 0; which < 2; which++ {
+			for _, f := range c2.inputs[which] {
+				if f.beingCompacted {
+					t.Fatalf("file %d picked by two compactions", f.number)
+				}
+			}
+		}
+		c2.markBeingCompacted(true)
+	}
+
+	for level := 0; level < 2; level++ {
+		for _, f := range v.files[level] {
+			if !f.beingCompacted {
+				t.Fatalf("file %d should have been picked", f.number)
+			}
+		}
+	}
+}
+
+func Test_pickUniversalCompaction(t *testing.T) {
+	option := DefaultOptions()
+	option.CompactionStyle = CompactionStyleUniversal
+	v := newTestVersion(option)
+
+	// an old, large run at level 2 and a few small level-0 runs
+	big := newTestFileMetaData(1, "000a", "999z")
+	big.fileSize = 1024 * 1024
+	v.addFile(2, big)
+	for i := 0; i < int(L0_CompactionTrigger)-1; i++ {
+		v.addFile(0, newTestFileMetaData(uint64(i+2), "000a", "999z"))
+	}
+
+	c := v.pickCompaction()
+	if c == nil {
+		t.Fatal("expect a universal compaction")
+	}
+	// the large run is out of size ratio, so only level-0 runs are merged
+	// and the output lands right above it
+	if len(c.sortedRuns()) != int(L0_CompactionTrigger)-1 || c.outputLevel != 1 {
+		t.Fatalf("unexpected compaction: %d runs to level %d", len(c.sortedRuns()), c.outputLevel)
+	}
+	runs := c.sortedRuns()
+	for i := 1; i < len(runs); i++ {
+		if runs[i-1].files[0].number < runs[i].files[0].number {
+			t.Fatal("sorted runs should be ordered newest first")
+		}
+	}
+
+	// once level 1 is taken, the next merge has to include it
+	v.addFile(1, newTestFileMetaData(10, "000a", "999z"))
+	for i := 0; i < int(L0_CompactionTrigger)-2; i++ {
+		v.addFile(0, newTestFileMetaData(uint64(i+11), "000a", "999z"))
+	}
+	for i := 0; i < len(runs); i++ {
+		v.deleteFile(0, runs[i].files[0], false)
+	}
+	c = v.pickCompaction()
+	if c == nil || c.outputLevel != 1 || c.sortedRuns()[len(c.sortedRuns())-1].level != 1 {
+		t.Fatal("expect level-0 runs merged together with level 1")
+	}
+}
+
+func Test_pickUniversalCompaction_maxMergeWidth(t *testing.T) {
+	option := DefaultOptions()
+	option.CompactionStyle = CompactionStyleUniversal
+	option.UniversalMaxMergeWidth = 3
+	v := newTestVersion(option)
+
+	// runs of equal size, all within size ratio
+	for level := 1; level < int(NumLevels); level++ {
+		v.addFile(level, newTestFileMetaData(uint64(level), "000a", "999z"))
+	}
+	c := v.pickCompaction()
+	if c == nil || len(c.sortedRuns()) != 3 || c.outputLevel != 3 {
+		t.Fatal("expect the three newest runs merged right above the fourth")
+	}
+}
+
+func Test_pickFIFOCompaction(t *testing.T) {
+	option := DefaultOptions()
+	option.CompactionStyle = CompactionStyleFIFO
+	option.FIFOMaxTableFilesSize = 3 * 1024
+	option.TTL = 60
+	v := newTestVersion(option)
+
+	now := uint64(time.Now().Unix())
+	for i := 0; i < 3; i++ {
+		f := newTestFileMetaData(uint64(i+1), "000a", "999z")
+		f.creationTime = now
+		v.addFile(0, f)
+	}
+	if c := v.pickCompaction(); c != nil {
+		t.Fatal("files within size and age limits should be kept")
+	}
+
+	// one file too many, the oldest one goes
+	f := newTestFileMetaData(4, "000a", "999z")
+	f.creationTime = now
+	v.addFile(0, f)
+	c := v.pickCompaction()
+	if c == nil || !c.deletion || len(c.sortedRuns()) != 1 || c.sortedRuns()[0].files[0].number != 1 {
+		t.Fatal("expect the oldest file to be deleted")
+	}
+	v.deleteFile(0, c.sortedRuns()[0].files[0], false)
+
+	// expired files go regardless of size
+	v.files[0][0].creationTime = now - 120
+	v.files[0][1].creationTime = now - 90
+	c = v.pickCompaction()
+	if c == nil || len(c.sortedRuns()) != 2 {
+		t.Fatal("expect the expired files to be deleted")
+	}
+	for i, run := range c.sortedRuns() {
+		if run.files[0].number != uint64(i+2) {
+			t.Fatalf("unexpected file %d", run.files[0].number)
+		}
+	}
+}
+
+func Test_fileMetaData_encoding(t *testing.T) {
+	meta := newTestFileMetaData(7, "000a", "999z")
+	meta.creationTime = uint64(time.Now().Unix())
+	var decoded fileMetaData
+	n := decoded.decodeFrom(meta.encodeTo(), kManifestFormatVersion)
+	if int(n) != len(meta.encodeTo()) || decoded.number != meta.number || decoded.fileSize != meta.fileSize ||
+		decoded.creationTime != meta.creationTime ||
+		InternalKeyCompare(decoded.smallest, meta.smallest) != 0 || InternalKeyCompare(decoded.largest, meta.largest) != 0 {
+		t.Fatal("fileMetaData encoding mismatch")
+	}
+}
@@ -0,0 +1,107 @@
+package goleveldb
+
+import "sort"
+
+// Universal compaction treats every level-0 file and every non-empty deeper
+// level as one sorted run. Runs are ordered by age: level-0 files from the
+// largest file number down, then level 1, level 2 and so on.
+//
+// A compaction always merges the newest runs into one run, which is written
+// to the level right above the next older run (or to the last level when
+// every run is merged), so the age order of runs is kept by their levels.
+
+// universalSortedRuns returns all sorted runs of v, newest first.
+func (v *version) universalSortedRuns() []sortedRun {
+	var runs []sortedRun
+	level0 := append([]*fileMetaData{}, v.files[0]...)
+	sort.Slice(level0, func(i, j int) bool {
+		return level0[i].number > level0[j].number
+	})
+	for i := 0; i < len(level0); i++ {
+		runs = append(runs, sortedRun{level: 0, files: []*fileMetaData{level0[i]}})
+	}
+	for level := 1; level < int(NumLevels); level++ {
+		if len(v.files[level]) > 0 {
+			runs = append(runs, sortedRun{level: level, files: v.files[level]})
+		}
+	}
+	return runs
+}
+
+func (run *sortedRun) size() uint64 {
+	return totalFileSize(run.files)
+}
+
+// pickUniversalCompaction picks the newest sorted runs to merge once there
+// are at least L0_CompactionTrigger runs. Runs are added while the runs
+// picked so far, enlarged by UniversalSizeRatio percent, are not smaller
+// than the next one. If that picks fewer than UniversalMinMergeWidth runs,
+// just enough runs are merged to get back under the trigger. Both passes
+// pick at most UniversalMaxMergeWidth runs.
+// REQUIRES: db.muCompaction held.
+func (v *version) pickUniversalCompaction() *compaction {
+	option := v.cache.option
+	runs := v.universalSortedRuns()
+	if len(runs) < int(L0_CompactionTrigger) {
+		return nil
+	}
+	// Universal compactions always start at the newest run, so only one
+	// can run at a time. Flushes keep adding level-0 runs meanwhile.
+	for i := 0; i < len(runs); i++ {
+		if anyBeingCompacted(runs[i].files) {
+			return nil
+		}
+	}
+
+	max_width := len(runs)
+	if int(option.UniversalMaxMergeWidth) < max_width {
+		max_width = int(option.UniversalMaxMergeWidth)
+	}
+	if max_width < 2 {
+		max_width = 2
+	}
+
+	// Size ratio
+	width := 1
+	candidate_size := runs[0].size()
+	for ; width < max_width; width++ {
+		if float64(candidate_size)*(100.0+float64(option.UniversalSizeRatio))/100.0 < float64(runs[width].size()) {
+			break
+		}
+		candidate_size += runs[width].size()
+	}
+
+	// Number of sorted runs
+	if width < int(option.UniversalMinMergeWidth) {
+		width = len(runs) - int(L0_CompactionTrigger) + 1
+		if width < 2 {
+			width = 2
+		}
+		if width > max_width {
+			width = max_width
+		}
+	}
+
+	// Level-0 runs are only ordered by file number, so the output can not
+	// go back to level 0 and all level-0 runs are merged together. The
+	// output also needs a free level above the next older run. Keeping the
+	// runs in age order comes before UniversalMaxMergeWidth.
+	num_level0 := len(v.files[0])
+	if width < num_level0 {
+		width = num_level0
+	}
+	for width < len(runs) && runs[width].level-1 <= 0 {
+		width++
+	}
+
+	var c compaction
+	c.level = runs[0].level
+	c.runs = runs[:width]
+	if width == len(runs) {
+		c.outputLevel = int(NumLevels) - 1
+	} else {
+		c.outputLevel = runs[width].level - 1
+	}
+	c.bottommost = v.isBottommost(&c)
+	return &c
+}
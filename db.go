@@ -1,268 +1,597 @@
 package goleveldb
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var Debug bool = false
 
+// numOpened counts the DBs opened by the process, accessed atomically.
+var numOpened uint64
+
 type DB struct {
 	// Constant after construction
-	option Options
+	option   Options
+	readOnly bool     // Opened by OpenReadOnly
+	fileLock FileLock // Lock of the directory, held by a writable DB until Close
+	instance uint64   // Tells this DB from the others opened by the process, even on the same directory
+
+	defaultFamily *columnFamilyData
+	families      map[uint32]*columnFamilyData // All column families by id, guarded by mu and muCompaction
+	nextFamilyID  uint32
+
+	snapshots map[SequenceNumber]int // Live snapshots by sequence number, guarded by mu
 
-	mem *memTable // Memtable
-	imm *memTable // Memtable being compacted
+	// bgErr is the first error of a background job or of the log, guarded by mu.
+	// Writes fail with it from then on, and background work stops.
+	bgErr error
+
+	locks             *lockManager // Keys locked by pessimistic transactions
+	nextTransactionID uint64       // Accessed atomically
 
 	cache *tableCache
+	blobs *blobCache
+
+	muGC sync.Mutex // Serializes blob garbage collections
+
+	// Obsolete files are kept while a checkpoint may link or copy them
+	muDeletion       sync.Mutex // Guards deletionsPaused and pendingDeletions
+	deletionsPaused  int        // Number of running checkpoints
+	pendingDeletions []string   // Files to delete once deletions resume
 
 	currentLogFileNumber uint64
 	logWriter            *walWriter
 
-	current *version
+	flushedBytes   uint64 // Bytes of level-0 tables written by flushes
+	compactedBytes uint64 // Bytes of tables written by compactions
 
-	immExistCh chan bool
-	dbCloseCh  chan bool
+	flushCh      chan *memTable // Hands immutable memtables to flush workers
+	compactionCh chan bool      // Wakes up a compaction worker after a flush
+	dbCloseCh    chan bool      // Closed to stop all background workers
+	bgWork       sync.WaitGroup
 
 	muCompaction sync.Mutex
 
 	mu sync.Mutex
+
+	// muWrite serializes writers, so a batch is logged, inserted and made
+	// visible as a whole before the next one starts.
+	muWrite sync.Mutex
 }
 
 func Open(option Options) (*DB, error) {
+	return open(option, false)
+}
+
+// OpenReadOnly opens the DB in option.DirPath for reads only, while another
+// process may be writing to it. The updates of the logs are replayed into
+// memory, and nothing is ever written to the directory: writes fail with
+// ErrReadOnly and no background flush or compaction runs.
+// The DB shows the state of the writer when it was opened, Refresh catches
+// up with later updates. A file deleted by the writer since then makes reads
+// of its keys fail until the next Refresh.
+func OpenReadOnly(option Options) (*DB, error) {
+	return open(option, true)
+}
+
+func open(option Options, readOnly bool) (*DB, error) {
 	var db DB
 	var err error
 	db.option = option
-	db.immExistCh = make(chan bool, 1)
-	db.dbCloseCh = make(chan bool, 1)
+	db.readOnly = readOnly
+	db.instance = atomic.AddUint64(&numOpened, 1)
+	if db.option.MaxBackgroundFlushes == 0 {
+		db.option.MaxBackgroundFlushes = 1
+	}
+	if db.option.MaxBackgroundCompactions == 0 {
+		db.option.MaxBackgroundCompactions = 1
+	}
+	db.flushCh = make(chan *memTable, db.option.MaxBackgroundFlushes)
+	db.compactionCh = make(chan bool, 1)
+	db.dbCloseCh = make(chan bool)
+	db.snapshots = make(map[SequenceNumber]int)
+	db.locks = newLockManager()
 
 	// init TableCache
 	db.cache, err = newTableCache(&db.option)
 	if err != nil {
 		return nil, err
 	}
+	db.blobs = newBlobCache(db.option.env(), db.option.DirPath)
+
+	// only one process at a time may write to the directory
+	if !db.readOnly {
+		if err = db.option.env().CreateDir(db.option.DirPath); err != nil {
+			return nil, err
+		}
+		if db.fileLock, err = db.option.env().LockFile(lockFileName(db.option.DirPath)); err != nil {
+			return nil, err
+		}
+	}
 
 	// recover from last close
 	if err = db.Recover(); err != nil {
+		if db.fileLock != nil {
+			db.fileLock.Unlock()
+		}
 		return nil, err
 	}
 
-	if db.mem == nil {
-		if err = db.switchToNewMemTable(); err != nil {
-			return nil, err
-		}
+	if !db.readOnly {
+		db.startBackgroundWork()
 	}
 
-	go db.backgroundCompaction()
-
 	return &db, nil
 }
 
 func (db *DB) Put(key, value []byte) error {
-	if err := db.makeRoomForWrite(); err != nil {
-		return err
-	}
+	return db.write(db.defaultFamily, KTypeValue, key, value)
+}
 
-	db.mu.Lock()
-	seq := db.current.lastSequence
-	db.current.lastSequence++
-	db.mu.Unlock()
+// PutWithTTL sets the value for key, which expires ttl from now.
+// Once expired, the key is reported as not found and compaction
+// drops the entry.
+func (db *DB) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	return db.write(db.defaultFamily, KTypeValueWithTTL, key, encodeTTLValue(time.Now().Add(ttl), value))
+}
 
-	// write ahead log
-	if err := db.logWriter.addRecord([]byte(NewKVEntry(seq, KTypeValue, key, value))); err != nil {
-		return err
+func (db *DB) Get(key []byte) ([]byte, error) {
+	return db.get(db.defaultFamily, key, nil)
+}
+
+// get reads key from cfd as of snap, or the last published update if snap is nil.
+func (db *DB) get(cfd *columnFamilyData, key []byte, snap *snapshot) ([]byte, error) {
+	stats := db.option.Statistics
+	defer stats.measure(histogramGetMicros, time.Now())
+
+	// merge operands are collected from newest to oldest until a value is found
+	ctx := newMergeContext(cfd.option.MergeOperator, key)
+	ctx.blobs = db.blobs
+	value, err := db.lookup(cfd, key, snap, ctx)
+	if err == nil {
+		stats.record(tickerBytesRead, uint64(len(value)))
 	}
+	return value, err
+}
 
-	// insert into memtable
-	db.mem.add(seq, KTypeValue, key, value)
-	return nil
+// latestSequence returns the sequence number of the last update of key in cfd,
+// range deletions included, or 0 if key was never written.
+func (db *DB) latestSequence(cfd *columnFamilyData, key []byte) (SequenceNumber, error) {
+	ctx := newMergeContext(nil, key)
+	_, err := db.lookup(cfd, key, nil, ctx)
+	if err != nil && err != ErrKeyNotFound && err != ErrNoMergeOperator {
+		return 0, err
+	}
+	return ctx.latest, nil
 }
 
-func (db *DB) Get(key []byte) ([]byte, error) {
+// lookup visits the versions of key in cfd from the newest to the oldest
+// through ctx, until its value as of snap is known.
+func (db *DB) lookup(cfd *columnFamilyData, key []byte, snap *snapshot, ctx *mergeContext) ([]byte, error) {
 	db.mu.Lock()
-	snapshot := db.current.lastSequence
-	mem := db.mem
-	imm := db.imm
-	current := db.current
+	if snap == nil && ctx.blobs != nil {
+		// blob garbage collection deletes no file the lookup may read
+		snap = &snapshot{seq: db.lastSequence()}
+		db.snapshots[snap.seq]++
+		defer db.releaseSnapshot(snap)
+	}
+	snapshot := db.lastSequence()
+	if snap != nil {
+		snapshot = snap.seq
+	}
+	mem := cfd.mem
+	imms := cfd.imms
+	current := cfd.current
 	db.mu.Unlock()
 
 	internal_key := NewInternalKey(key, snapshot, KTypeValue)
-	v, status := mem.get(internal_key)
+	stats := db.option.Statistics
+	v, status := mem.get(internal_key, ctx)
 	if status == nil {
+		stats.record(tickerMemtableHits, 1)
 		return v, nil
 	} else if status == errKeyDeleted {
+		stats.record(tickerMemtableHits, 1)
 		return nil, ErrKeyNotFound
-	} else if imm != nil {
-		v, status = imm.get(internal_key)
+	} else if status != ErrKeyNotFound {
+		return nil, status
+	}
+	// search immutable memtables from newest to oldest
+	for i := len(imms) - 1; i >= 0; i-- {
+		v, status = imms[i].get(internal_key, ctx)
 		if status == nil {
+			stats.record(tickerMemtableHits, 1)
 			return v, nil
 		} else if status == errKeyDeleted {
+			stats.record(tickerMemtableHits, 1)
 			return nil, ErrKeyNotFound
+		} else if status != ErrKeyNotFound {
+			return nil, status
 		}
 	}
+	stats.record(tickerMemtableMisses, 1)
 
 	db.muCompaction.Lock()
 	defer db.muCompaction.Unlock()
-	value, err := current.get(internal_key)
+	value, err := current.get(internal_key, ctx)
 	return value, err
 }
 
-func (db *DB) Scan(key []byte) (Iterator, error) {
-	snapshot := db.current.lastSequence
+// Scan returns an iterator over the default column family, positioned at
+// the first key not less than key. The iterator must be closed after use.
+func (db *DB) Scan(key []byte) (*DBIterator, error) {
+	return db.newDBIterator(db.defaultFamily, key, db.acquireSnapshot())
+}
+
+// scan returns an iterator over cfd as of snap, or as of the last published
+// update if snap is nil, positioned at the first key not less than key.
+// Sources are merged newest first, so that the newer one of two entries with
+// the same internal key wins, see collectBlobFile.
+func (db *DB) scan(cfd *columnFamilyData, key []byte, snap *snapshot) (*deduplicationIterator, error) {
+	db.mu.Lock()
+	snapshot := db.lastSequence()
+	if snap != nil {
+		snapshot = snap.seq
+	}
+	db.mu.Unlock()
 	internal_key := NewInternalKey(key, snapshot, KTypeValue)
 
 	var list [][]Iterator
 	db.muCompaction.Lock()
 	defer db.muCompaction.Unlock()
 
+	// range tombstones of every source apply to the merged entries
+	var tombstones rangeTombstones
+
 	var l1 []Iterator
-	if db.mem != nil {
-		l1 = append(l1, db.mem.iterator())
+	if cfd.mem != nil {
+		l1 = append(l1, cfd.mem.iterator())
 		list = append(list, l1)
+		tombstones = append(tombstones, cfd.mem.rangeTombstones()...)
 	}
 
-	var l2 []Iterator
-	if db.imm != nil {
-		l2 = append(l2, db.imm.iterator())
+	for i := len(cfd.imms) - 1; i >= 0; i-- {
+		var l2 []Iterator
+		l2 = append(l2, cfd.imms[i].iterator())
 		list = append(list, l2)
+		tombstones = append(tombstones, cfd.imms[i].rangeTombstones()...)
 	}
 
-	for i := 0; i < len(db.current.files); i++ {
-		level_num := len(db.current.files[i])
+	for i := 0; i < len(cfd.current.files); i++ {
+		level_num := len(cfd.current.files[i])
 		if level_num == 0 {
-			break
+			continue
 		}
 		if i == 0 {
+			// newer level-0 files have higher numbers
+			files := append([]*fileMetaData(nil), cfd.current.files[i]...)
+			sort.Slice(files, func(a, b int) bool {
+				return files[a].number > files[b].number
+			})
 			for j := 0; j < level_num; j++ {
-				table, err := db.cache.getTable(db.current.files[i][j].number)
+				table, err := db.cache.getTable(files[j].number)
 				if err != nil {
 					return nil, err
 				}
 				var tmp []Iterator
 				tmp = append(tmp, newSSTableIterator(table))
 				list = append(list, tmp)
+				tombstones = append(tombstones, table.tombstones...)
 			}
 		} else {
 			var tmp []Iterator
 			for j := 0; j < level_num; j++ {
-				table, err := db.cache.getTable(db.current.files[i][j].number)
+				table, err := db.cache.getTable(cfd.current.files[i][j].number)
 				if err != nil {
 					return nil, err
 				}
 				tmp = append(tmp, newSSTableIterator(table))
-
+				tombstones = append(tombstones, table.tombstones...)
 			}
 			list = append(list, tmp)
 		}
 	}
 
-	iter := newDeduplicationIterator(newMergeIterator(list))
+	iter := newDeduplicationIterator(newMergeIterator(list), cfd.option.MergeOperator, tombstones, db.blobs)
+	iter.snapshot = snapshot
 
 	iter.Seek(internal_key)
 	return iter, nil
 }
 
+// Merge records operand as an update of the value for key, which is
+// combined with the older value by Options.MergeOperator when key is read.
+func (db *DB) Merge(key, operand []byte) error {
+	if db.option.MergeOperator == nil {
+		return ErrNoMergeOperator
+	}
+	return db.write(db.defaultFamily, KTypeMerge, key, operand)
+}
+
 func (db *DB) Delete(key []byte) error {
-	if err := db.makeRoomForWrite(); err != nil {
-		return err
+	return db.write(db.defaultFamily, KTypeDeletion, key, []byte{})
+}
+
+// SingleDelete deletes key, which must have been written by a single Put
+// since it was last deleted, and never merged. Compaction drops the deletion
+// together with that Put, so older versions of key would show up again.
+func (db *DB) SingleDelete(key []byte) error {
+	return db.write(db.defaultFamily, KTypeSingleDeletion, key, []byte{})
+}
+
+// DeleteRange deletes every key in [start, end) with a single range tombstone.
+// An empty range deletes nothing.
+func (db *DB) DeleteRange(start, end []byte) error {
+	if UserKeyCompare(start, end) >= 0 {
+		return nil
+	}
+	return db.write(db.defaultFamily, KTypeRangeDeletion, start, end)
+}
+
+// write applies a single update to cfd.
+func (db *DB) write(cfd *columnFamilyData, valueType ValueType, key, value []byte) error {
+	var batch WriteBatch
+	batch.add(cfd.id, valueType, key, value)
+	return db.Write(&batch)
+}
+
+// Write applies all updates of batch atomically: they are logged as one
+// record and become visible to reads together.
+func (db *DB) Write(batch *WriteBatch) error {
+	db.muWrite.Lock()
+	defer db.muWrite.Unlock()
+	return db.writeBatch(batch)
+}
+
+// REQUIRES: db.muWrite held.
+func (db *DB) writeBatch(batch *WriteBatch) error {
+	if db.readOnly {
+		return ErrReadOnly
 	}
+	if batch.Count() == 0 {
+		return nil
+	}
+	stats := db.option.Statistics
+	defer stats.measure(histogramWriteMicros, time.Now())
 
 	db.mu.Lock()
-	seq := db.current.lastSequence
-	db.current.lastSequence++
+	if db.bgErr != nil {
+		db.mu.Unlock()
+		return db.bgErr
+	}
+	families := make([]*columnFamilyData, batch.Count())
+	for i := 0; i < batch.Count(); i++ {
+		families[i] = db.families[batch.entries[i].family]
+		if families[i] == nil {
+			db.mu.Unlock()
+			return ErrColumnFamilyNotFound
+		}
+	}
 	db.mu.Unlock()
 
-	if err := db.logWriter.addRecord([]byte(NewKVEntry(seq, KTypeDeletion, key, []byte{}))); err != nil {
+	for i := 0; i < len(families); i++ {
+		if err := db.makeRoomForWrite(families[i]); err != nil {
+			return err
+		}
+	}
+
+	db.mu.Lock()
+	seq := db.lastSequence() + 1
+	db.mu.Unlock()
+
+	// write ahead log
+	if err := db.logWriter.addRecord(batch.encodeTo(seq)); err != nil {
+		// the record may be in the log in part, so nothing may follow it
+		db.setBackgroundError(err)
 		return err
 	}
-	db.mem.add(seq, KTypeDeletion, key, []byte{})
+
+	// insert into memtables
+	for i := 0; i < batch.Count(); i++ {
+		entry := &batch.entries[i]
+		families[i].mem.add(seq+SequenceNumber(i), entry.valueType, entry.key, entry.value)
+	}
+
+	// publish the batch to readers
+	db.mu.Lock()
+	db.defaultFamily.current.lastSequence = seq + SequenceNumber(batch.Count()) - 1
+	db.mu.Unlock()
+
+	for i := 0; i < batch.Count(); i++ {
+		stats.record(tickerBytesWritten, uint64(len(batch.entries[i].key)+len(batch.entries[i].value)))
+	}
 	return nil
 }
 
-func (db *DB) makeRoomForWrite() error {
+// lastSequence returns the sequence number of the last published update.
+// REQUIRES: db.mu held.
+func (db *DB) lastSequence() SequenceNumber {
+	return db.defaultFamily.current.lastSequence
+}
+
+// newFileNumber returns a file number unused by every column family.
+func (db *DB) newFileNumber() uint64 {
+	return db.defaultFamily.current.newFileNumber()
+}
+
+// makeRoomForWrite makes sure the memtable of cfd can take a write.
+// REQUIRES: db.muWrite held.
+func (db *DB) makeRoomForWrite(cfd *columnFamilyData) error {
 	for {
-		if db.current.numLevelFiles(0) >= L0_SlowdownWritesTrigger {
+		if err := db.backgroundError(); err != nil {
+			// flushes have stopped, there will be no room
+			return err
+		}
+		db.muCompaction.Lock()
+		level0_files := cfd.current.numLevelFiles(0)
+		db.muCompaction.Unlock()
+		// FIFO compaction keeps many level-0 files by design, so it is not slowed down
+		if cfd.option.CompactionStyle != CompactionStyleFIFO &&
+			level0_files >= L0_SlowdownWritesTrigger {
+			stall := time.Now()
 			time.Sleep(time.Duration(1) * time.Second)
-		} else if db.mem.approximateMemoryUsage() < uint64(db.option.MemTableSize) {
+			db.option.Statistics.recordSince(tickerStallMicros, stall)
+		} else if cfd.mem.approximateMemoryUsage() < uint64(cfd.option.MemTableSize) {
 			// There is room in current memtable
 			return nil
-		} else if db.imm != nil {
-			// We have filled up the current memtable, but the previous
-			// one is still being compacted, so we wait.
-			time.Sleep(time.Duration(100+rand.Intn(100)) * time.Nanosecond)
 		} else {
 			// Attempt to switch to a new memtable and trigger compaction of old
 			db.mu.Lock()
 			db.muCompaction.Lock()
-			if db.imm == nil {
-				if err := db.switchToNewMemTable(); err != nil {
-					db.muCompaction.Unlock()
-					db.mu.Unlock()
-					return err
-				}
-				db.immExistCh <- true // notify background compaction
+			var switched []*memTable
+			var err error
+			backlogged := db.flushBacklogged()
+			if !backlogged {
+				switched, err = db.switchToNewMemTable()
 			}
 			db.muCompaction.Unlock()
 			db.mu.Unlock()
+			if err != nil {
+				return err
+			}
+			if backlogged {
+				// We have filled up the current memtable, but every flush
+				// worker is still busy with a previous one, so we wait.
+				stall := time.Now()
+				time.Sleep(time.Duration(100+rand.Intn(100)) * time.Nanosecond)
+				db.option.Statistics.recordSince(tickerStallMicros, stall)
+			}
+			for i := 0; i < len(switched); i++ {
+				db.flushCh <- switched[i] // notify background flush
+			}
+		}
+	}
+}
+
+// setBackgroundError records err as the error writes fail with, unless an
+// earlier one is recorded.
+func (db *DB) setBackgroundError(err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.bgErr == nil {
+		db.bgErr = err
+	}
+}
+
+// backgroundError returns the error recorded by setBackgroundError.
+func (db *DB) backgroundError() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.bgErr
+}
+
+// flushBacklogged reports whether a column family with data in its memtable
+// already has MaxBackgroundFlushes immutable memtables waiting.
+// REQUIRES: db.mu held.
+func (db *DB) flushBacklogged() bool {
+	for _, cfd := range db.families {
+		if cfd.mem.approximateMemoryUsage() > 0 && len(cfd.imms) >= int(db.option.MaxBackgroundFlushes) {
+			return true
 		}
 	}
+	return false
 }
 
-func (db *DB) writeLevel0Table(imm *memTable, ver *version) error {
+// writeLevel0Table builds a level-0 sstable from imm. The returned file
+// is not yet part of any version.
+func (db *DB) writeLevel0Table(cfd *columnFamilyData, imm *memTable) (*fileMetaData, error) {
 	// FileMetaData
 	var meta fileMetaData
-	meta.number = ver.nextFileNumber
+	meta.number = imm.tableNumber
+	meta.creationTime = uint64(time.Now().Unix())
 
 	// file
-	ver.nextFileNumber++
 	filename := sstableFileName(db.option.DirPath, meta.number)
-	file, err := NewLinuxFile(filename)
+	file, err := db.option.env().NewWritableFile(filename)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// sstable build
-	builder := newTableBuilder(&db.option, file)
+	builder := newTableBuilder(&cfd.option, file, db.option.RateLimiter, IOPriorityHigh, true)
+	// large values go to a blob file, created on the first one
+	var blob *blobFileBuilder
 
 	iter := imm.iterator()
-	iter.SeekToFirst()
-	if iter.Valid() {
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
 		internal_key := InternalKey(iter.Key())
-		meta.smallest = internal_key
-		for ; iter.Valid(); iter.Next() {
-			internal_key = InternalKey(iter.Key())
-			value := iter.Value()
-			meta.largest = internal_key
-			builder.add(internal_key, value)
-		}
-		builder.finish()
+		value := iter.Value()
+		if min_size := cfd.option.MinBlobSize; min_size > 0 && internal_key.ExtractValueType() == KTypeValue && len(value) >= int(min_size) {
+			if blob == nil {
+				meta.blobFile = db.newFileNumber()
+				if blob, err = newBlobFileBuilder(db.option.env(), db.option.DirPath, meta.blobFile, db.option.RateLimiter, IOPriorityHigh); err != nil {
+					return nil, err
+				}
+			}
+			index, err := blob.add(internal_key.ExtractUserKey(), value)
+			if err != nil {
+				return nil, err
+			}
+			internal_key = NewInternalKey(internal_key.ExtractUserKey(), internal_key.ExtractSequenceNumber(), KTypeBlobIndex)
+			value = index.encodeTo()
+		}
+		if meta.smallest == nil {
+			meta.smallest = internal_key
+		}
+		meta.largest = internal_key
+		builder.add(internal_key, value)
+	}
+	if blob != nil {
+		if err := blob.finish(); err != nil {
+			return nil, err
+		}
+	}
+	tombstones := imm.rangeTombstones()
+	for i := 0; i < len(tombstones); i++ {
+		builder.addRangeTombstone(tombstones[i])
+		meta.extendRange(&tombstones[i])
+	}
+	if meta.smallest != nil {
+		if err := builder.finish(); err != nil {
+			return nil, err
+		}
 		meta.fileSize = builder.fileSize()
 	}
 
-	// add meta to version
-	ver.addFile(0, &meta)
-	return nil
+	return &meta, nil
 }
 
 func (db *DB) Close() error {
-	db.muCompaction.Lock()
+	if db.readOnly {
+		db.blobs.close()
+		return nil
+	}
+
+	// stop background workers, each finishes the job at hand first
+	close(db.dbCloseCh)
+	db.bgWork.Wait()
+
 	db.mu.Lock()
+	db.muCompaction.Lock()
 	defer db.mu.Unlock()
 	defer db.muCompaction.Unlock()
+	err := db.flushOnClose()
 
-	db.dbCloseCh <- true
-
-	// save version
-	if err := db.saveManifestFile(); err != nil {
-		return err
+	// the files are closed and the lock released even after an error,
+	// so that the DB can be opened again
+	if e := db.logWriter.close(); err == nil {
+		err = e
 	}
-
-	// close wal file
-	if err := db.logWriter.close(); err != nil {
+	db.blobs.close()
+	if e := db.fileLock.Unlock(); err == nil {
+		err = e
+	}
+	if err != nil {
 		return err
 	}
 
@@ -270,112 +599,465 @@ func (db *DB) Close() error {
 	return nil
 }
 
+// flushOnClose flushes the memtables no worker got to, and saves the manifest.
+// REQUIRES: db.mu and db.muCompaction held.
+func (db *DB) flushOnClose() error {
+	for _, cfd := range db.families {
+		for i := 0; i < len(cfd.imms); i++ {
+			if cfd.imms[i].flushed == nil {
+				meta, err := db.writeLevel0Table(cfd, cfd.imms[i])
+				if err != nil {
+					return err
+				}
+				cfd.imms[i].flushed = meta
+			}
+		}
+		if err := db.installFlushResults(cfd); err != nil {
+			return err
+		}
+	}
+
+	// save version
+	return db.saveManifestFile()
+}
+
+// kMaxRecoverAttempts bounds how often a read-only DB starts its recovery
+// over because the writer replaced the manifest meanwhile.
+const kMaxRecoverAttempts = 10
+
+// Recover loads the manifest and replays the logs it still needs.
+// A writable DB then flushes the replayed updates to level 0 and starts
+// a new log, a read-only one keeps them in its memtables. A read-only DB
+// fails with ErrManifestChanged if the manifest changed during each of
+// kMaxRecoverAttempts attempts.
 func (db *DB) Recover() error {
-	db.mem, db.imm = nil, nil
+	var err error
+	for attempt := 0; attempt < kMaxRecoverAttempts; attempt++ {
+		if err = db.recover(); err != ErrManifestChanged {
+			return err
+		}
+	}
+	return err
+}
+
+// recover makes a single attempt of Recover.
+func (db *DB) recover() error {
+	db.families = make(map[uint32]*columnFamilyData)
+	db.defaultFamily = db.newColumnFamilyData(kDefaultColumnFamilyID, DefaultColumnFamilyName, db.option)
+	db.families[kDefaultColumnFamilyID] = db.defaultFamily
+	db.nextFamilyID = kDefaultColumnFamilyID + 1
 	dbpath := db.option.DirPath
-	_, err := os.Stat(dbpath)
+	env := db.option.env()
 	// db not exist
-	if err != nil && os.IsNotExist(err) {
-		if err = os.MkdirAll(dbpath, 0755); err != nil {
+	if !env.FileExists(dbpath) {
+		if db.readOnly {
+			return &os.PathError{Op: "open", Path: dbpath, Err: os.ErrNotExist}
+		}
+		if err := env.CreateDir(dbpath); err != nil {
 			return err
 		}
-		db.current = newVersion(db.cache)
-		return nil
-	} else { // recover from last close
-		db.current = newVersion(db.cache)
-		file, err := NewLinuxFile(manifestFileName(dbpath))
+	}
+
+	data, err := readFile(env, manifestFileName(dbpath))
+	if err != nil && (db.readOnly || !os.IsNotExist(err)) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := db.decodeManifest(data); err != nil {
+			return err
+		}
+	}
+
+	logs, err := db.scanDirectory(db.currentLogFileNumber)
+	if err != nil {
+		return err
+	}
+	if err := db.recoverLogFiles(logs); err != nil {
+		return err
+	}
+	if db.readOnly {
+		// A log is deleted only after a newer manifest is saved, whose
+		// sstables hold its updates. Start over if that happened meanwhile.
+		latest, err := readFile(env, manifestFileName(dbpath))
 		if err != nil {
 			return err
 		}
-		data, err := file.Read(0, uint32(file.Size()))
+		if !bytes.Equal(latest, data) {
+			return ErrManifestChanged
+		}
+		return nil
+	}
+
+	// the replayed updates go to level 0, so that their logs can be deleted
+	for _, cfd := range db.families {
+		if cfd.mem.approximateMemoryUsage() == 0 {
+			continue
+		}
+		cfd.mem.tableNumber = db.newFileNumber()
+		meta, err := db.writeLevel0Table(cfd, cfd.mem)
 		if err != nil {
 			return err
 		}
-		db.currentLogFileNumber = DecodeFixed64(data)
-		db.recoverMemTable()
-		db.current.decodeFrom(data[8:])
+		cfd.current.addFile(0, meta)
+		if meta.blobFile != 0 {
+			cfd.blobFiles = append(cfd.blobFiles, meta.blobFile)
+		}
+		db.flushedBytes += meta.fileSize
+		cfd.flushedBytes += meta.fileSize
+		cfd.mem = nil
+	}
+	if _, err := db.switchToNewMemTable(); err != nil {
+		return err
+	}
+	if err := db.saveManifestFile(); err != nil {
+		return err
+	}
+	for _, number := range logs {
+		if err := env.RemoveFile(walFileName(dbpath, number)); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (db *DB) saveManifestFile() error {
-	file, err := NewLinuxFile(manifestFileName(db.option.DirPath))
-	if err != nil {
+// Refresh catches up a DB opened by OpenReadOnly with the manifest and the
+// logs written since it was opened or last refreshed. Column family handles
+// stay valid. It does nothing on a DB opened by Open.
+func (db *DB) Refresh() error {
+	if !db.readOnly {
+		return nil
+	}
+	var fresh DB
+	fresh.option = db.option
+	fresh.readOnly = true
+	fresh.cache = db.cache
+	if err := fresh.Recover(); err != nil {
 		return err
 	}
 
-	p := make([]byte, 8)
-	EncodeFixed64(p, db.currentLogFileNumber)
-	manifestContent := db.current.encodeTo()
+	db.mu.Lock()
+	db.muCompaction.Lock()
+	defer db.mu.Unlock()
+	defer db.muCompaction.Unlock()
+	for id, cfd := range fresh.families {
+		old, ok := db.families[id]
+		if !ok {
+			db.families[id] = cfd
+			continue
+		}
+		old.mem, old.imms, old.current, old.blobFiles = cfd.mem, cfd.imms, cfd.current, cfd.blobFiles
+		old.mem.family = old
+	}
+	db.nextFamilyID = fresh.nextFamilyID
+	db.currentLogFileNumber = fresh.currentLogFileNumber
+	return nil
+}
+
+// scanDirectory marks the numbers of all files in the DB directory as used,
+// and returns the numbers of the logs from minLog on, oldest first.
+func (db *DB) scanDirectory(minLog uint64) ([]uint64, error) {
+	names, err := db.option.env().GetChildren(db.option.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	var logs []uint64
+	v := db.defaultFamily.current
+	for _, name := range names {
+		number, ext, ok := parseFileName(name)
+		if !ok {
+			continue
+		}
+		v.markFileNumberUsed(number)
+		if ext == "log" && number >= minLog {
+			logs = append(logs, number)
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i] < logs[j] })
+	return logs, nil
+}
+
+// saveManifestFile replaces the manifest with the current state of every column family.
+// It is saved whenever files are added or removed, so that other processes can follow.
+// REQUIRES: db.mu and db.muCompaction held.
+func (db *DB) saveManifestFile() error {
+	return db.writeManifestFile(db.option.DirPath)
+}
+
+// A manifest starts with a header naming the format it is written in:
+//
+//	magic: fixed64
+//	format: fixed32
+//	log_number: fixed64
+//	version: see version.encodeTo
+//	column_families: see DB.encodeColumnFamiliesTo
+//	blob_files: see DB.encodeBlobFilesTo
+//
+// Manifests written before the header existed start right with the log
+// number, and are read in kManifestFormatLegacy.
+const (
+	kManifestMagic      uint64 = 0x74736566696e614d
+	kManifestHeaderSize        = 12
+
+	kManifestFormatLegacy uint32 = 0 // fileMetaData without creation time
+	kManifestFormatV1     uint32 = 1
+
+	kManifestFormatVersion = kManifestFormatV1 // The format manifests are written in
+)
+
+// writeManifestFile writes the manifest of the current state to the directory dirPath.
+// REQUIRES: db.mu and db.muCompaction held.
+func (db *DB) writeManifestFile(dirPath string) error {
+	return writeManifest(db.option.env(), dirPath, db.encodeManifest())
+}
+
+// encodeManifest returns the manifest of the current state.
+// REQUIRES: db.mu and db.muCompaction held.
+func (db *DB) encodeManifest() []byte {
+	p := make([]byte, kManifestHeaderSize+8)
+	EncodeFixed64(p, kManifestMagic)
+	EncodeFixed32(p[8:], kManifestFormatVersion)
+	EncodeFixed64(p[kManifestHeaderSize:], db.minLogNumber())
+	manifestContent := db.defaultFamily.current.encodeTo()
 	p = append(p, manifestContent...)
-	file.Append(string(p))
-	file.Sync()
-	file.Close()
+	p = append(p, db.encodeColumnFamiliesTo()...)
+	p = append(p, db.encodeBlobFilesTo()...)
+	return p
+}
+
+// writeManifest replaces the manifest in the directory dirPath by data.
+func writeManifest(env Env, dirPath string, data []byte) error {
+	tmpPath := manifestFileName(dirPath) + ".tmp"
+	if err := writeFile(env, tmpPath, data); err != nil {
+		return err
+	}
+	return env.RenameFile(tmpPath, manifestFileName(dirPath))
+}
+
+// decodeManifest restores the state saved by writeManifestFile.
+func (db *DB) decodeManifest(data []byte) error {
+	format := kManifestFormatLegacy
+	if len(data) >= kManifestHeaderSize && DecodeFixed64(data) == kManifestMagic {
+		format = DecodeFixed32(data[8:])
+		data = data[kManifestHeaderSize:]
+	}
+	if format > kManifestFormatVersion {
+		return ErrUnsupportedFormat
+	}
+	db.currentLogFileNumber = DecodeFixed64(data)
+	n := db.defaultFamily.current.decodeFrom(data[8:], format)
+	m := db.decodeColumnFamiliesFrom(data[8+n:], format)
+	db.decodeBlobFilesFrom(data[8+n+m:])
 	return nil
 }
 
-// switch mem to imm, and create new memtable and walWriter
-func (db *DB) switchToNewMemTable() error {
+// minLogNumber returns the number of the oldest log holding updates
+// not yet in sstables.
+// REQUIRES: db.mu or db.muCompaction held.
+func (db *DB) minLogNumber() uint64 {
+	number := db.currentLogFileNumber
+	for _, cfd := range db.families {
+		for i := 0; i < len(cfd.imms); i++ {
+			if cfd.imms[i].logNumber < number {
+				number = cfd.imms[i].logNumber
+			}
+		}
+	}
+	return number
+}
+
+// switchToNewMemTable starts a new write ahead log. The memtable of every
+// column family holding data becomes immutable, so that a log can be removed
+// once the memtables written to it are flushed. The new immutable memtables
+// are returned.
+// REQUIRES: db.mu and db.muCompaction held.
+func (db *DB) switchToNewMemTable() ([]*memTable, error) {
 	// switch mem to imm
-	db.imm = db.mem
+	var switched []*memTable
+	for _, cfd := range db.families {
+		if cfd.mem != nil && cfd.mem.approximateMemoryUsage() > 0 {
+			cfd.mem.tableNumber = db.newFileNumber()
+			cfd.imms = append(cfd.imms, cfd.mem)
+			switched = append(switched, cfd.mem)
+		}
+	}
 
 	// close old wal file
 	if db.logWriter != nil {
 		if err := db.logWriter.close(); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	// new write ahead log
-	db.currentLogFileNumber = db.current.nextFileNumber
-	db.current.nextFileNumber++
-	LogPath := walFileName(db.option.DirPath, db.currentLogFileNumber)
-	logFile, err := NewLinuxFile(LogPath)
+	db.currentLogFileNumber = db.newFileNumber()
+	logFile, err := db.option.env().NewWritableFile(walFileName(db.option.DirPath, db.currentLogFileNumber))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	db.logWriter = newWALWriter(logFile, db.option.Sync, db.option.Statistics)
+	if err := db.logWriter.addRecord(encodeLogHeader()); err != nil {
+		// the header may be in the log in part, so nothing may follow it
+		if db.bgErr == nil {
+			db.bgErr = err
+		}
+		return nil, err
 	}
-	db.logWriter = newWALWriter(logFile, db.option.Sync)
 
-	// new memtable
-	db.mem = newMemTable(LogPath)
+	// new memtables
+	for _, cfd := range db.families {
+		cfd.mem = cfd.newMemTable(db.currentLogFileNumber)
+	}
 
-	return nil
+	return switched, nil
 }
 
-func (db *DB) recoverMemTable() error {
-	logPath := walFileName(db.option.DirPath, db.currentLogFileNumber)
-	file, err := NewLinuxFile(logPath)
-	if err != nil {
-		return err
+// recoverLogFiles replays the logs into new memtables. The logs are left
+// untouched, a log being written by another process is read up to its last
+// complete record.
+func (db *DB) recoverLogFiles(logs []uint64) error {
+	for _, cfd := range db.families {
+		cfd.mem = cfd.newMemTable(db.currentLogFileNumber)
 	}
-	db.mem = newMemTable(logPath)
-	reader := newWALReader(file)
-	for {
-		record, err := reader.readRecord()
+	for _, number := range logs {
+		file, err := db.option.env().NewRandomAccessFile(walFileName(db.option.DirPath, number))
 		if err != nil {
-			break
+			if os.IsNotExist(err) {
+				// deleted by the writer meanwhile, see Recover
+				continue
+			}
+			return err
+		}
+		err = replayLog(file, func(seq SequenceNumber, batch *WriteBatch) {
+			for i := 0; i < batch.Count(); i++ {
+				entry := &batch.entries[i]
+				if cfd, ok := db.families[entry.family]; ok {
+					cfd.mem.add(seq+SequenceNumber(i), entry.valueType, entry.key, entry.value)
+				}
+			}
+			if last := seq + SequenceNumber(batch.Count()) - 1; last > db.lastSequence() {
+				db.defaultFamily.current.lastSequence = last
+			}
+		})
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("log %d: %w", number, err)
 		}
-		memkey := KVEntry(record)
-		db.mem.add(memkey.ExtractInternalKey().ExtractSequenceNumber(),
-			memkey.ExtractInternalKey().ExtractValueType(),
-			memkey.ExtractInternalKey().ExtractUserKey(), memkey.ExtractValue())
 	}
-	db.logWriter = newWALWriter(file, db.option.Sync)
 	return nil
 }
 
+// SpaceConsumption returns the bytes taken by the files of the DB directory.
 func (db *DB) SpaceConsumption() (int64, error) {
+	env := db.option.env()
+	names, err := env.GetChildren(db.option.DirPath)
+	if err != nil {
+		return 0, err
+	}
 	var size int64
-	err := filepath.Walk(db.option.DirPath, func(_ string, info os.FileInfo, err error) error {
+	for _, name := range names {
+		if name == kLostDirName {
+			continue
+		}
+		n, err := env.GetFileSize(filepath.Join(db.option.DirPath, name))
 		if err != nil {
-			return err
+			return 0, err
+		}
+		size += int64(n)
+	}
+	return size, nil
+}
+
+// WriteAmplification returns the bytes written to sstables by flushes and
+// compactions, divided by the bytes written by flushes alone.
+func (db *DB) WriteAmplification() float64 {
+	db.muCompaction.Lock()
+	defer db.muCompaction.Unlock()
+
+	if db.flushedBytes == 0 {
+		return 0
+	}
+	return float64(db.flushedBytes+db.compactedBytes) / float64(db.flushedBytes)
+}
+
+// GetProperty returns the value of the property name of the default column
+// family, and whether the property exists:
+//
+//	leveldb.num-files-at-level<N>     the number of sstables at level N
+//	leveldb.stats                     the sstables and their size at every level, the bytes flushed and compacted, and the Statistics of the DB if set
+//	leveldb.sstables                  the sstables of every level with their key ranges
+//	leveldb.total-sst-size            the bytes of all sstables
+//	leveldb.approximate-memory-usage  the bytes taken by the memtables
+func (db *DB) GetProperty(name string) (string, bool) {
+	return db.getProperty(db.defaultFamily, name)
+}
+
+func (db *DB) getProperty(cfd *columnFamilyData, name string) (string, bool) {
+	db.mu.Lock()
+	db.muCompaction.Lock()
+	defer db.muCompaction.Unlock()
+	defer db.mu.Unlock()
+
+	files := &cfd.current.files
+	if rest, ok := strings.CutPrefix(name, "leveldb.num-files-at-level"); ok {
+		level, err := strconv.Atoi(rest)
+		if err != nil || level < 0 || level >= int(NumLevels) {
+			return "", false
 		}
-		if !info.IsDir() {
-			size += info.Size()
+		return strconv.Itoa(len(files[level])), true
+	}
+
+	var sb strings.Builder
+	switch name {
+	case "leveldb.stats":
+		sb.WriteString("Level  Files  Size(MB)\n")
+		sb.WriteString("----------------------\n")
+		for level := 0; level < len(files); level++ {
+			if len(files[level]) == 0 {
+				continue
+			}
+			var size uint64
+			for _, meta := range files[level] {
+				size += meta.fileSize
+			}
+			fmt.Fprintf(&sb, "%5d %6d %9.2f\n", level, len(files[level]), float64(size)/MB)
 		}
-		return err
-	})
-	return size, err
+		// of the column family, like the levels
+		var amplification float64
+		if cfd.flushedBytes > 0 {
+			amplification = float64(cfd.flushedBytes+cfd.compactedBytes) / float64(cfd.flushedBytes)
+		}
+		fmt.Fprintf(&sb, "Flushed(MB): %.2f  Compacted(MB): %.2f  Write amplification: %.2f\n",
+			float64(cfd.flushedBytes)/MB, float64(cfd.compactedBytes)/MB, amplification)
+		if db.option.Statistics != nil {
+			sb.WriteString("\nStatistics of the DB:\n")
+			sb.WriteString(db.option.Statistics.String())
+		}
+	case "leveldb.sstables":
+		for level := 0; level < len(files); level++ {
+			fmt.Fprintf(&sb, "--- level %d ---\n", level)
+			for _, meta := range files[level] {
+				fmt.Fprintf(&sb, " %d:%d[%q .. %q]\n", meta.number, meta.fileSize,
+					meta.smallest.ExtractUserKey(), meta.largest.ExtractUserKey())
+			}
+		}
+	case "leveldb.total-sst-size":
+		var size uint64
+		for level := 0; level < len(files); level++ {
+			for _, meta := range files[level] {
+				size += meta.fileSize
+			}
+		}
+		sb.WriteString(strconv.FormatUint(size, 10))
+	case "leveldb.approximate-memory-usage":
+		size := cfd.mem.approximateMemoryUsage()
+		for _, imm := range cfd.imms {
+			size += imm.approximateMemoryUsage()
+		}
+		sb.WriteString(strconv.FormatUint(size, 10))
+	default:
+		return "", false
+	}
+	return sb.String(), true
 }
 
 func (db *DB) PrintLevelInfo() {
@@ -384,5 +1066,12 @@ func (db *DB) PrintLevelInfo() {
 	defer db.muCompaction.Unlock()
 	defer db.mu.Unlock()
 
-	db.current.info()
+	for id := uint32(0); id < db.nextFamilyID; id++ {
+		if cfd, ok := db.families[id]; ok {
+			if len(db.families) > 1 {
+				fmt.Printf("column family %s\n", cfd.name)
+			}
+			cfd.current.info()
+		}
+	}
 }
@@ -1,9 +1,15 @@
 package goleveldb
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -11,9 +17,9 @@ import (
 
 func openDB() (*DB, func()) {
 	path := "/tmp/goleveldb-mydb"
-	os.RemoveAll(path)
 	options := DefaultOptions()
 	options.DirPath = path
+	options.Env = NewMemEnv()
 	options.BlockSize = 1024
 	options.MemTableSize = 1024 * 64
 
@@ -24,7 +30,51 @@ func openDB() (*DB, func()) {
 	}
 	return db, func() {
 		_ = db.Close()
-		_ = os.RemoveAll(options.DirPath)
+		_ = DestroyDB(*options)
+	}
+}
+
+// testOptions returns the options of a DB in memory at /tmp/goleveldb-mydb,
+// changed by configure if it is not nil.
+func testOptions(configure func(option *Options)) *Options {
+	option := DefaultOptions()
+	option.DirPath = "/tmp/goleveldb-mydb"
+	option.Env = NewMemEnv()
+	if configure != nil {
+		configure(option)
+	}
+	return option
+}
+
+// openTestDB opens a DB with testOptions(configure), closed when t ends.
+func openTestDB(t *testing.T, configure func(option *Options)) (*DB, *Options) {
+	t.Helper()
+	option := testOptions(configure)
+	db, err := Open(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return db, option
+}
+
+// waitForBackgroundWork waits until db has nothing left to flush or compact.
+func waitForBackgroundWork(db *DB) {
+	for {
+		db.mu.Lock()
+		db.muCompaction.Lock()
+		idle := true
+		for _, cfd := range db.families {
+			idle = idle && len(cfd.imms) == 0 && !cfd.current.needsCompaction()
+		}
+		db.muCompaction.Unlock()
+		db.mu.Unlock()
+		if idle {
+			return
+		}
+		time.Sleep(time.Millisecond)
 	}
 }
 
@@ -76,6 +126,7 @@ func TestDB_Scan(t *testing.T) {
 	}
 
 	iter, _ := db.Scan([]byte(fmt.Sprintf("%06dtest", 10)))
+	defer iter.Close()
 	for i := 10; i < 9990; i++ {
 		if !iter.Valid() {
 			t.Fatalf("Scan %s failed\n", fmt.Sprintf("%06dtest", i))
@@ -89,12 +140,10 @@ func TestDB_Scan(t *testing.T) {
 }
 
 func TestDB_Recover(t *testing.T) {
-	path := "/tmp/goleveldb-mydb"
-	os.RemoveAll(path)
-	option := DefaultOptions()
-	option.DirPath = path
-	option.BlockSize = 1024
-	option.MemTableSize = 1024 * 64
+	option := testOptions(func(option *Options) {
+		option.BlockSize = 1024
+		option.MemTableSize = 1024 * 64
+	})
 
 	db, _ := Open(*option)
 	for i := 0; i < 5000; i++ {
@@ -121,7 +170,7 @@ func TestDB_Recover(t *testing.T) {
 			t.Fatalf("Expect: %s, but get %s\n", key, v)
 		}
 	}
-	os.RemoveAll(path)
+	db.Close()
 }
 
 func TestDB_concurrent_put(t *testing.T) {
@@ -165,3 +214,2184 @@ func TestDB_concurrent_put(t *testing.T) {
 		}
 	}
 }
+
+func TestDB_ParallelBackgroundWork(t *testing.T) {
+	db, _ := openTestDB(t, func(option *Options) {
+		option.BlockSize = 1024
+		option.MemTableSize = 1024 * 16
+		option.CompactionInterval = 10
+		option.MaxBackgroundFlushes = 2
+		option.MaxBackgroundCompactions = 4
+	})
+
+	test_num := 20000
+	for i := 0; i < test_num; i++ {
+		key := fmt.Sprintf("%06dtest", i)
+		value := fmt.Sprintf("value%06d", i)
+		db.Put([]byte(key), []byte(value))
+	}
+	for i := 0; i < test_num; i += 3 {
+		key := fmt.Sprintf("%06dtest", i)
+		db.Delete([]byte(key))
+	}
+	waitForBackgroundWork(db)
+
+	for i := 0; i < test_num; i++ {
+		key := fmt.Sprintf("%06dtest", i)
+		v, err := db.Get([]byte(key))
+		if i%3 == 0 {
+			if err != ErrKeyNotFound {
+				t.Fatalf("key %s should be deleted", key)
+			}
+		} else if value := fmt.Sprintf("value%06d", i); value != string(v) {
+			t.Fatalf("Expect: %s, but get %s\n", value, v)
+		}
+	}
+}
+
+func TestDB_UniversalCompaction(t *testing.T) {
+	db, _ := openTestDB(t, func(option *Options) {
+		option.BlockSize = 1024
+		option.MemTableSize = 1024 * 16
+		option.CompactionStyle = CompactionStyleUniversal
+	})
+
+	test_num := 10000
+	for round := 0; round < 3; round++ {
+		for i := 0; i < test_num; i++ {
+			key := fmt.Sprintf("%06dtest", i)
+			value := fmt.Sprintf("value%06d-%d", i, round)
+			db.Put([]byte(key), []byte(value))
+		}
+	}
+	for i := 0; i < test_num; i += 2 {
+		key := fmt.Sprintf("%06dtest", i)
+		db.Delete([]byte(key))
+	}
+	waitForBackgroundWork(db)
+
+	for i := 0; i < test_num; i++ {
+		key := fmt.Sprintf("%06dtest", i)
+		v, err := db.Get([]byte(key))
+		if i%2 == 0 {
+			if err != ErrKeyNotFound {
+				t.Fatalf("key %s should be deleted", key)
+			}
+		} else if value := fmt.Sprintf("value%06d-2", i); value != string(v) {
+			t.Fatalf("Expect: %s, but get %s\n", value, v)
+		}
+	}
+}
+
+func TestDB_FIFOCompaction(t *testing.T) {
+	db, option := openTestDB(t, func(option *Options) {
+		option.BlockSize = 1024
+		option.MemTableSize = 1024 * 16
+		option.CompactionStyle = CompactionStyleFIFO
+		option.FIFOMaxTableFilesSize = 1024 * 64
+	})
+
+	test_num := 20000
+	for i := 0; i < test_num; i++ {
+		key := fmt.Sprintf("%06dtest", i)
+		value := fmt.Sprintf("value%06d", i)
+		db.Put([]byte(key), []byte(value))
+	}
+	waitForBackgroundWork(db)
+
+	db.muCompaction.Lock()
+	size := totalFileSize(db.defaultFamily.current.files[0])
+	db.muCompaction.Unlock()
+	if size > option.FIFOMaxTableFilesSize {
+		t.Fatalf("level-0 size %d exceeds the FIFO limit", size)
+	}
+	if _, err := db.Get([]byte(fmt.Sprintf("%06dtest", 0))); err != ErrKeyNotFound {
+		t.Fatal("the oldest key should have been dropped")
+	}
+	key := fmt.Sprintf("%06dtest", test_num-1)
+	if v, err := db.Get([]byte(key)); err != nil || string(v) != fmt.Sprintf("value%06d", test_num-1) {
+		t.Fatalf("lookup: %s err. %v\n", key, err)
+	}
+}
+
+func TestDB_PutWithTTL(t *testing.T) {
+	db, destroy := openDB()
+	defer destroy()
+
+	test_num := 10000
+	// older plain values, flushed to sstables
+	for i := 0; i < test_num; i++ {
+		key := fmt.Sprintf("%06dtest", i)
+		db.Put([]byte(key), []byte("old"))
+	}
+	ttl := time.Second * time.Duration(2)
+	for i := 0; i < test_num; i++ {
+		key := fmt.Sprintf("%06dtest", i)
+		value := fmt.Sprintf("value%06d", i)
+		if i%2 == 0 {
+			db.PutWithTTL([]byte(key), []byte(value), ttl)
+		} else {
+			db.PutWithTTL([]byte(key), []byte(value), time.Hour)
+		}
+	}
+	expire_at := time.Now().Add(ttl)
+
+	check := func(expired bool) {
+		for i := 0; i < test_num; i++ {
+			key := fmt.Sprintf("%06dtest", i)
+			v, err := db.Get([]byte(key))
+			if expired && i%2 == 0 {
+				if err != ErrKeyNotFound {
+					t.Fatalf("key %s should be expired", key)
+				}
+			} else if value := fmt.Sprintf("value%06d", i); value != string(v) {
+				t.Fatalf("Expect: %s, but get %s\n", value, v)
+			}
+		}
+
+		iter, _ := db.Scan([]byte(fmt.Sprintf("%06dtest", 0)))
+		defer iter.Close()
+		for i := 0; i < test_num; i++ {
+			if expired && i%2 == 0 {
+				continue
+			}
+			value := fmt.Sprintf("value%06d", i)
+			if !iter.Valid() || string(iter.Value()) != value {
+				t.Fatalf("Scan %s failed\n", fmt.Sprintf("%06dtest", i))
+			}
+			iter.Next()
+		}
+	}
+	check(false)
+
+	time.Sleep(time.Until(expire_at) + time.Millisecond*time.Duration(100))
+	check(true)
+
+	// compaction drops the expired entries without resurrecting old values
+	for i := test_num; i < 3*test_num; i++ {
+		key := fmt.Sprintf("%06dtest", i)
+		db.Put([]byte(key), []byte("filler"))
+	}
+	waitForBackgroundWork(db)
+	for i := 0; i < test_num; i += 2 {
+		key := fmt.Sprintf("%06dtest", i)
+		if _, err := db.Get([]byte(key)); err != ErrKeyNotFound {
+			t.Fatalf("key %s should be expired", key)
+		}
+	}
+}
+
+// testCompactionFilter removes keys of tenant "a" and strips values of tenant "b"
+type testCompactionFilter struct {
+	calls int
+}
+
+func (f *testCompactionFilter) Filter(level int, key, value []byte) (CompactionFilterDecision, []byte) {
+	f.calls++
+	if key[0] == 'a' {
+		return CompactionFilterRemove, nil
+	} else if key[0] == 'b' {
+		return CompactionFilterChangeValue, value[:5]
+	}
+	return CompactionFilterKeep, nil
+}
+
+type testCompactionFilterFactory struct {
+	mu      sync.Mutex
+	filters []*testCompactionFilter
+}
+
+func (factory *testCompactionFilterFactory) CreateCompactionFilter(context CompactionFilterContext) CompactionFilter {
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	filter := &testCompactionFilter{}
+	factory.filters = append(factory.filters, filter)
+	return filter
+}
+
+func TestDB_CompactionFilter(t *testing.T) {
+	factory := &testCompactionFilterFactory{}
+	db, _ := openTestDB(t, func(option *Options) {
+		option.CompactionFilterFactory = factory
+	})
+
+	test_num := 1000
+	mem := newMemTable("")
+	seq := SequenceNumber(1)
+	for _, tenant := range []string{"a", "b", "c"} {
+		for i := 0; i < test_num; i++ {
+			key := fmt.Sprintf("%s%06d", tenant, i)
+			value := fmt.Sprintf("value%06d", i)
+			mem.add(seq, KTypeValue, []byte(key), []byte(value))
+			seq++
+		}
+	}
+	mem.tableNumber = db.newFileNumber()
+	meta, err := db.writeLevel0Table(db.defaultFamily, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bottommost := range []bool{true, false} {
+		c := &compaction{level: 0, outputLevel: 1, bottommost: bottommost}
+		c.inputs[0] = []*fileMetaData{meta}
+		outputs, err := db.doCompaction(db.defaultFamily, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var list []Iterator
+		for _, output := range outputs {
+			table, err := db.cache.getTable(output.number)
+			if err != nil {
+				t.Fatal(err)
+			}
+			list = append(list, newSSTableIterator(table))
+		}
+		iter := newSortedLevelIterator(list)
+		count := map[byte]int{}
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			key := InternalKey(iter.Key())
+			tenant := key.ExtractUserKey()[0]
+			count[tenant]++
+			switch tenant {
+			case 'a':
+				if bottommost || key.ExtractValueType() != KTypeDeletion {
+					t.Fatalf("key %s should be removed by the filter", key.ExtractUserKey())
+				}
+			case 'b':
+				if string(iter.Value()) != "value" {
+					t.Fatalf("Expect: value, but get %s\n", iter.Value())
+				}
+			}
+		}
+		if (!bottommost && count['a'] != test_num) || count['b'] != test_num || count['c'] != test_num {
+			t.Fatalf("unexpected compaction output %v", count)
+		}
+	}
+
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	if len(factory.filters) != 2 || factory.filters[0] == factory.filters[1] {
+		t.Fatal("the factory should create a filter for each compaction")
+	}
+	if factory.filters[0].calls != 3*test_num {
+		t.Fatalf("filter called %d times", factory.filters[0].calls)
+	}
+}
+
+// testAppendOperator joins all values of a key with commas.
+type testAppendOperator struct{}
+
+func (testAppendOperator) FullMerge(key, existingValue []byte, operands [][]byte) ([]byte, error) {
+	var result []byte
+	if existingValue != nil {
+		result = append(result, existingValue...)
+	}
+	for _, operand := range operands {
+		if len(result) > 0 {
+			result = append(result, ',')
+		}
+		result = append(result, operand...)
+	}
+	return result, nil
+}
+
+func (testAppendOperator) PartialMerge(key, leftOperand, rightOperand []byte) ([]byte, bool) {
+	return []byte(string(leftOperand) + "," + string(rightOperand)), true
+}
+
+func TestDB_Merge(t *testing.T) {
+	db, _ := openTestDB(t, func(option *Options) {
+		option.BlockSize = 1024
+		option.MemTableSize = 1024 * 16
+		option.MergeOperator = testAppendOperator{}
+	})
+
+	key_num := 100
+	rounds := 50
+	expected := make([]string, key_num)
+	for i := 0; i < key_num; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		switch i % 3 {
+		case 0:
+			// merged onto a base value
+			if err := db.Put(key, []byte("base")); err != nil {
+				t.Fatal(err)
+			}
+			expected[i] = "base"
+		case 1:
+			// merged onto a deleted key
+			if err := db.Put(key, []byte("old")); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for r := 0; r < rounds; r++ {
+		for i := 0; i < key_num; i++ {
+			operand := fmt.Sprintf("%d", r)
+			if err := db.Merge([]byte(fmt.Sprintf("key%04d", i)), []byte(operand)); err != nil {
+				t.Fatal(err)
+			}
+			if expected[i] != "" {
+				expected[i] += ","
+			}
+			expected[i] += operand
+		}
+	}
+
+	for i := 0; i < key_num; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("key%04d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != expected[i] {
+			t.Fatalf("key%04d Expect: %s, but get %s\n", i, expected[i], value)
+		}
+	}
+
+	iter, err := db.Scan([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	i := 0
+	for ; iter.Valid(); iter.Next() {
+		if string(iter.Value()) != expected[i] {
+			t.Fatalf("scan key%04d Expect: %s, but get %s\n", i, expected[i], iter.Value())
+		}
+		i++
+	}
+	if i != key_num {
+		t.Fatalf("scan returned %d keys", i)
+	}
+}
+
+func TestDB_MergeWithoutOperator(t *testing.T) {
+	db, clean := openDB()
+	defer clean()
+	if err := db.Merge([]byte("key"), []byte("operand")); err != ErrNoMergeOperator {
+		t.Fatalf("Expect: %v, but get %v\n", ErrNoMergeOperator, err)
+	}
+}
+
+func TestDB_MergeCompaction(t *testing.T) {
+	db, _ := openTestDB(t, func(option *Options) {
+		option.MergeOperator = testAppendOperator{}
+	})
+
+	// operands only, the base values may lie in deeper levels
+	key_num := 100
+	mem := newMemTable("")
+	seq := SequenceNumber(1)
+	for r := 0; r < 3; r++ {
+		for i := 0; i < key_num; i++ {
+			mem.add(seq, KTypeMerge, []byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("%d", r)))
+			seq++
+		}
+	}
+	mem.tableNumber = db.newFileNumber()
+	meta, err := db.writeLevel0Table(db.defaultFamily, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bottommost := range []bool{true, false} {
+		c := &compaction{level: 0, outputLevel: 1, bottommost: bottommost}
+		c.inputs[0] = []*fileMetaData{meta}
+		outputs, err := db.doCompaction(db.defaultFamily, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var list []Iterator
+		for _, output := range outputs {
+			table, err := db.cache.getTable(output.number)
+			if err != nil {
+				t.Fatal(err)
+			}
+			list = append(list, newSSTableIterator(table))
+		}
+		iter := newSortedLevelIterator(list)
+		count := 0
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			key := InternalKey(iter.Key())
+			expected_type := KTypeMerge
+			if bottommost {
+				expected_type = KTypeValue
+			}
+			if key.ExtractValueType() != expected_type {
+				t.Fatalf("key %s has type %d, Expect: %d\n", key.ExtractUserKey(), key.ExtractValueType(), expected_type)
+			}
+			if string(iter.Value()) != "0,1,2" {
+				t.Fatalf("Expect: 0,1,2, but get %s\n", iter.Value())
+			}
+			count++
+		}
+		if count != key_num {
+			t.Fatalf("compaction wrote %d entries", count)
+		}
+	}
+}
+
+func TestDB_MergeKeepsTTL(t *testing.T) {
+	db, _ := openTestDB(t, func(option *Options) {
+		option.MergeOperator = testAppendOperator{}
+	})
+
+	// a live and an expired base value, each below two operands
+	expire_at := time.Unix(0, time.Now().Add(time.Hour).UnixNano())
+	mem := newMemTable("")
+	mem.add(1, KTypeValueWithTTL, []byte("live"), encodeTTLValue(expire_at, []byte("base")))
+	mem.add(2, KTypeValueWithTTL, []byte("expired"), encodeTTLValue(time.Now().Add(-time.Hour), []byte("base")))
+	seq := SequenceNumber(3)
+	for _, key := range []string{"live", "expired"} {
+		for _, operand := range []string{"0", "1"} {
+			mem.add(seq, KTypeMerge, []byte(key), []byte(operand))
+			seq++
+		}
+	}
+	mem.tableNumber = db.newFileNumber()
+	meta, err := db.writeLevel0Table(db.defaultFamily, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &compaction{level: 0, outputLevel: 1}
+	c.inputs[0] = []*fileMetaData{meta}
+	outputs, err := db.doCompaction(db.defaultFamily, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 1 {
+		t.Fatalf("Expect 1 output, but get %d\n", len(outputs))
+	}
+	table, err := db.cache.getTable(outputs[0].number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]InternalKey)
+	values := make(map[string][]byte)
+	iter := newSSTableIterator(table)
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		key := InternalKey(append([]byte{}, iter.Key()...))
+		entries[string(key.ExtractUserKey())] = key
+		values[string(key.ExtractUserKey())] = append([]byte{}, iter.Value()...)
+	}
+
+	// the merged value expires with its base value
+	if entries["live"].ExtractValueType() != KTypeValueWithTTL {
+		t.Fatalf("Expect type %d, but get %d\n", KTypeValueWithTTL, entries["live"].ExtractValueType())
+	}
+	if at, value := decodeTTLValue(values["live"]); !at.Equal(expire_at) || string(value) != "base,0,1" {
+		t.Fatalf("Expect base,0,1 expiring at %v, but get %s expiring at %v\n", expire_at, value, at)
+	}
+	// the operands of an expired value make a new value
+	if entries["expired"].ExtractValueType() != KTypeValue || string(values["expired"]) != "0,1" {
+		t.Fatalf("Expect 0,1 without expiry, but get %s of type %d\n", values["expired"], entries["expired"].ExtractValueType())
+	}
+}
+
+func TestDB_DeleteRange(t *testing.T) {
+	db, _ := openTestDB(t, func(option *Options) {
+		option.BlockSize = 1024
+		option.MemTableSize = 1024 * 16
+	})
+
+	test_num := 3000
+	for i := 0; i < test_num; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%06d", i)), []byte(fmt.Sprintf("value%06d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// one tombstone, followed by writes that push it into sstables
+	if err := db.DeleteRange([]byte("key001000"), []byte("key002000")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("key001500"), []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < test_num; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("other%06d", i)), []byte(fmt.Sprintf("value%06d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect := func(i int) (string, bool) {
+		if i == 1500 {
+			return "again", true
+		}
+		if i >= 1000 && i < 2000 {
+			return "", false
+		}
+		return fmt.Sprintf("value%06d", i), true
+	}
+	for i := 0; i < test_num; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("key%06d", i)))
+		expected, ok := expect(i)
+		if !ok {
+			if err != ErrKeyNotFound {
+				t.Fatalf("key%06d should be deleted, get %s %v\n", i, value, err)
+			}
+			continue
+		}
+		if err != nil || string(value) != expected {
+			t.Fatalf("key%06d Expect: %s, but get %s %v\n", i, expected, value, err)
+		}
+	}
+
+	iter, err := db.Scan([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	count := 0
+	for ; iter.Valid(); iter.Next() {
+		key := InternalKey(iter.Key()).ExtractUserKey()
+		if string(key) >= "other" {
+			break
+		}
+		var i int
+		fmt.Sscanf(string(key), "key%06d", &i)
+		if expected, ok := expect(i); !ok || string(iter.Value()) != expected {
+			t.Fatalf("scan returned %s=%s\n", key, iter.Value())
+		}
+		count++
+	}
+	if count != test_num-1000+1 {
+		t.Fatalf("scan returned %d keys", count)
+	}
+}
+
+func TestDB_DeleteRangeCompaction(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+
+	// an old table fully covered by the tombstone and one partly covered
+	test_num := 1000
+	seq := SequenceNumber(1)
+	var inputs []*fileMetaData
+	for _, prefix := range []string{"b", "a"} {
+		mem := newMemTable("")
+		for i := 0; i < test_num; i++ {
+			mem.add(seq, KTypeValue, []byte(fmt.Sprintf("%s%06d", prefix, i)), []byte("value"))
+			seq++
+		}
+		mem.tableNumber = db.newFileNumber()
+		meta, err := db.writeLevel0Table(db.defaultFamily, mem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, meta)
+	}
+	mem := newMemTable("")
+	mem.add(seq, KTypeRangeDeletion, []byte("a000500"), []byte("c"))
+	mem.tableNumber = db.newFileNumber()
+	meta, err := db.writeLevel0Table(db.defaultFamily, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs = append(inputs, meta)
+	if string(meta.smallest.ExtractUserKey()) != "a000500" || string(meta.largest.ExtractUserKey()) != "c" {
+		t.Fatalf("tombstone table range [%s, %s]", meta.smallest.ExtractUserKey(), meta.largest.ExtractUserKey())
+	}
+
+	for _, bottommost := range []bool{true, false} {
+		c := &compaction{level: 0, outputLevel: 1, bottommost: bottommost}
+		c.inputs[0] = inputs
+		outputs, err := db.doCompaction(db.defaultFamily, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var list []Iterator
+		var tombstones rangeTombstones
+		for _, output := range outputs {
+			table, err := db.cache.getTable(output.number)
+			if err != nil {
+				t.Fatal(err)
+			}
+			list = append(list, newSSTableIterator(table))
+			tombstones = append(tombstones, table.tombstones...)
+		}
+		iter := newSortedLevelIterator(list)
+		count := 0
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			key := InternalKey(iter.Key()).ExtractUserKey()
+			if string(key) >= "a000500" {
+				t.Fatalf("key %s should be dropped by the tombstone", key)
+			}
+			count++
+		}
+		if count != 500 {
+			t.Fatalf("compaction wrote %d entries", count)
+		}
+		if bottommost != (len(tombstones) == 0) {
+			t.Fatalf("bottommost %v compaction kept %d tombstones", bottommost, len(tombstones))
+		}
+		if !bottommost && tombstones.maxCoveringSeq([]byte("b000000"), kMaxSequenceNumber) != seq {
+			t.Fatal("the tombstone should still cover older data below")
+		}
+	}
+}
+
+func TestDB_SingleDelete(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SingleDelete([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get([]byte("key")); err != ErrKeyNotFound {
+		t.Fatalf("Expect: %v, but get %v\n", ErrKeyNotFound, err)
+	}
+
+	// "a" and "c" keys meet their Put in the compaction, "b" keys do not.
+	// The Puts of "c" keys point to blob files.
+	test_num := 1000
+	index := (&blobIndex{fileNumber: 1}).encodeTo()
+	mem := newMemTable("")
+	seq := SequenceNumber(1)
+	for i := 0; i < test_num; i++ {
+		mem.add(seq, KTypeValue, []byte(fmt.Sprintf("a%06d", i)), []byte("value"))
+		seq++
+		mem.add(seq, KTypeBlobIndex, []byte(fmt.Sprintf("c%06d", i)), index)
+		seq++
+	}
+	for i := 0; i < test_num; i++ {
+		mem.add(seq, KTypeSingleDeletion, []byte(fmt.Sprintf("a%06d", i)), []byte{})
+		seq++
+		mem.add(seq, KTypeSingleDeletion, []byte(fmt.Sprintf("b%06d", i)), []byte{})
+		seq++
+		mem.add(seq, KTypeSingleDeletion, []byte(fmt.Sprintf("c%06d", i)), []byte{})
+		seq++
+	}
+	mem.tableNumber = db.newFileNumber()
+	meta, err := db.writeLevel0Table(db.defaultFamily, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// compact returns the number of single deletions written of each key prefix
+	compact := func(bottommost bool) map[byte]int {
+		c := &compaction{level: 0, outputLevel: 1, bottommost: bottommost}
+		c.inputs[0] = []*fileMetaData{meta}
+		outputs, err := db.doCompaction(db.defaultFamily, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var list []Iterator
+		for _, output := range outputs {
+			table, err := db.cache.getTable(output.number)
+			if err != nil {
+				t.Fatal(err)
+			}
+			list = append(list, newSSTableIterator(table))
+		}
+		iter := newSortedLevelIterator(list)
+		counts := make(map[byte]int)
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			key := InternalKey(iter.Key())
+			if key.ExtractValueType() != KTypeSingleDeletion {
+				t.Fatalf("unexpected entry %s type %d", key.ExtractUserKey(), key.ExtractValueType())
+			}
+			counts[key.ExtractUserKey()[0]]++
+		}
+		return counts
+	}
+	for _, bottommost := range []bool{true, false} {
+		counts := compact(bottommost)
+		if (bottommost && len(counts) != 0) || (!bottommost && (len(counts) != 1 || counts['b'] != test_num)) {
+			t.Fatalf("bottommost %v compaction wrote %v single deletions", bottommost, counts)
+		}
+	}
+
+	// blob garbage collection may leave another copy of a blob index Put
+	// in an older file, which the deletions must still hide
+	other := newMemTable("")
+	for i := 0; i < test_num; i++ {
+		other.add(SequenceNumber(2*i+2), KTypeBlobIndex, []byte(fmt.Sprintf("c%06d", i)), index)
+	}
+	other.tableNumber = db.newFileNumber()
+	other_meta, err := db.writeLevel0Table(db.defaultFamily, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.muCompaction.Lock()
+	db.defaultFamily.current.addFile(2, other_meta)
+	db.muCompaction.Unlock()
+	if counts := compact(false); len(counts) != 2 || counts['b'] != test_num || counts['c'] != test_num {
+		t.Fatalf("compaction wrote %v single deletions", counts)
+	}
+}
+
+func TestDB_ColumnFamilies(t *testing.T) {
+	option := testOptions(func(option *Options) {
+		option.BlockSize = 1024
+		option.MemTableSize = 1024 * 64
+	})
+
+	db, err := Open(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta_option := *option
+	meta_option.MemTableSize = 1024 * 8
+	meta_option.CompactionStyle = CompactionStyleUniversal
+	meta, err := db.CreateColumnFamily("meta", meta_option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateColumnFamily("meta", meta_option); err != ErrColumnFamilyExists {
+		t.Fatalf("Expect: %v, but get %v\n", ErrColumnFamilyExists, err)
+	}
+
+	// the same keys in both families, meta switching memtables more often
+	test_num := 3000
+	for i := 0; i < test_num; i++ {
+		key := []byte(fmt.Sprintf("key%06d", i))
+		var batch WriteBatch
+		batch.Put(key, []byte(fmt.Sprintf("default%06d", i)))
+		batch.PutCF(meta, key, []byte(fmt.Sprintf("meta%06d", i)))
+		if i%3 == 0 {
+			batch.DeleteCF(meta, key)
+		}
+		if err := db.Write(&batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(db *DB, meta *ColumnFamilyHandle) {
+		for i := 0; i < test_num; i++ {
+			key := []byte(fmt.Sprintf("key%06d", i))
+			value, err := db.Get(key)
+			if err != nil || string(value) != fmt.Sprintf("default%06d", i) {
+				t.Fatalf("default %s get %s %v\n", key, value, err)
+			}
+			value, err = db.GetCF(meta, key)
+			if i%3 == 0 {
+				if err != ErrKeyNotFound {
+					t.Fatalf("meta %s should be deleted, get %s %v\n", key, value, err)
+				}
+			} else if err != nil || string(value) != fmt.Sprintf("meta%06d", i) {
+				t.Fatalf("meta %s get %s %v\n", key, value, err)
+			}
+		}
+
+		iter, err := db.ScanCF(meta, []byte("key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer iter.Close()
+		count := 0
+		for ; iter.Valid(); iter.Next() {
+			count++
+		}
+		if count != test_num-(test_num+2)/3 {
+			t.Fatalf("meta scan returned %d keys", count)
+		}
+	}
+	check(db, meta)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	option.ColumnFamilyOptions = map[string]Options{"meta": meta_option}
+	db, err = Open(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	meta, err = db.GetColumnFamily("meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.cfd.option.CompactionStyle != CompactionStyleUniversal {
+		t.Fatal("meta should be recovered with its own options")
+	}
+	check(db, meta)
+	if _, err := db.GetColumnFamily("blobs"); err != ErrColumnFamilyNotFound {
+		t.Fatalf("Expect: %v, but get %v\n", ErrColumnFamilyNotFound, err)
+	}
+}
+
+func TestDB_ColumnFamilyDBOptions(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+	// the family reads and writes its files through the Env of the DB
+	cf_option := DefaultOptions()
+	cf_option.MemTableSize = 1024 * 8
+	cf, err := db.CreateColumnFamily("other", *cf_option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_num := 1000
+	for i := 0; i < test_num; i++ {
+		if err := db.PutCF(cf, []byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("value%06d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForBackgroundWork(db)
+	db.muCompaction.Lock()
+	files := 0
+	for _, level := range cf.cfd.current.files {
+		files += len(level)
+	}
+	db.muCompaction.Unlock()
+	if files == 0 {
+		t.Fatal("Expect the memtables of the family to be flushed")
+	}
+	for i := 0; i < test_num; i++ {
+		value, err := db.GetCF(cf, []byte(fmt.Sprintf("%06d", i)))
+		expectValue(t, value, err, fmt.Sprintf("value%06d", i))
+	}
+}
+
+func TestDB_SnapshotCompaction(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+
+	mem := newMemTable("")
+	mem.add(1, KTypeValue, []byte("a"), []byte("v1"))
+	mem.add(2, KTypeValue, []byte("b"), []byte("v1"))
+	mem.add(3, KTypeValue, []byte("a"), []byte("v2"))
+	mem.add(4, KTypeDeletion, []byte("b"), []byte{})
+	mem.addRangeTombstone(5, []byte("a"), []byte("c"))
+	mem.tableNumber = db.newFileNumber()
+	meta, err := db.writeLevel0Table(db.defaultFamily, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compact := func() int {
+		c := &compaction{level: 0, outputLevel: 1, bottommost: true}
+		c.inputs[0] = []*fileMetaData{meta}
+		outputs, err := db.doCompaction(db.defaultFamily, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for _, output := range outputs {
+			table, err := db.cache.getTable(output.number)
+			if err != nil {
+				t.Fatal(err)
+			}
+			iter := newSSTableIterator(table)
+			for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+				count++
+			}
+			count += len(table.tombstones)
+		}
+		return count
+	}
+
+	// a snapshot at 2 reads the first versions of a and b
+	db.snapshots = map[SequenceNumber]int{2: 1, 4: 1}
+	if count := compact(); count != 5 {
+		t.Fatalf("compaction under a snapshot kept %d entries", count)
+	}
+	// one at 4 reads the second version of a, and the deletion of b
+	db.snapshots = map[SequenceNumber]int{4: 1}
+	if count := compact(); count != 2 {
+		t.Fatalf("compaction under a snapshot kept %d entries", count)
+	}
+	db.snapshots = make(map[SequenceNumber]int)
+	if count := compact(); count != 0 {
+		t.Fatalf("compaction without snapshots kept %d entries", count)
+	}
+}
+
+func TestDB_BlobFiles(t *testing.T) {
+	option := testOptions(func(option *Options) {
+		option.MemTableSize = 1024 * 64
+		option.MinBlobSize = 512
+	})
+	path := option.DirPath
+
+	db, err := Open(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	test_num := 1000
+	large := func(i, round int) string {
+		return fmt.Sprintf("%06d-%d-%01000d", i, round, 0)
+	}
+	for round := 0; round < 2; round++ {
+		for i := 0; i < test_num; i++ {
+			value := large(i, round)
+			if i%2 == 1 {
+				// small values stay in the sstables
+				value = fmt.Sprintf("value%06d", i)
+			}
+			if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Delete([]byte("000000")); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		for i := 1; i < test_num; i++ {
+			expected := large(i, 1)
+			if i%2 == 1 {
+				expected = fmt.Sprintf("value%06d", i)
+			}
+			value, err := db.Get([]byte(fmt.Sprintf("%06d", i)))
+			if err != nil || string(value) != expected {
+				t.Fatalf("Get %06d: %v", i, err)
+			}
+		}
+		iter, err := db.Scan([]byte(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer iter.Close()
+		count := 0
+		for ; iter.Valid(); iter.Next() {
+			key := InternalKey(iter.Key()).ExtractUserKey()
+			if key[5]%2 == 0 && string(iter.Value()[:6]) != string(key) {
+				t.Fatalf("Scan %s: unexpected value %.20s", key, iter.Value())
+			}
+			count++
+		}
+		if count != test_num-1 {
+			t.Fatalf("Scan returned %d keys", count)
+		}
+	}
+	check()
+
+	// recover and make sure values moved to blob files
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(*option); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	blobs_size := func() int64 {
+		var size int64
+		for _, number := range db.defaultFamily.blobFiles {
+			n, err := option.Env.GetFileSize(blobFileName(path, number))
+			if err != nil {
+				t.Fatal(err)
+			}
+			size += int64(n)
+		}
+		return size
+	}
+	before := blobs_size()
+	if before < int64(test_num/2*len(large(0, 0))) {
+		t.Fatalf("blob files hold %d bytes", before)
+	}
+
+	// the first round of large values is garbage
+	if err := db.GarbageCollectBlobs(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	if after := blobs_size(); after > before-int64(test_num/4*len(large(0, 0))) {
+		t.Fatalf("blob files hold %d bytes after garbage collection, %d before", after, before)
+	}
+}
+
+func TestDB_BlobGarbageCollection(t *testing.T) {
+	option := testOptions(func(option *Options) {
+		option.MinBlobSize = 512
+	})
+	path := option.DirPath
+
+	db, err := Open(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	test_num := 100
+	large := func(i, round int) string {
+		return fmt.Sprintf("%06d-%d-%01000d", i, round, 0)
+	}
+	// the values go to a blob file per round when the log is recovered,
+	// half of the first one is overwritten
+	for round := 0; round < 2; round++ {
+		for i := 0; i < test_num; i += round + 1 {
+			if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte(large(i, round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = Open(*option); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := db.defaultFamily.blobFiles[0]
+	db.mu.Lock()
+	before := db.lastSequence()
+	db.mu.Unlock()
+
+	// the keys moved by garbage collection are not written by anyone
+	txn := db.BeginTransaction(DefaultTransactionOptions())
+	value, err := txn.GetForUpdate([]byte("000001"))
+	expectValue(t, value, err, large(1, 0))
+	if err := txn.Put([]byte("000001"), []byte("txn")); err != nil {
+		t.Fatal(err)
+	}
+
+	// an open iterator keeps the collected file
+	iter, err := db.Scan([]byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	if err := db.GarbageCollectBlobs(); err != nil {
+		t.Fatal(err)
+	}
+	if !option.Env.FileExists(blobFileName(path, first)) {
+		t.Fatalf("blob file %d deleted while an iterator reads it", first)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for ; iter.Valid(); iter.Next() {
+		if expected := large(count, 1-count%2); string(iter.Value()) != expected {
+			t.Fatalf("Scan %06d: unexpected value %.20s", count, iter.Value())
+		}
+		count++
+	}
+	if iter.Err() != nil || count != test_num {
+		t.Fatalf("Scan returned %d keys: %v", count, iter.Err())
+	}
+	iter.Close()
+
+	if err := db.GarbageCollectBlobs(); err != nil {
+		t.Fatal(err)
+	}
+	if option.Env.FileExists(blobFileName(path, first)) {
+		t.Fatalf("blob file %d not deleted", first)
+	}
+	// a moved value is a newer entry of its key, which keeps the sequence
+	// number of the write
+	mem_iter := db.defaultFamily.mem.iterator()
+	mem_iter.Seek(NewInternalKey([]byte("000003"), kMaxSequenceNumber, KTypeValue))
+	if !mem_iter.Valid() || string(InternalKey(mem_iter.Key()).ExtractUserKey()) != "000003" {
+		t.Fatal("moved value of 000003 not in the memtable")
+	}
+	if key := InternalKey(mem_iter.Key()); key.ExtractSequenceNumber() <= before || writtenSequence(key, mem_iter.Value()) > before {
+		t.Fatalf("moved value of 000003 at sequence %d written at %d, last sequence before %d",
+			key.ExtractSequenceNumber(), writtenSequence(key, mem_iter.Value()), before)
+	}
+	for i := 0; i < test_num; i++ {
+		expected := large(i, 1-i%2)
+		if i == 1 {
+			expected = "txn"
+		}
+		value, err := db.Get([]byte(fmt.Sprintf("%06d", i)))
+		expectValue(t, value, err, expected)
+	}
+
+	// a value that can not be read ends the scan with an error
+	for _, number := range db.defaultFamily.blobFiles {
+		db.blobs.evict(number)
+		if err := option.Env.RemoveFile(blobFileName(path, number)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	iter, err = db.Scan([]byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	if iter.Valid() || iter.Err() == nil {
+		t.Fatalf("Scan of a missing blob file: valid %v, error %v", iter.Valid(), iter.Err())
+	}
+}
+
+func TestDB_BlobGarbageCollectionConcurrentGets(t *testing.T) {
+	db, _ := openTestDB(t, func(option *Options) {
+		option.MemTableSize = 1024 * 64
+		option.MinBlobSize = 512
+	})
+	test_num := 200
+	put := func(round int) {
+		for i := 0; i < test_num; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("%06d-%d-%01000d", i, round, 0))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(0)
+
+	// the blob files read by a Get are not deleted under it
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			key := fmt.Sprintf("%06d", i%test_num)
+			if value, err := db.Get([]byte(key)); err != nil || !strings.HasPrefix(string(value), key) {
+				errs <- fmt.Errorf("Get %s: %v", key, err)
+				return
+			}
+		}
+	}()
+	for round := 1; round < 20; round++ {
+		put(round)
+		waitForBackgroundWork(db)
+		if err := db.GarbageCollectBlobs(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDB_OpenReadOnly(t *testing.T) {
+	option := testOptions(func(option *Options) {
+		option.MemTableSize = 1024 * 64
+	})
+	path := option.DirPath
+
+	if _, err := OpenReadOnly(*option); err == nil {
+		t.Fatal("read-only open of a missing DB succeeded")
+	}
+
+	db, err := Open(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("value%06d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	check := func(reader *DB, to int) {
+		t.Helper()
+		for i := 0; i < to; i++ {
+			value, err := reader.Get([]byte(fmt.Sprintf("%06d", i)))
+			if err != nil || string(value) != fmt.Sprintf("value%06d", i) {
+				t.Fatalf("Get %06d: %v", i, err)
+			}
+		}
+		if _, err := reader.Get([]byte(fmt.Sprintf("%06d", to))); err != ErrKeyNotFound {
+			t.Fatalf("Expect: %v, but get %v\n", ErrKeyNotFound, err)
+		}
+	}
+
+	// some updates are in level 0, the others in the log
+	put(0, 5000)
+	// a flush or compaction still running would change the directory as well
+	waitForBackgroundWork(db)
+	entries, err := option.Env.GetChildren(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := OpenReadOnly(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	check(reader, 5000)
+	if err := reader.Put([]byte("key"), []byte("value")); err != ErrReadOnly {
+		t.Fatalf("Expect: %v, but get %v\n", ErrReadOnly, err)
+	}
+	if _, err := reader.CreateColumnFamily("cf", *option); err != ErrReadOnly {
+		t.Fatalf("Expect: %v, but get %v\n", ErrReadOnly, err)
+	}
+	after, err := option.Env.GetChildren(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(entries) {
+		t.Fatalf("read-only open changed the directory from %d to %d files", len(entries), len(after))
+	}
+
+	put(5000, 6000)
+	check(reader, 5000)
+	if err := reader.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	check(reader, 6000)
+}
+
+// TestDB_Lock runs on disk, to check the lock of the operating system.
+// flippingEnv replaces the manifest by the other one of two versions each
+// time it is read, like a writer saving manifests all the time.
+type flippingEnv struct {
+	Env
+	manifests [2][]byte
+	reads     int
+}
+
+type flippingFile struct {
+	RandomAccessFile
+	env  *flippingEnv
+	name string
+}
+
+func (env *flippingEnv) NewRandomAccessFile(name string) (RandomAccessFile, error) {
+	file, err := env.Env.NewRandomAccessFile(name)
+	if err != nil || filepath.Base(name) != filepath.Base(manifestFileName("")) {
+		return file, err
+	}
+	return &flippingFile{RandomAccessFile: file, env: env, name: name}, nil
+}
+
+func (file *flippingFile) Close() error {
+	file.env.reads++
+	if err := writeFile(file.env.Env, file.name, file.env.manifests[file.env.reads%2]); err != nil {
+		return err
+	}
+	return file.RandomAccessFile.Close()
+}
+
+func TestDB_OpenReadOnlyChangingManifest(t *testing.T) {
+	option := testOptions(nil)
+	path := option.DirPath
+
+	var manifests [2][]byte
+	for i := 0; i < 2; i++ {
+		db, err := Open(*option)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if manifests[i], err = readFile(option.Env, manifestFileName(path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writeFile(option.Env, manifestFileName(path), manifests[0]); err != nil {
+		t.Fatal(err)
+	}
+	env := &flippingEnv{Env: option.Env, manifests: manifests}
+	option.Env = env
+	if _, err := OpenReadOnly(*option); err != ErrManifestChanged {
+		t.Fatalf("Expect: %v, but get %v\n", ErrManifestChanged, err)
+	}
+	if env.reads != 2*kMaxRecoverAttempts {
+		t.Fatalf("manifest read %d times", env.reads)
+	}
+}
+
+func TestDB_Lock(t *testing.T) {
+	path := "/tmp/goleveldb-mydb"
+	os.RemoveAll(path)
+	option := DefaultOptions()
+	option.DirPath = path
+
+	db, err := Open(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	if _, err := Open(*option); err != ErrLocked {
+		t.Fatalf("Expect: %v, but get %v\n", ErrLocked, err)
+	}
+	// readers do not need the lock
+	reader, err := OpenReadOnly(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(*option); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+}
+
+func TestDB_MmapReads(t *testing.T) {
+	// runs on disk, only the files of DefaultEnv can be mapped
+	path := "/tmp/goleveldb-mydb"
+	os.RemoveAll(path)
+	option := DefaultOptions()
+	option.DirPath = path
+	option.MemTableSize = 1024 * 64
+	option.MaxOpenFiles = 4
+	option.UseMmapReads = true
+
+	db, err := Open(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	defer db.Close()
+	test_num := 20000
+	for i := 0; i < test_num; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("value%06d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForBackgroundWork(db)
+
+	var number uint64
+	db.muCompaction.Lock()
+	for level := len(db.defaultFamily.current.files) - 1; level >= 0; level-- {
+		if files := db.defaultFamily.current.files[level]; len(files) > 0 {
+			number = files[0].number
+		}
+	}
+	db.muCompaction.Unlock()
+	if table, err := db.cache.getTable(number); err != nil || !table.mapped {
+		t.Fatalf("Expect table %d to be mapped: %v\n", number, err)
+	}
+
+	// the values read stay valid after their tables are evicted and unmapped
+	values := make([][]byte, test_num)
+	for i := 0; i < test_num; i++ {
+		if values[i], err = db.Get([]byte(fmt.Sprintf("%06d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runtime.GC()
+	runtime.GC()
+	for i := 0; i < test_num; i++ {
+		if string(values[i]) != fmt.Sprintf("value%06d", i) {
+			t.Fatalf("Expect: value%06d, but get %s\n", i, values[i])
+		}
+	}
+
+	// and so do the keys and values of a scan after the iterator is closed
+	iter, err := db.Scan([]byte("000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys [][]byte
+	values = values[:0]
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, iter.Key())
+		values = append(values, iter.Value())
+	}
+	iter.Close()
+	if len(values) != test_num {
+		t.Fatalf("Expect: %d, but get %d\n", test_num, len(values))
+	}
+	db.muCompaction.Lock()
+	for _, files := range db.defaultFamily.current.files {
+		for _, file := range files {
+			db.cache.evict(file.number)
+		}
+	}
+	db.muCompaction.Unlock()
+	iter = nil
+	runtime.GC()
+	runtime.GC()
+	for i := 0; i < test_num; i++ {
+		if string(InternalKey(keys[i]).ExtractUserKey()) != fmt.Sprintf("%06d", i) {
+			t.Fatalf("Expect: %06d, but get %s\n", i, InternalKey(keys[i]).ExtractUserKey())
+		}
+		if string(values[i]) != fmt.Sprintf("value%06d", i) {
+			t.Fatalf("Expect: value%06d, but get %s\n", i, values[i])
+		}
+	}
+}
+
+func TestDB_DirectIOForCompaction(t *testing.T) {
+	// runs on disk, to use the direct I/O of the operating system
+	path := "/tmp/goleveldb-mydb"
+	os.RemoveAll(path)
+	option := DefaultOptions()
+	option.DirPath = path
+	option.MemTableSize = 1024 * 64
+	option.UseDirectIOForCompaction = true
+	option.DropPageCacheAfterFlush = true
+
+	db, err := Open(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	// written twice, so that compactions merge files instead of moving them
+	test_num := 10000
+	for round := 0; round < 2; round++ {
+		for i := 0; i < test_num; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("value%06d_%d", i, round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	waitForBackgroundWork(db)
+	db.muCompaction.Lock()
+	compacted := db.compactedBytes
+	db.muCompaction.Unlock()
+	if compacted == 0 {
+		t.Fatalf("Expect compactions to run\n")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = Open(*option); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < test_num; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("%06d", i)))
+		if err != nil || string(value) != fmt.Sprintf("value%06d_1", i) {
+			t.Fatalf("Get %06d: %v", i, err)
+		}
+	}
+}
+
+func TestDB_RateLimiter(t *testing.T) {
+	db, option := openTestDB(t, func(option *Options) {
+		option.MemTableSize = 1024 * 64
+		option.RateLimiter = NewRateLimiter(100*MB, true)
+	})
+	test_num := 10000
+	for round := 0; round < 2; round++ {
+		for i := 0; i < test_num; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("value%06d_%d", i, round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	waitForBackgroundWork(db)
+
+	// flushed, compacted and read by compactions
+	db.muCompaction.Lock()
+	written := db.flushedBytes + db.compactedBytes
+	db.muCompaction.Unlock()
+	if through := option.RateLimiter.TotalBytesThrough(); through <= int64(written) {
+		t.Fatalf("Expect more than %d bytes through the RateLimiter, but get %d\n", written, through)
+	}
+	for i := 0; i < test_num; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("%06d", i)))
+		if err != nil || string(value) != fmt.Sprintf("value%06d_1", i) {
+			t.Fatalf("Get %06d: %v", i, err)
+		}
+	}
+}
+
+func TestDB_RateLimiterColumnFamily(t *testing.T) {
+	db, option := openTestDB(t, func(option *Options) {
+		option.RateLimiter = NewRateLimiter(100*MB, true)
+	})
+	// the family has no RateLimiter of its own, the one of the DB applies
+	cf_option := DefaultOptions()
+	cf_option.MemTableSize = 1024 * 64
+	cf, err := db.CreateColumnFamily("other", *cf_option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_num := 10000
+	for round := 0; round < 2; round++ {
+		for i := 0; i < test_num; i++ {
+			if err := db.PutCF(cf, []byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("value%06d_%d", i, round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	waitForBackgroundWork(db)
+
+	db.muCompaction.Lock()
+	written := cf.cfd.flushedBytes + cf.cfd.compactedBytes
+	db.muCompaction.Unlock()
+	if through := option.RateLimiter.TotalBytesThrough(); written == 0 || through <= int64(written) {
+		t.Fatalf("Expect more than %d bytes through the RateLimiter, but get %d\n", written, through)
+	}
+}
+
+func TestDB_RateLimiterBlobFiles(t *testing.T) {
+	option := testOptions(func(option *Options) {
+		option.MemTableSize = 1024 * 64
+		option.MinBlobSize = 512
+	})
+	// a rate of zero throttles nothing, but counts the bytes through
+	option.RateLimiter = NewRateLimiter(0, true)
+
+	db, err := Open(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	begin := time.Now()
+	test_num := 1000
+	value := fmt.Sprintf("%01000d", 0)
+	for i := 0; i < test_num; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForBackgroundWork(db)
+	if elapsed := time.Since(begin); elapsed > 5*time.Second {
+		t.Fatalf("Expect no throttling, but take %v\n", elapsed)
+	}
+
+	// the values written to blob files by flushes count too, at least half of
+	// them left the memtable
+	db.muCompaction.Lock()
+	written := db.flushedBytes + db.compactedBytes
+	db.muCompaction.Unlock()
+	blob_bytes := int64(test_num / 2 * len(value))
+	if through := option.RateLimiter.TotalBytesThrough(); through < int64(written)+blob_bytes {
+		t.Fatalf("Expect at least %d bytes through the RateLimiter, but get %d\n", int64(written)+blob_bytes, through)
+	}
+}
+
+// openBaselineDB opens a copy of testdata/baseline_db in memory. The DB was
+// written by the first release of goleveldb: 3000 keys were put, and every
+// tenth key deleted afterwards. Two tables were flushed and moved to level 1,
+// the rest of the updates were left in the log by Close.
+func openBaselineDB(t *testing.T) *DB {
+	path := "/tmp/goleveldb-mydb"
+	env := NewMemEnv()
+	if err := env.CreateDir(path); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir("testdata/baseline_db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join("testdata/baseline_db", entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(env, filepath.Join(path, entry.Name()), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	option := DefaultOptions()
+	option.DirPath = path
+	option.Env = env
+	db, err := Open(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestDB_OpenBaselineManifest(t *testing.T) {
+	db := openBaselineDB(t)
+	defer db.Close()
+
+	db.muCompaction.Lock()
+	var numbers []uint64
+	for level := 0; level < len(db.defaultFamily.current.files); level++ {
+		for _, meta := range db.defaultFamily.current.files[level] {
+			if meta.creationTime == 0 {
+				t.Fatalf("Expect a creation time for table %d\n", meta.number)
+			}
+			numbers = append(numbers, meta.number)
+		}
+	}
+	db.muCompaction.Unlock()
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	if len(numbers) < 2 || numbers[0] != 3 || numbers[1] != 5 {
+		t.Fatalf("Expect the baseline tables 3 and 5, but get %v\n", numbers)
+	}
+	// the tables hold the keys up to 002621, every tenth one is deleted in the log
+	for i := 0; i <= 2621; i++ {
+		if i%10 == 0 {
+			continue
+		}
+		value, err := db.Get([]byte(fmt.Sprintf("%06d", i)))
+		if err != nil || string(value) != fmt.Sprintf("value%06d", i) {
+			t.Fatalf("Get %06d: %v", i, err)
+		}
+	}
+}
+
+func TestDB_OpenBaselineLog(t *testing.T) {
+	db := openBaselineDB(t)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	check := func(db *DB) {
+		for i := 0; i < 3000; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("%06d", i)))
+			if i%10 == 0 {
+				if err != ErrKeyNotFound {
+					t.Fatalf("Expect %06d deleted, but get %q: %v\n", i, value, err)
+				}
+			} else if err != nil || string(value) != fmt.Sprintf("value%06d", i) {
+				t.Fatalf("Get %06d: %v", i, err)
+			}
+		}
+	}
+	check(db)
+
+	// the updates of the old log are flushed, and the log deleted
+	option := db.option
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if option.Env.FileExists(walFileName(option.DirPath, 4)) {
+		t.Fatal("Expect the old log to be deleted")
+	}
+	var err error
+	if db, err = Open(option); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+}
+
+func TestDB_Statistics(t *testing.T) {
+	db, option := openTestDB(t, func(option *Options) {
+		option.MemTableSize = 1024 * 64
+		option.Statistics = NewStatistics()
+	})
+	test_num := 10000
+	for round := 0; round < 2; round++ {
+		for i := 0; i < test_num; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("value%06d_%d", i, round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	waitForBackgroundWork(db)
+	for i := 0; i < test_num; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("%06d", i)))
+		if err != nil || string(value) != fmt.Sprintf("value%06d_1", i) {
+			t.Fatalf("Get %06d: %v", i, err)
+		}
+	}
+
+	data := option.Statistics.Data()
+	if data.BytesWritten == 0 || data.BytesRead == 0 {
+		t.Fatalf("Expect bytes written and read, but get %d and %d\n", data.BytesWritten, data.BytesRead)
+	}
+	if data.GetMicros.Count != uint64(test_num) || data.WriteMicros.Count != uint64(2*test_num) {
+		t.Fatalf("Expect %d gets and %d writes, but get %d and %d\n", test_num, 2*test_num, data.GetMicros.Count, data.WriteMicros.Count)
+	}
+	if data.MemtableHits+data.MemtableMisses != uint64(test_num) {
+		t.Fatalf("Expect %d memtable lookups, but get %d\n", test_num, data.MemtableHits+data.MemtableMisses)
+	}
+	var lookups uint64
+	for _, n := range data.TableLookups {
+		lookups += n
+	}
+	if lookups < data.MemtableMisses {
+		t.Fatalf("Expect at least %d table lookups, but get %d\n", data.MemtableMisses, lookups)
+	}
+	if data.FlushBytesWritten == 0 || data.CompactionBytesWritten == 0 || data.CompactionBytesRead == 0 {
+		t.Fatalf("Expect flushes and compactions, but get %+v\n", data)
+	}
+	option.Statistics.Reset()
+	if data := option.Statistics.Data(); data.BytesWritten != 0 || data.GetMicros.Count != 0 {
+		t.Fatalf("Expect no values after Reset, but get %+v\n", data)
+	}
+
+	var files int
+	for level := 0; level < int(NumLevels); level++ {
+		value, ok := db.GetProperty(fmt.Sprintf("leveldb.num-files-at-level%d", level))
+		if !ok {
+			t.Fatalf("Expect property of level %d\n", level)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files += n
+	}
+	if files == 0 {
+		t.Fatal("Expect sstables")
+	}
+	if _, ok := db.GetProperty(fmt.Sprintf("leveldb.num-files-at-level%d", NumLevels)); ok {
+		t.Fatal("Expect no property beyond the last level")
+	}
+	if stats, ok := db.GetProperty("leveldb.stats"); !ok || !strings.Contains(stats, "Write amplification") || !strings.Contains(stats, "get.micros") {
+		t.Fatalf("Expect stats, but get %q\n", stats)
+	}
+	if sstables, ok := db.GetProperty("leveldb.sstables"); !ok || strings.Count(sstables, "[") != files {
+		t.Fatalf("Expect %d sstables, but get %q\n", files, sstables)
+	}
+	if size, ok := db.GetProperty("leveldb.total-sst-size"); !ok || size == "0" {
+		t.Fatalf("Expect sstable size, but get %q\n", size)
+	}
+	if _, ok := db.GetProperty("leveldb.unknown"); ok {
+		t.Fatal("Expect no unknown property")
+	}
+
+	// the bytes flushed and compacted are those of the column family
+	cf, err := db.CreateColumnFamily("empty", *option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats, ok := db.GetPropertyCF(cf, "leveldb.stats"); !ok || !strings.Contains(stats, "Flushed(MB): 0.00  Compacted(MB): 0.00") {
+		t.Fatalf("Expect nothing flushed or compacted, but get %q\n", stats)
+	}
+
+	// the reads of the tables of a family created without Statistics count
+	// in those of the DB
+	other_option := DefaultOptions()
+	other_option.MemTableSize = 1024 * 8
+	other, err := db.CreateColumnFamily("other", *other_option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < test_num; i++ {
+		if err := db.PutCF(other, []byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("value%06d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForBackgroundWork(db)
+	option.Statistics.Reset()
+	for i := 0; i < test_num; i++ {
+		value, err := db.GetCF(other, []byte(fmt.Sprintf("%06d", i)))
+		expectValue(t, value, err, fmt.Sprintf("value%06d", i))
+	}
+	data = option.Statistics.Data()
+	if data.MemtableMisses == 0 || data.TableCacheHits+data.TableCacheMisses < data.MemtableMisses {
+		t.Fatalf("Expect table reads, but get %+v\n", data)
+	}
+	stats, ok := db.GetPropertyCF(other, "leveldb.stats")
+	if !ok || !strings.Contains(stats, fmt.Sprintf("table.cache.hits: %d", data.TableCacheHits)) {
+		t.Fatalf("Expect the table reads of the family, but get %q\n", stats)
+	}
+
+	// a nil Statistics has all values zero
+	var none *Statistics
+	none.Reset()
+	if data := none.Data(); data != (StatisticsData{}) || !strings.Contains(none.String(), "bytes.written: 0") {
+		t.Fatalf("Expect no values, but get %+v\n", data)
+	}
+}
+
+func TestDB_Repair(t *testing.T) {
+	option := testOptions(func(option *Options) {
+		option.MemTableSize = 1024 * 64
+	})
+	path := option.DirPath
+
+	// updates both in tables and in the log
+	db, err := Open(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_num := 5000
+	for i := 0; i < test_num; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("value%06d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.DeleteRange([]byte("000000"), []byte("000010")); err != nil {
+		t.Fatal(err)
+	}
+	// the log holds records of another column family
+	meta, err := db.CreateColumnFamily("meta", *option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutCF(meta, []byte("metakey"), []byte("metavalue")); err != nil {
+		t.Fatal(err)
+	}
+	// a table with older updates of a key than another one may have a
+	// higher number, as compaction outputs do
+	db.mu.Lock()
+	seq := db.lastSequence()
+	db.mu.Unlock()
+	newer := newMemTable("")
+	newer.add(seq+2000, KTypeValue, []byte("key"), []byte("newer"))
+	newer.tableNumber = db.newFileNumber()
+	older := newMemTable("")
+	older.add(seq+1000, KTypeValue, []byte("key"), []byte("older"))
+	older.tableNumber = db.newFileNumber()
+	for _, mem := range []*memTable{newer, older} {
+		if _, err := db.writeLevel0Table(db.defaultFamily, mem); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := option.Env.RemoveFile(manifestFileName(path)); err != nil {
+		t.Fatal(err)
+	}
+	garbage := sstableFileName(path, 999999)
+	if err := writeFile(option.Env, garbage, []byte("not a table, not a table, not a table, not a table")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Repair(*option); err != nil {
+		t.Fatal(err)
+	}
+	if !option.Env.FileExists(filepath.Join(path, kLostDirName, filepath.Base(garbage))) {
+		t.Fatalf("Expect %s to be moved to %s\n", garbage, kLostDirName)
+	}
+
+	if db, err = Open(*option); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < test_num; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("%06d", i)))
+		if i < 10 {
+			if err != ErrKeyNotFound {
+				t.Fatalf("Expect: %v, but get %v\n", ErrKeyNotFound, err)
+			}
+		} else if err != nil || string(value) != fmt.Sprintf("value%06d", i) {
+			t.Fatalf("Get %06d: %v", i, err)
+		}
+	}
+	value, err := db.Get([]byte("key"))
+	expectValue(t, value, err, "newer")
+	if _, err := db.Get([]byte("metakey")); err != ErrKeyNotFound {
+		t.Fatalf("Expect: %v, but get %v\n", ErrKeyNotFound, err)
+	}
+	if meta, err = db.GetColumnFamily(fmt.Sprintf("%s-%d", kLostDirName, meta.ID())); err != nil {
+		t.Fatal(err)
+	}
+	value, err = db.GetCF(meta, []byte("metakey"))
+	expectValue(t, value, err, "metavalue")
+
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get([]byte("key")); err != nil || string(value) != "value" {
+		t.Fatalf("Get key: %v", err)
+	}
+}
+
+func TestDB_DestroyDB(t *testing.T) {
+	option := testOptions(func(option *Options) {
+		option.MemTableSize = 1024 * 64
+	})
+	path := option.DirPath
+
+	db, err := Open(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("value%06d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := DestroyDB(*option); err != ErrLocked {
+		t.Fatalf("Expect: %v, but get %v\n", ErrLocked, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// files of others, leveldb ones included, are left alone
+	other := filepath.Join(path, "notes.txt")
+	current := filepath.Join(path, "CURRENT")
+	for _, name := range []string{other, current} {
+		if err := writeFile(option.Env, name, []byte("notes")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := DestroyDB(*option); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := option.Env.GetChildren(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(entries)
+	if len(entries) != 2 || entries[0] != "CURRENT" || entries[1] != "notes.txt" {
+		t.Fatalf("Expect only CURRENT and notes.txt to remain, but get %v\n", entries)
+	}
+
+	for _, name := range []string{other, current} {
+		if err := option.Env.RemoveFile(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db, err = Open(*option); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := DestroyDB(*option); err != nil {
+		t.Fatal(err)
+	}
+	if option.Env.FileExists(path) {
+		t.Fatal("Expect the directory to be removed")
+	}
+	// nothing left to destroy
+	if err := DestroyDB(*option); err != nil {
+		t.Fatal(err)
+	}
+
+	// the LOCK file is removed before it is unlocked
+	env := &unlockCheckingEnv{Env: option.Env}
+	option.Env = env
+	if db, err = Open(*option); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	env.unlockedExisting = false // Close keeps the LOCK file
+	if err := DestroyDB(*option); err != nil {
+		t.Fatal(err)
+	}
+	if env.unlockedExisting {
+		t.Fatal("Expect LOCK to be removed while locked")
+	}
+}
+
+// unlockCheckingEnv records whether a lock is released while its file exists.
+type unlockCheckingEnv struct {
+	Env
+	unlockedExisting bool
+}
+
+type unlockCheckingLock struct {
+	FileLock
+	env  *unlockCheckingEnv
+	name string
+}
+
+func (env *unlockCheckingEnv) LockFile(name string) (FileLock, error) {
+	lock, err := env.Env.LockFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &unlockCheckingLock{FileLock: lock, env: env, name: name}, nil
+}
+
+func (lock *unlockCheckingLock) Unlock() error {
+	lock.env.unlockedExisting = lock.env.unlockedExisting || lock.env.FileExists(lock.name)
+	return lock.FileLock.Unlock()
+}
+
+func TestDB_Checkpoint(t *testing.T) {
+	checkpoint := "/tmp/goleveldb-checkpoint"
+	db, option := openTestDB(t, func(option *Options) {
+		option.MemTableSize = 1024 * 64
+	})
+	path := option.DirPath
+	// in tables and in the log
+	test_num := 5000
+	for i := 0; i < test_num; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("value%06d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Checkpoint(checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(checkpoint); err == nil {
+		t.Fatal("Expect an error for an existing directory")
+	}
+	// not seen by the checkpoint
+	for i := 0; i < test_num; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkpoint_option := *option
+	checkpoint_option.DirPath = checkpoint
+	copied, err := Open(checkpoint_option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+	for i := 0; i < test_num; i++ {
+		value, err := copied.Get([]byte(fmt.Sprintf("%06d", i)))
+		if err != nil || string(value) != fmt.Sprintf("value%06d", i) {
+			t.Fatalf("Get %06d: %v", i, err)
+		}
+	}
+	// both DBs are written independently
+	if err := copied.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get([]byte("key")); err != ErrKeyNotFound {
+		t.Fatalf("Expect: %v, but get %v\n", ErrKeyNotFound, err)
+	}
+	if value, err := db.Get([]byte("000000")); err != nil || string(value) != "new" {
+		t.Fatalf("Get 000000: %v", err)
+	}
+
+	// files made obsolete while a checkpoint runs are deleted afterwards
+	obsolete := sstableFileName(path, 999999)
+	if err := writeFile(option.Env, obsolete, []byte("obsolete")); err != nil {
+		t.Fatal(err)
+	}
+	db.pauseFileDeletions()
+	if err := db.removeObsoleteFile(obsolete); err != nil {
+		t.Fatal(err)
+	}
+	if !option.Env.FileExists(obsolete) {
+		t.Fatalf("%s deleted while deletions are paused", obsolete)
+	}
+	if err := db.resumeFileDeletions(); err != nil {
+		t.Fatal(err)
+	}
+	if option.Env.FileExists(obsolete) {
+		t.Fatalf("%s not deleted once deletions resume", obsolete)
+	}
+}
+
+// countingEnv counts the files created through it.
+type countingEnv struct {
+	Env
+	mu      sync.Mutex
+	created map[string]int
+}
+
+func (env *countingEnv) NewWritableFile(name string) (WritableFile, error) {
+	env.mu.Lock()
+	env.created[filepath.Ext(name)]++
+	env.mu.Unlock()
+	return env.Env.NewWritableFile(name)
+}
+
+func TestDB_Env(t *testing.T) {
+	path := "/tmp/goleveldb-mydb"
+	env := &countingEnv{Env: NewMemEnv(), created: make(map[string]int)}
+	option := DefaultOptions()
+	option.DirPath = path
+	option.MemTableSize = 1024 * 64
+	option.Env = env
+
+	db, err := Open(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("value%06d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	for _, ext := range []string{".ldb", ".log", ".tmp"} {
+		if env.created[ext] == 0 {
+			t.Fatalf("Expect %s files to be created through the Env, but get %v\n", ext, env.created)
+		}
+	}
+}
+
+func TestDB_MemEnvCrash(t *testing.T) {
+	for _, sync := range []bool{true, false} {
+		env := NewMemEnv()
+		option := DefaultOptions()
+		option.DirPath = "/tmp/goleveldb-mydb"
+		option.Env = env
+		option.Sync = sync
+
+		db, err := Open(*option)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("value%06d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// db is abandoned, as by a crashed process
+		env.Crash()
+
+		if db, err = Open(*option); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("%06d", i)))
+			if sync && (err != nil || string(value) != fmt.Sprintf("value%06d", i)) {
+				t.Fatalf("Get %06d: %v", i, err)
+			} else if !sync && err != ErrKeyNotFound {
+				t.Fatalf("Expect: %v, but get %v\n", ErrKeyNotFound, err)
+			}
+		}
+		db.Close()
+	}
+}
+
+func TestDB_EncryptedEnv(t *testing.T) {
+	base := NewMemEnv()
+	key1, key2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+	option := DefaultOptions()
+	option.DirPath = "/tmp/goleveldb-mydb"
+	option.MemTableSize = 1024 * 64
+	option.Env = NewEncryptedEnv(base, NewStaticKeyProvider(map[uint32][]byte{1: key1}, 1))
+
+	db, err := Open(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_num := 5000
+	for i := 0; i < test_num; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("value%06d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// neither keys nor values are readable in the files
+	names, err := base.GetChildren(option.DirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		data, err := readFile(base, filepath.Join(option.DirPath, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("value0")) || bytes.Contains(data, []byte("00001")) {
+			t.Fatalf("Expect %s to be encrypted\n", name)
+		}
+	}
+
+	option.Env = NewEncryptedEnv(base, NewStaticKeyProvider(map[uint32][]byte{2: key2}, 2))
+	if _, err := Open(*option); err == nil {
+		t.Fatalf("Expect the DB not to open without its key\n")
+	}
+
+	// a rotated key encrypts the new files, the old key still reads the old ones
+	option.Env = NewEncryptedEnv(base, NewStaticKeyProvider(map[uint32][]byte{1: key1, 2: key2}, 2))
+	if db, err = Open(*option); err != nil {
+		t.Fatal(err)
+	}
+	for i := test_num; i < 2*test_num; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("value%06d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2*test_num; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("%06d", i)))
+		if err != nil || string(value) != fmt.Sprintf("value%06d", i) {
+			t.Fatalf("Get %06d: %v", i, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
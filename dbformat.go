@@ -2,6 +2,7 @@ package goleveldb
 
 import (
 	"bytes"
+	"time"
 )
 
 const (
@@ -23,12 +24,28 @@ const (
 type ValueType uint8
 
 const (
-	KTypeDeletion ValueType = 0x0
-	KTypeValue    ValueType = 0x1
+	KTypeDeletion     ValueType = 0x0
+	KTypeValue        ValueType = 0x1
+	KTypeValueWithTTL ValueType = 0x2 // value prefixed by its expiry time
+	KTypeMerge        ValueType = 0x3 // operand for Options.MergeOperator
+
+	// KTypeRangeDeletion entries carry the start of a range tombstone as
+	// user key and its exclusive end as value.
+	KTypeRangeDeletion ValueType = 0x4
+
+	// KTypeSingleDeletion deletes a key written by exactly one Put.
+	KTypeSingleDeletion ValueType = 0x5
+
+	// KTypeBlobIndex entries carry an encoded blobIndex as value, pointing
+	// to the actual value in a blob file.
+	KTypeBlobIndex ValueType = 0x6
 )
 
 type SequenceNumber uint64
 
+// kMaxSequenceNumber leaves room for the value type in the 8-byte tag
+const kMaxSequenceNumber SequenceNumber = (1 << 56) - 1
+
 func Compare(a, b []byte) int {
 	return bytes.Compare(a, b)
 }
@@ -45,10 +62,11 @@ func UserKeyCompare(a, b UserKey) int {
 type InternalKey []byte
 
 func NewInternalKey(userKey []byte, s SequenceNumber, t ValueType) InternalKey {
-	p := make([]byte, 8)
-	EncodeFixed64(p, PackSequenceAndType(s, t))
-	userKey = append(userKey, p...)
-	return userKey
+	// copy, appending to userKey could overwrite the bytes following it
+	p := make([]byte, len(userKey)+8)
+	copy(p, userKey)
+	EncodeFixed64(p[len(userKey):], PackSequenceAndType(s, t))
+	return p
 }
 
 func InternalKeyCompare(a, b InternalKey) int {
@@ -185,6 +203,43 @@ func GetLengthPrefixedSlice(input []byte) ([]byte, uint32) {
 	return input[value_begin_offset:value_end_offset], offset + size
 }
 
+// TTLValue = ExpireAt + Value
+// | expire_at(8B unix nano) | value |
+func encodeTTLValue(expireAt time.Time, value []byte) []byte {
+	p := make([]byte, 8+len(value))
+	EncodeFixed64(p, uint64(expireAt.UnixNano()))
+	copy(p[8:], value)
+	return p
+}
+
+func decodeTTLValue(p []byte) (time.Time, []byte) {
+	return time.Unix(0, int64(DecodeFixed64(p))), p[8:]
+}
+
+// isHidden reports whether an entry of type t with raw value hides its key
+// from reads, that is whether it is a deletion or an expired value.
+func isHidden(t ValueType, value []byte) bool {
+	if t == KTypeDeletion || t == KTypeSingleDeletion {
+		return true
+	} else if t == KTypeValueWithTTL {
+		expire_at, _ := decodeTTLValue(value)
+		return !time.Now().Before(expire_at)
+	}
+	return false
+}
+
+// userValue returns the value seen by users for an entry of type t
+// whose raw value is stored in the memtable or sstable.
+// Return errKeyDeleted if the entry hides its key.
+func userValue(t ValueType, value []byte) ([]byte, error) {
+	if isHidden(t, value) {
+		return nil, errKeyDeleted
+	} else if t == KTypeValueWithTTL {
+		_, value = decodeTTLValue(value)
+	}
+	return value, nil
+}
+
 func FindShortestSeparator(a, b []byte) []byte {
 	a_len := len(a)
 	b_len := len(b)
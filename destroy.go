@@ -0,0 +1,57 @@
+package goleveldb
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// DestroyDB deletes the DB in option.DirPath. Only the files of the engine
+// are removed, and the directory itself once nothing else is left in it.
+// The files Repair archived to the lost subdirectory are kept.
+// The DB must not be open, ErrLocked is returned otherwise.
+func DestroyDB(option Options) error {
+	env := option.env()
+	dir := option.DirPath
+	names, err := env.GetChildren(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	lockPath := lockFileName(dir)
+	lock, err := env.LockFile(lockPath)
+	if err != nil {
+		return err
+	}
+	var result error
+	for _, name := range names {
+		if !ownedFile(name) || name == filepath.Base(lockPath) {
+			continue
+		}
+		// keep going, removing as much as possible
+		if err := env.RemoveFile(filepath.Join(dir, name)); err != nil && result == nil {
+			result = err
+		}
+	}
+	// removed while still locked, so that no DB opened meanwhile locks it
+	if err := env.RemoveFile(lockPath); err != nil && result == nil {
+		result = err
+	}
+	if err := lock.Unlock(); err != nil && result == nil {
+		result = err
+	}
+	// fails if other files are left, which is fine
+	env.RemoveDir(dir)
+	return result
+}
+
+// ownedFile reports whether name is a file the engine creates in the DB directory.
+func ownedFile(name string) bool {
+	switch name {
+	case "MANIFEST", "MANIFEST.tmp", "LOCK":
+		return true
+	}
+	_, ext, ok := parseFileName(name)
+	return ok && (ext == "ldb" || ext == "log" || ext == "blob")
+}
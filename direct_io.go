@@ -0,0 +1,168 @@
+package goleveldb
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// kDirectIOAlignment is the alignment of the buffers, offsets and lengths
+// of direct I/O, the logical block size of common devices.
+const kDirectIOAlignment = 4096
+
+// kDirectIOBufferSize is the size of the writes of a directWritableFile.
+const kDirectIOBufferSize = 1 * MB
+
+// kFadviseDontNeed is POSIX_FADV_DONTNEED.
+const kFadviseDontNeed = 4
+
+// alignedBuffer returns a buffer of n bytes starting at an aligned address.
+func alignedBuffer(n int) []byte {
+	buf := make([]byte, n+kDirectIOAlignment)
+	shift := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & (kDirectIOAlignment - 1)); rem != 0 {
+		shift = kDirectIOAlignment - rem
+	}
+	return buf[shift : shift+n : shift+n]
+}
+
+func alignUp(n int64) int64 {
+	return (n + kDirectIOAlignment - 1) &^ (kDirectIOAlignment - 1)
+}
+
+// openDirect opens name with O_DIRECT, or without it on file systems
+// not supporting direct I/O.
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, bool, error) {
+	file, err := os.OpenFile(name, flag|syscall.O_DIRECT, perm)
+	if err == nil {
+		return file, true, nil
+	}
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EINVAL {
+		file, err = os.OpenFile(name, flag, perm)
+		return file, false, err
+	}
+	return nil, false, err
+}
+
+func (linuxEnv) newDirectWritableFile(name string) (WritableFile, error) {
+	file, direct, err := openDirect(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if !direct {
+		return &LinuxFile{file: file}, nil
+	}
+	return &directWritableFile{file: file, buf: alignedBuffer(kDirectIOBufferSize)[:0]}, nil
+}
+
+func (linuxEnv) newDirectRandomAccessFile(name string) (RandomAccessFile, error) {
+	file, direct, err := openDirect(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !direct {
+		return &LinuxFile{file: file}, nil
+	}
+	return &directRandomAccessFile{file: file}, nil
+}
+
+var _ directIOEnv = linuxEnv{}
+
+// dropPageCache asks the operating system to drop the cached pages of the file.
+func (lf *LinuxFile) dropPageCache() error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, lf.file.Fd(), 0, 0, kFadviseDontNeed, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+var _ pageCacheFile = (*LinuxFile)(nil)
+
+// directWritableFile writes a file around the page cache. Data is written in
+// aligned blocks, the last one padded with zeros until the file is closed
+// and truncated to its size.
+type directWritableFile struct {
+	file   *os.File
+	buf    []byte // Data not written yet, or the partial last block
+	offset int64  // Offset of buf in the file, aligned
+}
+
+func (f *directWritableFile) Append(data string) error {
+	for len(data) > 0 {
+		n := copy(f.buf[len(f.buf):cap(f.buf)], data)
+		f.buf = f.buf[:len(f.buf)+n]
+		data = data[n:]
+		if len(f.buf) == cap(f.buf) {
+			if _, err := f.file.WriteAt(f.buf, f.offset); err != nil {
+				return err
+			}
+			f.offset += int64(len(f.buf))
+			f.buf = f.buf[:0]
+		}
+	}
+	return nil
+}
+
+// writeTail writes the buffered data, padded to whole blocks. The aligned
+// part leaves the buffer, the partial last block stays to be written again.
+func (f *directWritableFile) writeTail() error {
+	if len(f.buf) == 0 {
+		return nil
+	}
+	n := len(f.buf)
+	padded := f.buf[:alignUp(int64(n))]
+	for i := n; i < len(padded); i++ {
+		padded[i] = 0
+	}
+	if _, err := f.file.WriteAt(padded, f.offset); err != nil {
+		return err
+	}
+	// the file ends with the data, not with the padding
+	if err := f.file.Truncate(f.offset + int64(n)); err != nil {
+		return err
+	}
+	aligned := n &^ (kDirectIOAlignment - 1)
+	f.offset += int64(aligned)
+	f.buf = f.buf[:copy(f.buf, f.buf[aligned:n])]
+	return nil
+}
+
+func (f *directWritableFile) Sync() error {
+	if err := f.writeTail(); err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+func (f *directWritableFile) Close() error {
+	if err := f.writeTail(); err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
+
+// directRandomAccessFile reads a file around the page cache.
+type directRandomAccessFile struct {
+	file *os.File
+}
+
+// Read reads the aligned blocks holding the n bytes at offset.
+func (f *directRandomAccessFile) Read(offset uint64, n uint32) ([]byte, error) {
+	begin := int64(offset) &^ (kDirectIOAlignment - 1)
+	end := alignUp(int64(offset) + int64(n))
+	buf := alignedBuffer(int(end - begin))
+	read, err := f.file.ReadAt(buf, begin)
+	// the last block of the file is short
+	if err != nil && !(err == io.EOF && int64(read) >= int64(offset)+int64(n)-begin) {
+		return nil, err
+	}
+	skip := int64(offset) - begin
+	return buf[skip : skip+int64(n)], nil
+}
+
+func (f *directRandomAccessFile) Close() error {
+	return f.file.Close()
+}
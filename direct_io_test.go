@@ -0,0 +1,60 @@
+package goleveldb
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestDirectIOFile(t *testing.T) {
+	path := "/tmp/goleveldb-direct"
+	defer os.Remove(path)
+	var env linuxEnv
+	file, err := env.newDirectWritableFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// appends of every size, synced now and then in the middle of a block
+	var data []byte
+	for i := 0; i < 300; i++ {
+		chunk := make([]byte, rand.Intn(3*kDirectIOAlignment))
+		rand.Read(chunk)
+		if err := file.Append(string(chunk)); err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, chunk...)
+		if i%7 == 0 {
+			if err := file.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := env.GetFileSize(path); size != uint64(len(data)) {
+		t.Fatalf("Expect: %d, but get %d\n", len(data), size)
+	}
+
+	reader, err := env.newDirectRandomAccessFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	for i := 0; i < 1000; i++ {
+		offset := rand.Intn(len(data))
+		n := rand.Intn(len(data) - offset + 1)
+		buf, err := reader.Read(uint64(offset), uint32(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, data[offset:offset+n]) {
+			t.Fatalf("Read %d bytes at %d: wrong data\n", n, offset)
+		}
+	}
+	if _, err := reader.Read(uint64(len(data)-10), 20); err == nil {
+		t.Fatalf("Expect a read past the end to fail\n")
+	}
+}
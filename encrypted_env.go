@@ -0,0 +1,210 @@
+package goleveldb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+)
+
+// KeyProvider supplies the AES keys of an encrypted Env. A key is 16, 24 or
+// 32 bytes long, selecting AES-128, AES-192 or AES-256.
+type KeyProvider interface {
+	// CurrentKey returns the ID and the key new files are encrypted with.
+	CurrentKey() (uint32, []byte, error)
+
+	// Key returns the key with the ID id, or ErrEncryptionKeyNotFound.
+	Key(id uint32) ([]byte, error)
+}
+
+// staticKeyProvider holds a fixed set of keys.
+type staticKeyProvider struct {
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// NewStaticKeyProvider returns a KeyProvider holding keys by ID. New files are
+// encrypted with the key current, the others still decrypt older files, so
+// that keys can be rotated.
+func NewStaticKeyProvider(keys map[uint32][]byte, current uint32) KeyProvider {
+	return &staticKeyProvider{keys: keys, current: current}
+}
+
+func (kp *staticKeyProvider) CurrentKey() (uint32, []byte, error) {
+	key, err := kp.Key(kp.current)
+	return kp.current, key, err
+}
+
+func (kp *staticKeyProvider) Key(id uint32) ([]byte, error) {
+	key, ok := kp.keys[id]
+	if !ok {
+		return nil, ErrEncryptionKeyNotFound
+	}
+	return key, nil
+}
+
+// Every file of an encrypted Env starts with a header:
+//
+//	magic: fixed32
+//	key_id: fixed32
+//	iv: 16 bytes
+//
+// The rest of the file is encrypted with AES in CTR mode, by the key key_id
+// and from the counter iv, so that any part of it can be read alone.
+const (
+	kEncryptionMagic      uint32 = 0x6e456c47
+	kEncryptionHeaderSize        = 8 + aes.BlockSize
+)
+
+// encryptedEnv encrypts the files of the Env it wraps.
+type encryptedEnv struct {
+	Env
+	provider KeyProvider
+}
+
+// NewEncryptedEnv returns an Env encrypting all files written through base
+// with the keys of provider: tables, logs, blob files and the manifest.
+// Every file gets its own random IV. Files are not readable without their key,
+// nor through base.
+func NewEncryptedEnv(base Env, provider KeyProvider) Env {
+	return &encryptedEnv{Env: base, provider: provider}
+}
+
+func (env *encryptedEnv) NewWritableFile(name string) (WritableFile, error) {
+	id, key, err := env.provider.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, kEncryptionHeaderSize)
+	EncodeFixed32(header, kEncryptionMagic)
+	EncodeFixed32(header[4:], id)
+	iv := header[8:]
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	file, err := env.Env.NewWritableFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Append(string(header)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &encryptedWritableFile{file: file, stream: newCTRStream(block, iv, 0)}, nil
+}
+
+func (env *encryptedEnv) NewRandomAccessFile(name string) (RandomAccessFile, error) {
+	size, err := env.Env.GetFileSize(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := env.Env.NewRandomAccessFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if size < kEncryptionHeaderSize {
+		// cut by a crash before its header was synced, so nothing was written to it
+		return &encryptedRandomAccessFile{file: file}, nil
+	}
+	header, err := file.Read(0, kEncryptionHeaderSize)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if DecodeFixed32(header) != kEncryptionMagic {
+		file.Close()
+		return nil, ErrCorruption
+	}
+	key, err := env.provider.Key(DecodeFixed32(header[4:]))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &encryptedRandomAccessFile{file: file, block: block, iv: header[8:]}, nil
+}
+
+// GetFileSize returns the size of the content of the file name, without its header.
+func (env *encryptedEnv) GetFileSize(name string) (uint64, error) {
+	size, err := env.Env.GetFileSize(name)
+	if err != nil {
+		return 0, err
+	}
+	if size < kEncryptionHeaderSize {
+		return 0, nil
+	}
+	return size - kEncryptionHeaderSize, nil
+}
+
+// newCTRStream returns the key stream of block from the counter iv, advanced
+// to the byte offset.
+func newCTRStream(block cipher.Block, iv []byte, offset uint64) cipher.Stream {
+	// the counter is a big endian number
+	counter := make([]byte, aes.BlockSize)
+	copy(counter, iv)
+	carry := offset / aes.BlockSize
+	for i := aes.BlockSize - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(counter[i]) + carry&0xff
+		counter[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	stream := cipher.NewCTR(block, counter)
+	skip := make([]byte, offset%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+	return stream
+}
+
+type encryptedWritableFile struct {
+	file   WritableFile
+	stream cipher.Stream // Positioned at the end of the file
+}
+
+func (f *encryptedWritableFile) Append(data string) error {
+	buf := make([]byte, len(data))
+	f.stream.XORKeyStream(buf, []byte(data))
+	return f.file.Append(string(buf))
+}
+
+func (f *encryptedWritableFile) Close() error {
+	return f.file.Close()
+}
+
+func (f *encryptedWritableFile) Sync() error {
+	return f.file.Sync()
+}
+
+type encryptedRandomAccessFile struct {
+	file  RandomAccessFile
+	block cipher.Block // nil if the file is empty
+	iv    []byte
+}
+
+func (f *encryptedRandomAccessFile) Read(offset uint64, n uint32) ([]byte, error) {
+	if f.block == nil {
+		if n == 0 {
+			return []byte{}, nil
+		}
+		return nil, io.EOF
+	}
+	data, err := f.file.Read(offset+kEncryptionHeaderSize, n)
+	if err != nil {
+		return nil, err
+	}
+	// data may be shared with the file, it is left as it is
+	buf := make([]byte, len(data))
+	newCTRStream(f.block, f.iv, offset).XORKeyStream(buf, data)
+	return buf, nil
+}
+
+func (f *encryptedRandomAccessFile) Close() error {
+	return f.file.Close()
+}
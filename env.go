@@ -0,0 +1,201 @@
+package goleveldb
+
+import "path/filepath"
+
+// Env is the file system the DB keeps its files on. Options.Env selects it,
+// so that files can be kept in memory, encrypted, rate limited or counted.
+//
+// Errors about missing files must satisfy os.IsNotExist.
+type Env interface {
+	// NewWritableFile creates the file name, truncating it if it exists.
+	NewWritableFile(name string) (WritableFile, error)
+
+	// NewRandomAccessFile opens the existing file name for reading.
+	NewRandomAccessFile(name string) (RandomAccessFile, error)
+
+	// FileExists reports whether the file or directory name exists.
+	FileExists(name string) bool
+
+	// GetFileSize returns the size in bytes of the file name.
+	GetFileSize(name string) (uint64, error)
+
+	// GetChildren returns the names of the entries of the directory dir.
+	GetChildren(dir string) ([]string, error)
+
+	// RenameFile replaces target by the file src.
+	RenameFile(src, target string) error
+
+	// RemoveFile removes the file name.
+	RemoveFile(name string) error
+
+	// LinkFile makes target another name of the file src.
+	LinkFile(src, target string) error
+
+	// CreateDir creates the directory dir and its parents, if missing.
+	CreateDir(dir string) error
+
+	// RemoveDir removes the empty directory dir.
+	RemoveDir(dir string) error
+
+	// LockFile locks the file name, creating it if needed. It returns
+	// ErrLocked if the lock is already held.
+	LockFile(name string) (FileLock, error)
+}
+
+// FileLock is a lock acquired by Env.LockFile.
+type FileLock interface {
+	Unlock() error
+}
+
+// mmapEnv is implemented by the Envs whose files can be mapped into memory,
+// see Options.UseMmapReads.
+type mmapEnv interface {
+	// mmapFile maps the whole file name into memory, read-only.
+	// The mapping is released by calling unmap.
+	mmapFile(name string) (data []byte, unmap func() error, err error)
+}
+
+// directIOEnv is implemented by the Envs able to read and write files around
+// the page cache, see Options.UseDirectIOForCompaction.
+type directIOEnv interface {
+	newDirectWritableFile(name string) (WritableFile, error)
+	newDirectRandomAccessFile(name string) (RandomAccessFile, error)
+}
+
+// pageCacheFile is implemented by the files whose pages can be dropped from
+// the page cache, see Options.DropPageCacheAfterFlush.
+type pageCacheFile interface {
+	dropPageCache() error
+}
+
+// DefaultEnv keeps files in the file system of the operating system.
+var DefaultEnv Env = linuxEnv{}
+
+// env returns the Env of option, DefaultEnv if none is set.
+func (option *Options) env() Env {
+	if option.Env == nil {
+		return DefaultEnv
+	}
+	return option.Env
+}
+
+// createDirectFile creates name for writing around the page cache, if env can.
+func createDirectFile(env Env, name string) (WritableFile, error) {
+	if direct_env, ok := env.(directIOEnv); ok {
+		return direct_env.newDirectWritableFile(name)
+	}
+	return env.NewWritableFile(name)
+}
+
+// openDirectFile opens name for reading around the page cache, if env can.
+func openDirectFile(env Env, name string) (RandomAccessFile, error) {
+	if direct_env, ok := env.(directIOEnv); ok {
+		return direct_env.newDirectRandomAccessFile(name)
+	}
+	return env.NewRandomAccessFile(name)
+}
+
+// readFile returns the content of the file name.
+func readFile(env Env, name string) ([]byte, error) {
+	size, err := env.GetFileSize(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := env.NewRandomAccessFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if size == 0 {
+		return []byte{}, nil
+	}
+	return file.Read(0, uint32(size))
+}
+
+// writeFile replaces the content of the file name by data, synced.
+func writeFile(env Env, name string, data []byte) error {
+	file, err := env.NewWritableFile(name)
+	if err != nil {
+		return err
+	}
+	if err := file.Append(string(data)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// copyFile copies the file src of srcEnv to the file dst of dstEnv.
+func copyFile(srcEnv Env, src string, dstEnv Env, dst string) error {
+	size, err := srcEnv.GetFileSize(src)
+	if err != nil {
+		return err
+	}
+	return copyFilePrefix(srcEnv, src, size, dstEnv, dst)
+}
+
+// copyFilePrefix copies the first size bytes of the file src of srcEnv to the
+// file dst of dstEnv.
+func copyFilePrefix(srcEnv Env, src string, size uint64, dstEnv Env, dst string) error {
+	in, err := srcEnv.NewRandomAccessFile(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := dstEnv.NewWritableFile(dst)
+	if err != nil {
+		return err
+	}
+	// copied in pieces, tables may be large
+	const chunk = 1 * MB
+	for offset := uint64(0); offset < size; offset += chunk {
+		n := size - offset
+		if n > chunk {
+			n = chunk
+		}
+		data, err := in.Read(offset, uint32(n))
+		if err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Append(string(data)); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// linkFile links src to target, or copies it if src can not be linked there.
+func linkFile(env Env, src, target string) error {
+	if err := env.LinkFile(src, target); err == nil {
+		return nil
+	}
+	return copyFile(env, src, env, target)
+}
+
+// removeDir removes the directory dir along with the files in it.
+// A missing directory is not an error.
+func removeDir(env Env, dir string) error {
+	if !env.FileExists(dir) {
+		return nil
+	}
+	names, err := env.GetChildren(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := env.RemoveFile(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return env.RemoveDir(dir)
+}
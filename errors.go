@@ -7,4 +7,26 @@ var (
 	errKeyDeleted  = errors.New("key has been deleted")
 	ErrInvalidKey  = errors.New("key is invalid")
 	ErrByteCoding  = errors.New("coding exception")
+	ErrCorruption  = errors.New("corrupted data")
+
+	ErrUnsupportedFormat = errors.New("written in an unsupported format")
+
+	ErrNoMergeOperator = errors.New("no merge operator configured")
+
+	ErrColumnFamilyExists   = errors.New("column family already exists")
+	ErrColumnFamilyNotFound = errors.New("column family not found")
+
+	ErrTransactionConflict = errors.New("transaction conflicts with a newer write")
+	ErrLockTimeout         = errors.New("timed out waiting for a key lock")
+	ErrTransactionClosed   = errors.New("transaction already committed or rolled back")
+
+	ErrReadOnly        = errors.New("db is opened read-only")
+	ErrManifestChanged = errors.New("manifest kept changing while the db was recovered")
+	ErrLocked          = errors.New("db is locked by another process")
+
+	ErrBackupNotFound = errors.New("backup not found")
+
+	ErrInjectedFault = errors.New("fault injected by FaultInjectionEnv")
+
+	ErrEncryptionKeyNotFound = errors.New("encryption key not found")
 )
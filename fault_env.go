@@ -0,0 +1,339 @@
+package goleveldb
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// FaultInjectionEnv wraps an Env to test how the DB copes with failing I/O
+// and with crashes. Writes, syncs and reads can be made to fail after a
+// number of them succeeded, and PowerLoss simulates a machine crash.
+type FaultInjectionEnv struct {
+	base Env
+
+	// mu is held for reading by every operation, and for writing by
+	// PowerLoss, so that no operation outlives the crash.
+	mu    sync.RWMutex
+	dead  bool                  // Set by PowerLoss, every operation fails from then on
+	files map[string]*faultFile // Files written through the Env, by name
+	locks []FileLock            // Locks taken through the Env
+
+	writes, syncs, reads             int64 // Operations since the fault was set, accessed atomically
+	failWrites, failSyncs, failReads int64 // Operations allowed before failing, -1 if unlimited
+}
+
+// faultFile is the state of a file written through a FaultInjectionEnv.
+type faultFile struct {
+	mu     sync.Mutex
+	synced uint64 // Bytes of the file surviving a power loss
+}
+
+// NewFaultInjectionEnv returns an Env doing its I/O through base, injecting no fault yet.
+func NewFaultInjectionEnv(base Env) *FaultInjectionEnv {
+	var env FaultInjectionEnv
+	env.base = base
+	env.files = make(map[string]*faultFile)
+	env.ClearFaults()
+	return &env
+}
+
+// FailWritesAfter lets n more appends to files succeed, and fails the later ones.
+func (env *FaultInjectionEnv) FailWritesAfter(n int) {
+	atomic.StoreInt64(&env.writes, 0)
+	atomic.StoreInt64(&env.failWrites, int64(n))
+}
+
+// FailSyncsAfter lets n more syncs of files succeed, and fails the later ones.
+func (env *FaultInjectionEnv) FailSyncsAfter(n int) {
+	atomic.StoreInt64(&env.syncs, 0)
+	atomic.StoreInt64(&env.failSyncs, int64(n))
+}
+
+// FailReadsAfter lets n more reads of files succeed, and fails the later ones.
+func (env *FaultInjectionEnv) FailReadsAfter(n int) {
+	atomic.StoreInt64(&env.reads, 0)
+	atomic.StoreInt64(&env.failReads, int64(n))
+}
+
+// ClearFaults lets all operations succeed again.
+func (env *FaultInjectionEnv) ClearFaults() {
+	atomic.StoreInt64(&env.failWrites, -1)
+	atomic.StoreInt64(&env.failSyncs, -1)
+	atomic.StoreInt64(&env.failReads, -1)
+}
+
+// inject counts an operation and reports whether it must fail.
+func inject(count, limit *int64) bool {
+	n := atomic.AddInt64(count, 1)
+	max := atomic.LoadInt64(limit)
+	return max >= 0 && n > max
+}
+
+// PowerLoss simulates a machine crash: the data not synced yet is dropped
+// from every file written through env, and the locks taken through it are
+// released. Every later operation on env fails with ErrInjectedFault, as
+// the process using it is gone. The DB is then opened again with a new
+// FaultInjectionEnv on the same base Env.
+func (env *FaultInjectionEnv) PowerLoss() error {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.dead = true
+	for name, file := range env.files {
+		if !env.base.FileExists(name) {
+			continue
+		}
+		data, err := readFile(env.base, name)
+		if err != nil {
+			return err
+		}
+		if uint64(len(data)) <= file.synced {
+			continue
+		}
+		// a new file, so that open handles can not write to it
+		tmp := name + ".powerloss"
+		if err := writeFile(env.base, tmp, data[:file.synced]); err != nil {
+			return err
+		}
+		if err := env.base.RenameFile(tmp, name); err != nil {
+			return err
+		}
+	}
+	for _, lock := range env.locks {
+		if err := lock.Unlock(); err != nil {
+			return err
+		}
+	}
+	env.locks = nil
+	return nil
+}
+
+// CorruptBytes inverts n bytes of the file name from offset on, or up to its end.
+// The corruption survives a power loss.
+func (env *FaultInjectionEnv) CorruptBytes(name string, offset uint64, n int) error {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	data, err := readFile(env.base, name)
+	if err != nil {
+		return err
+	}
+	for i := offset; i < offset+uint64(n) && i < uint64(len(data)); i++ {
+		data[i] ^= 0xff
+	}
+	if err := writeFile(env.base, name, data); err != nil {
+		return err
+	}
+	if file, ok := env.files[name]; ok {
+		file.synced = uint64(len(data))
+	}
+	return nil
+}
+
+func (env *FaultInjectionEnv) NewWritableFile(name string) (WritableFile, error) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	if env.dead {
+		return nil, ErrInjectedFault
+	}
+	base, err := env.base.NewWritableFile(name)
+	if err != nil {
+		return nil, err
+	}
+	file := &faultFile{}
+	env.files[name] = file
+	return &faultWritableFile{env: env, base: base, file: file}, nil
+}
+
+func (env *FaultInjectionEnv) NewRandomAccessFile(name string) (RandomAccessFile, error) {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	if env.dead {
+		return nil, ErrInjectedFault
+	}
+	base, err := env.base.NewRandomAccessFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultRandomAccessFile{env: env, base: base}, nil
+}
+
+func (env *FaultInjectionEnv) FileExists(name string) bool {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	return !env.dead && env.base.FileExists(name)
+}
+
+func (env *FaultInjectionEnv) GetFileSize(name string) (uint64, error) {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	if env.dead {
+		return 0, ErrInjectedFault
+	}
+	return env.base.GetFileSize(name)
+}
+
+func (env *FaultInjectionEnv) GetChildren(dir string) ([]string, error) {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	if env.dead {
+		return nil, ErrInjectedFault
+	}
+	return env.base.GetChildren(dir)
+}
+
+func (env *FaultInjectionEnv) RenameFile(src, target string) error {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	if env.dead {
+		return ErrInjectedFault
+	}
+	if err := env.base.RenameFile(src, target); err != nil {
+		return err
+	}
+	// a renamed directory takes its files along
+	for name, file := range env.files {
+		if name == src {
+			delete(env.files, name)
+			env.files[target] = file
+		} else if strings.HasPrefix(name, src+"/") {
+			delete(env.files, name)
+			env.files[target+strings.TrimPrefix(name, src)] = file
+		}
+	}
+	return nil
+}
+
+func (env *FaultInjectionEnv) RemoveFile(name string) error {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	if env.dead {
+		return ErrInjectedFault
+	}
+	if err := env.base.RemoveFile(name); err != nil {
+		return err
+	}
+	delete(env.files, name)
+	return nil
+}
+
+func (env *FaultInjectionEnv) LinkFile(src, target string) error {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	if env.dead {
+		return ErrInjectedFault
+	}
+	return env.base.LinkFile(src, target)
+}
+
+func (env *FaultInjectionEnv) CreateDir(dir string) error {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	if env.dead {
+		return ErrInjectedFault
+	}
+	return env.base.CreateDir(dir)
+}
+
+func (env *FaultInjectionEnv) RemoveDir(dir string) error {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	if env.dead {
+		return ErrInjectedFault
+	}
+	return env.base.RemoveDir(dir)
+}
+
+func (env *FaultInjectionEnv) LockFile(name string) (FileLock, error) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	if env.dead {
+		return nil, ErrInjectedFault
+	}
+	lock, err := env.base.LockFile(name)
+	if err != nil {
+		return nil, err
+	}
+	env.locks = append(env.locks, lock)
+	return &faultFileLock{env: env, base: lock}, nil
+}
+
+var _ Env = (*FaultInjectionEnv)(nil)
+
+type faultWritableFile struct {
+	env  *FaultInjectionEnv
+	base WritableFile
+	file *faultFile
+
+	size uint64 // Bytes appended so far
+}
+
+func (f *faultWritableFile) Append(data string) error {
+	f.env.mu.RLock()
+	defer f.env.mu.RUnlock()
+	if f.env.dead || inject(&f.env.writes, &f.env.failWrites) {
+		return ErrInjectedFault
+	}
+	if err := f.base.Append(data); err != nil {
+		return err
+	}
+	f.size += uint64(len(data))
+	return nil
+}
+
+func (f *faultWritableFile) Close() error {
+	return f.base.Close()
+}
+
+func (f *faultWritableFile) Sync() error {
+	f.env.mu.RLock()
+	defer f.env.mu.RUnlock()
+	if f.env.dead || inject(&f.env.syncs, &f.env.failSyncs) {
+		return ErrInjectedFault
+	}
+	if err := f.base.Sync(); err != nil {
+		return err
+	}
+	f.file.mu.Lock()
+	f.file.synced = f.size
+	f.file.mu.Unlock()
+	return nil
+}
+
+type faultRandomAccessFile struct {
+	env  *FaultInjectionEnv
+	base RandomAccessFile
+}
+
+func (f *faultRandomAccessFile) Read(offset uint64, n uint32) ([]byte, error) {
+	f.env.mu.RLock()
+	defer f.env.mu.RUnlock()
+	if f.env.dead || inject(&f.env.reads, &f.env.failReads) {
+		return nil, ErrInjectedFault
+	}
+	return f.base.Read(offset, n)
+}
+
+func (f *faultRandomAccessFile) Close() error {
+	return f.base.Close()
+}
+
+type faultFileLock struct {
+	env  *FaultInjectionEnv
+	base FileLock
+}
+
+func (fl *faultFileLock) Unlock() error {
+	fl.env.mu.Lock()
+	defer fl.env.mu.Unlock()
+	if fl.env.dead {
+		// released by PowerLoss
+		return nil
+	}
+	for i, lock := range fl.env.locks {
+		if lock == fl.base {
+			fl.env.locks = append(fl.env.locks[:i], fl.env.locks[i+1:]...)
+			break
+		}
+	}
+	return fl.base.Unlock()
+}
@@ -0,0 +1,139 @@
+package goleveldb
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+const kDeletedValue = "<deleted>"
+
+// checkAcknowledged checks that db holds the acknowledged value of every key,
+// or the value of the write that failed last. The values found are then
+// the acknowledged ones.
+func checkAcknowledged(t *testing.T, db *DB, acked map[string]string, failed_key, failed_value string) {
+	t.Helper()
+	for key, want := range acked {
+		value, err := db.Get([]byte(key))
+		got := string(value)
+		if err == ErrKeyNotFound {
+			got = kDeletedValue
+		} else if err != nil {
+			t.Fatalf("Get %s: %v", key, err)
+		}
+		if got != want && !(key == failed_key && got == failed_value) {
+			t.Fatalf("Get %s: expect %s, but get %s\n", key, want, got)
+		}
+		acked[key] = got
+	}
+	if _, ok := acked[failed_key]; !ok && failed_key != "" {
+		// a key never written before
+		if value, err := db.Get([]byte(failed_key)); err == nil {
+			acked[failed_key] = string(value)
+		}
+	}
+}
+
+func TestFaultInjectionEnv_CrashRecovery(t *testing.T) {
+	seed := time.Now().UnixNano()
+	rnd := rand.New(rand.NewSource(seed))
+	t.Logf("seed %d", seed)
+
+	base := NewMemEnv()
+	option := DefaultOptions()
+	option.DirPath = "/tmp/goleveldb-mydb"
+	option.Sync = true
+	option.MemTableSize = 1024 * 16
+	option.CompactionInterval = 10
+
+	acked := make(map[string]string)
+	var failed_key, failed_value string
+	for round := 0; round < 30; round++ {
+		env := NewFaultInjectionEnv(base)
+		option.Env = env
+		db, err := Open(*option)
+		if err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+		checkAcknowledged(t, db, acked, failed_key, failed_value)
+		failed_key, failed_value = "", ""
+
+		switch rnd.Intn(3) {
+		case 0:
+			env.FailWritesAfter(rnd.Intn(2000))
+		case 1:
+			env.FailSyncsAfter(rnd.Intn(1000))
+		case 2:
+			env.FailReadsAfter(rnd.Intn(100))
+		}
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("%04d", rnd.Intn(500))
+			value := fmt.Sprintf("value%d_%d", round, i)
+			if rnd.Intn(10) == 0 {
+				value = kDeletedValue
+				err = db.Delete([]byte(key))
+			} else {
+				err = db.Put([]byte(key), []byte(value))
+			}
+			if err != nil {
+				failed_key, failed_value = key, value
+				break
+			}
+			acked[key] = value
+		}
+
+		if err := env.PowerLoss(); err != nil {
+			t.Fatal(err)
+		}
+		// stops the workers, nothing reaches the files any more
+		db.Close()
+	}
+
+	option.Env = NewFaultInjectionEnv(base)
+	db, err := Open(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkAcknowledged(t, db, acked, failed_key, failed_value)
+}
+
+func TestFaultInjectionEnv_CorruptManifest(t *testing.T) {
+	env := NewFaultInjectionEnv(NewMemEnv())
+	option := DefaultOptions()
+	option.DirPath = "/tmp/goleveldb-mydb"
+	option.Env = env
+	option.MemTableSize = 1024 * 64
+
+	db, err := Open(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_num := 5000
+	for i := 0; i < test_num; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("value%06d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := env.CorruptBytes(manifestFileName(option.DirPath), 8, 64); err != nil {
+		t.Fatal(err)
+	}
+	if err := Repair(*option); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(*option); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < test_num; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("%06d", i)))
+		if err != nil || string(value) != fmt.Sprintf("value%06d", i) {
+			t.Fatalf("Get %06d: %v", i, err)
+		}
+	}
+}
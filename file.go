@@ -2,6 +2,7 @@ package goleveldb
 
 import (
 	"os"
+	"syscall"
 )
 
 type WritableFile interface {
@@ -67,3 +68,128 @@ func (lf *LinuxFile) Size() int64 {
 func RemoveFile(path string) error {
 	return os.Remove(path)
 }
+
+// LinuxFileLock is an exclusive advisory lock on a file, held until Unlock.
+type LinuxFileLock struct {
+	file *os.File
+}
+
+// LockFile locks fileName, creating it if needed. It returns ErrLocked if
+// the lock is held elsewhere, by this process or another one.
+func LockFile(fileName string) (*LinuxFileLock, error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return &LinuxFileLock{file: file}, nil
+}
+
+func (fl *LinuxFileLock) Unlock() error {
+	if err := syscall.Flock(int(fl.file.Fd()), syscall.LOCK_UN); err != nil {
+		fl.file.Close()
+		return err
+	}
+	return fl.file.Close()
+}
+
+var _ FileLock = (*LinuxFileLock)(nil)
+
+// linuxEnv is the Env of the operating system.
+type linuxEnv struct{}
+
+func (linuxEnv) NewWritableFile(name string) (WritableFile, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &LinuxFile{file: file}, nil
+}
+
+func (linuxEnv) NewRandomAccessFile(name string) (RandomAccessFile, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &LinuxFile{file: file}, nil
+}
+
+func (linuxEnv) FileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func (linuxEnv) GetFileSize(name string) (uint64, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(info.Size()), nil
+}
+
+func (linuxEnv) GetChildren(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names, nil
+}
+
+func (linuxEnv) RenameFile(src, target string) error {
+	return os.Rename(src, target)
+}
+
+func (linuxEnv) RemoveFile(name string) error {
+	return os.Remove(name)
+}
+
+func (linuxEnv) LinkFile(src, target string) error {
+	return os.Link(src, target)
+}
+
+func (linuxEnv) CreateDir(dir string) error {
+	return os.MkdirAll(dir, 0755)
+}
+
+func (linuxEnv) RemoveDir(dir string) error {
+	return os.Remove(dir)
+}
+
+func (linuxEnv) LockFile(name string) (FileLock, error) {
+	lock, err := LockFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+func (linuxEnv) mmapFile(name string) ([]byte, func() error, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the mapping outlives the file descriptor
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
+
+var _ Env = linuxEnv{}
+var _ mmapEnv = linuxEnv{}
@@ -1,11 +1,19 @@
 package goleveldb
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 func sstableFileName(dbpath string, number uint64) string {
 	return fmt.Sprintf("%s/%06d.ldb", dbpath, number)
 }
 
+func lockFileName(dbpath string) string {
+	return fmt.Sprintf("%s/LOCK", dbpath)
+}
+
 func manifestFileName(dbpath string) string {
 	return fmt.Sprintf("%s/MANIFEST", dbpath)
 }
@@ -13,3 +21,21 @@ func manifestFileName(dbpath string) string {
 func walFileName(dbpath string, number uint64) string {
 	return fmt.Sprintf("%s/%06d.log", dbpath, number)
 }
+
+func blobFileName(dbpath string, number uint64) string {
+	return fmt.Sprintf("%s/%06d.blob", dbpath, number)
+}
+
+// parseFileName returns the number and the extension of a numbered file
+// of the DB directory.
+func parseFileName(name string) (uint64, string, bool) {
+	base, ext, ok := strings.Cut(name, ".")
+	if !ok {
+		return 0, "", false
+	}
+	number, err := strconv.ParseUint(base, 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return number, ext, true
+}
@@ -29,16 +29,19 @@ func (iter *sortedLevelIterator) Valid() bool {
 }
 
 func (iter *sortedLevelIterator) SeekToFirst() {
+	iter.pos = 0
 	if iter.pos >= uint32(len(iter.list)) {
 		return
 	}
 	iter.list[0].SeekToFirst()
+	iter.skipExhaustedIterators()
 }
 
 func (iter *sortedLevelIterator) Seek(target interface{}) {
+	iter.pos = uint32(len(iter.list))
 	for i := 0; i < len(iter.list); i++ {
 		iter.list[i].Seek(target)
-		if InternalKeyCompare(iter.list[i].Key(), target.(InternalKey)) >= 0 {
+		if iter.list[i].Valid() && InternalKeyCompare(iter.list[i].Key(), target.(InternalKey)) >= 0 {
 			iter.pos = uint32(i)
 			break
 		}
@@ -46,12 +49,17 @@ func (iter *sortedLevelIterator) Seek(target interface{}) {
 }
 
 func (iter *sortedLevelIterator) Next() {
-	level_num := uint32(len(iter.list))
-	if iter.pos >= level_num {
+	if iter.pos >= uint32(len(iter.list)) {
 		return
-	} else if iter.list[iter.pos].Valid() {
-		iter.list[iter.pos].Next()
-	} else {
+	}
+	iter.list[iter.pos].Next()
+	iter.skipExhaustedIterators()
+}
+
+// move on to the next iterator once the current one is exhausted
+func (iter *sortedLevelIterator) skipExhaustedIterators() {
+	level_num := uint32(len(iter.list))
+	for iter.pos < level_num && !iter.list[iter.pos].Valid() {
 		iter.pos++
 		if iter.pos < level_num {
 			iter.list[iter.pos].SeekToFirst()
@@ -139,31 +147,37 @@ var _ Iterator = (*mergeIterator)(nil)
 
 // Responsible for remove the deleted or duplicated item in iterator
 type deduplicationIterator struct {
-	input                Iterator
-	prev_userkey         UserKey
-	prev_userkey_deleted bool
+	input      Iterator
+	operator   MergeOperator
+	tombstones rangeTombstones
+	blobs      *blobCache     // Resolves values stored in blob files
+	snapshot   SequenceNumber // Versions newer than snapshot are skipped
+
+	// current visible entry, resolved from all versions of its user key
+	key   []byte
+	value []byte
+	valid bool
+	err   error // Error that ended the iteration
 }
 
-func newDeduplicationIterator(input Iterator) *deduplicationIterator {
+func newDeduplicationIterator(input Iterator, operator MergeOperator, tombstones rangeTombstones, blobs *blobCache) *deduplicationIterator {
 	var iter deduplicationIterator
 	iter.input = input
-	iter.prev_userkey = []byte("")
-	iter.prev_userkey_deleted = false
+	iter.operator = operator
+	iter.tombstones = tombstones
+	iter.blobs = blobs
+	iter.snapshot = kMaxSequenceNumber
 	return &iter
 }
 
 func (iter *deduplicationIterator) Valid() bool {
-	return iter.input.Valid()
+	return iter.valid
 }
 
 func (iter *deduplicationIterator) SeekToFirst() {
+	iter.err = nil
 	iter.input.SeekToFirst()
-	key := InternalKey(iter.Key())
-	iter.prev_userkey = key.ExtractUserKey()
-	iter.prev_userkey_deleted = key.ExtractValueType() == KTypeDeletion
-	if iter.prev_userkey_deleted {
-		iter.nextExist()
-	}
+	iter.nextExist()
 }
 
 func (iter *deduplicationIterator) Next() {
@@ -172,35 +186,107 @@ func (iter *deduplicationIterator) Next() {
 	}
 }
 
-// find next exist entry
+// find next exist entry, starting at the newest version of a user key.
+// Deleted and expired entries hide older versions as well, merge operands
+// are combined with the older versions, and versions covered by a range
+// tombstone count as deleted. An error reading a key, such as a failed merge
+// or blob read, ends the iteration and is kept in iter.err.
 func (iter *deduplicationIterator) nextExist() {
-	var key InternalKey
-	iter.input.Next()
-	for iter.Valid() {
-		key = iter.input.Key()
-		if UserKeyCompare(key.ExtractUserKey(), iter.prev_userkey) == 0 {
+	iter.valid = false
+	for iter.input.Valid() {
+		key := InternalKey(iter.input.Key())
+		if key.ExtractSequenceNumber() > iter.snapshot {
+			// written after the snapshot
 			iter.input.Next()
-		} else {
-			iter.prev_userkey = key.ExtractUserKey()
-			iter.prev_userkey_deleted = key.ExtractValueType() == KTypeDeletion
-			if !iter.prev_userkey_deleted {
+			continue
+		}
+		user_key := key.ExtractUserKey()
+		ctx := newMergeContext(iter.operator, user_key)
+		ctx.blobs = iter.blobs
+		ctx.tombstone = iter.tombstones.maxCoveringSeq(user_key, iter.snapshot)
+		done, value, err := ctx.add(key, iter.input.Value())
+		iter.input.Next()
+		for ; iter.input.Valid(); iter.input.Next() {
+			k := InternalKey(iter.input.Key())
+			if UserKeyCompare(k.ExtractUserKey(), user_key) != 0 {
 				break
 			}
-			iter.input.Next()
+			if !done {
+				done, value, err = ctx.add(k, iter.input.Value())
+			}
+		}
+		if !done {
+			value, err = ctx.finish()
+		}
+		if err == nil {
+			iter.key = key
+			iter.value = value
+			iter.valid = true
+			return
+		} else if err != errKeyDeleted && err != ErrKeyNotFound {
+			iter.err = err
+			return
 		}
 	}
 }
 
 func (iter *deduplicationIterator) Seek(target interface{}) {
+	iter.err = nil
 	iter.input.Seek(target)
+	iter.nextExist()
 }
 
 func (iter *deduplicationIterator) Key() []byte {
-	return iter.input.Key()
+	return iter.key
 }
 
 func (iter *deduplicationIterator) Value() []byte {
-	return iter.input.Value()
+	return iter.value
 }
 
 var _ Iterator = (*deduplicationIterator)(nil)
+
+// DBIterator iterates over a column family as of the moment it was created.
+// Key returns the internal key of an entry. An error reading an entry ends
+// the iteration, see Err.
+//
+// A DBIterator must be closed once done with: until then the blob files it
+// may read are not deleted by DB.GarbageCollectBlobs.
+type DBIterator struct {
+	Iterator
+	db    *DB
+	snap  *snapshot
+	dedup *deduplicationIterator
+}
+
+// newDBIterator returns an iterator over cfd as of snap, positioned at the
+// first key not less than key. snap is released when the iterator is closed.
+func (db *DB) newDBIterator(cfd *columnFamilyData, key []byte, snap *snapshot) (*DBIterator, error) {
+	dedup, err := db.scan(cfd, key, snap)
+	if err != nil {
+		db.releaseSnapshot(snap)
+		return nil, err
+	}
+	var user Iterator = dedup
+	if db.option.UseMmapReads {
+		// the keys and values handed out outlive the mapped tables
+		user = &copyingIterator{dedup}
+	}
+	return &DBIterator{Iterator: user, db: db, snap: snap, dedup: dedup}, nil
+}
+
+// Err returns the error that ended the iteration, or nil if the iterator
+// is valid or all entries were read.
+func (iter *DBIterator) Err() error {
+	return iter.dedup.err
+}
+
+// Close releases the files pinned by the iterator, which must not be used
+// afterwards. Closing an iterator again has no effect.
+func (iter *DBIterator) Close() error {
+	if iter.snap != nil {
+		iter.db.releaseSnapshot(iter.snap)
+		iter.snap = nil
+	}
+	return nil
+}
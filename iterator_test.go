@@ -111,7 +111,7 @@ func Test_deduplication(t *testing.T) {
 		key := NewInternalKey([]byte(fmt.Sprintf("%06dtest", i)), SequenceNumber(i), KTypeValue)
 		data = append(data, key)
 	}
-	iter := newDeduplicationIterator(newOutputIterator(data))
+	iter := newDeduplicationIterator(newOutputIterator(data), nil, nil, nil)
 
 	i := 0
 	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
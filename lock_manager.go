@@ -0,0 +1,74 @@
+package goleveldb
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// lockManager hands out exclusive key locks to pessimistic transactions.
+// A transaction waiting longer than its lock timeout gives up, which also
+// breaks deadlocks between transactions waiting for each other.
+type lockManager struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	owner    uint64        // Transaction id
+	released chan struct{} // Closed on unlock
+}
+
+func newLockManager() *lockManager {
+	var lm lockManager
+	lm.locks = make(map[string]*keyLock)
+	return &lm
+}
+
+// lockKey identifies key of a column family in the lock table.
+func lockKey(family uint32, key []byte) string {
+	buf := make([]byte, 4, 4+len(key))
+	binary.LittleEndian.PutUint32(buf, family)
+	return string(append(buf, key...))
+}
+
+// lock acquires the lock of k for owner, waiting at most timeout if another
+// transaction holds it. Locking a key again from its owner succeeds at once.
+func (lm *lockManager) lock(owner uint64, k string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		lm.mu.Lock()
+		l, ok := lm.locks[k]
+		if !ok {
+			lm.locks[k] = &keyLock{owner: owner, released: make(chan struct{})}
+			lm.mu.Unlock()
+			return nil
+		}
+		lm.mu.Unlock()
+		if l.owner == owner {
+			return nil
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return ErrLockTimeout
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-l.released:
+			timer.Stop()
+		case <-timer.C:
+			return ErrLockTimeout
+		}
+	}
+}
+
+// unlock releases the lock of k if owner holds it.
+func (lm *lockManager) unlock(owner uint64, k string) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if l, ok := lm.locks[k]; ok && l.owner == owner {
+		delete(lm.locks, k)
+		close(l.released)
+	}
+}
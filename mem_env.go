@@ -0,0 +1,285 @@
+package goleveldb
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// MemEnv is an Env keeping all files in memory, for tests.
+//
+// Data appended to a file is durable once the file is synced. Crash simulates
+// a machine crash by dropping the data appended since the last Sync of every
+// file. Creating, renaming and removing files and directories is durable at once.
+type MemEnv struct {
+	mu    sync.Mutex
+	files map[string]*memFile // By cleaned path
+	dirs  map[string]bool
+	locks map[string]*memFileLock
+}
+
+// memFile is the content of a file, shared by its names and open handles.
+type memFile struct {
+	mu     sync.RWMutex
+	data   []byte
+	synced int // Length of the data that survives a crash
+}
+
+// NewMemEnv returns an empty MemEnv. Its root directory exists.
+func NewMemEnv() *MemEnv {
+	var env MemEnv
+	env.files = make(map[string]*memFile)
+	env.dirs = map[string]bool{"/": true, ".": true}
+	env.locks = make(map[string]*memFileLock)
+	return &env
+}
+
+// Crash drops the data not synced yet from every file, and releases all locks.
+func (env *MemEnv) Crash() {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	for _, file := range env.files {
+		file.mu.Lock()
+		file.data = file.data[:file.synced]
+		file.mu.Unlock()
+	}
+	env.locks = make(map[string]*memFileLock)
+}
+
+func (env *MemEnv) NewWritableFile(name string) (WritableFile, error) {
+	name = filepath.Clean(name)
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	if !env.dirs[filepath.Dir(name)] {
+		return nil, notExistError("open", name)
+	}
+	file := &memFile{}
+	env.files[name] = file
+	return &memWritableFile{file: file}, nil
+}
+
+func (env *MemEnv) NewRandomAccessFile(name string) (RandomAccessFile, error) {
+	name = filepath.Clean(name)
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	file, ok := env.files[name]
+	if !ok {
+		return nil, notExistError("open", name)
+	}
+	return &memRandomAccessFile{file: file}, nil
+}
+
+func (env *MemEnv) FileExists(name string) bool {
+	name = filepath.Clean(name)
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	_, ok := env.files[name]
+	return ok || env.dirs[name]
+}
+
+func (env *MemEnv) GetFileSize(name string) (uint64, error) {
+	name = filepath.Clean(name)
+	env.mu.Lock()
+	file, ok := env.files[name]
+	env.mu.Unlock()
+	if !ok {
+		return 0, notExistError("stat", name)
+	}
+	file.mu.RLock()
+	defer file.mu.RUnlock()
+	return uint64(len(file.data)), nil
+}
+
+func (env *MemEnv) GetChildren(dir string) ([]string, error) {
+	dir = filepath.Clean(dir)
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	if !env.dirs[dir] {
+		return nil, notExistError("open", dir)
+	}
+	var names []string
+	for name := range env.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	for name := range env.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	return names, nil
+}
+
+func (env *MemEnv) RenameFile(src, target string) error {
+	src, target = filepath.Clean(src), filepath.Clean(target)
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	if file, ok := env.files[src]; ok {
+		if !env.dirs[filepath.Dir(target)] {
+			return notExistError("rename", target)
+		}
+		delete(env.files, src)
+		env.files[target] = file
+		return nil
+	}
+	if !env.dirs[src] {
+		return notExistError("rename", src)
+	}
+	// a directory takes its files along
+	prefix := src + "/"
+	for name, file := range env.files {
+		if strings.HasPrefix(name, prefix) {
+			delete(env.files, name)
+			env.files[target+"/"+strings.TrimPrefix(name, prefix)] = file
+		}
+	}
+	for name := range env.dirs {
+		if name == src || strings.HasPrefix(name, prefix) {
+			delete(env.dirs, name)
+			env.dirs[target+strings.TrimPrefix(name, src)] = true
+		}
+	}
+	return nil
+}
+
+func (env *MemEnv) RemoveFile(name string) error {
+	name = filepath.Clean(name)
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	if _, ok := env.files[name]; !ok {
+		return notExistError("remove", name)
+	}
+	// open handles keep reading the content
+	delete(env.files, name)
+	return nil
+}
+
+func (env *MemEnv) LinkFile(src, target string) error {
+	src, target = filepath.Clean(src), filepath.Clean(target)
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	file, ok := env.files[src]
+	if !ok {
+		return notExistError("link", src)
+	}
+	if _, ok := env.files[target]; ok {
+		return &os.LinkError{Op: "link", Old: src, New: target, Err: os.ErrExist}
+	}
+	env.files[target] = file
+	return nil
+}
+
+func (env *MemEnv) CreateDir(dir string) error {
+	dir = filepath.Clean(dir)
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	for ; !env.dirs[dir]; dir = filepath.Dir(dir) {
+		env.dirs[dir] = true
+	}
+	return nil
+}
+
+func (env *MemEnv) RemoveDir(dir string) error {
+	dir = filepath.Clean(dir)
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	if !env.dirs[dir] {
+		return notExistError("remove", dir)
+	}
+	for name := range env.files {
+		if filepath.Dir(name) == dir {
+			return &os.PathError{Op: "remove", Path: dir, Err: os.ErrExist}
+		}
+	}
+	for name := range env.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			return &os.PathError{Op: "remove", Path: dir, Err: os.ErrExist}
+		}
+	}
+	delete(env.dirs, dir)
+	return nil
+}
+
+func (env *MemEnv) LockFile(name string) (FileLock, error) {
+	name = filepath.Clean(name)
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	if !env.dirs[filepath.Dir(name)] {
+		return nil, notExistError("open", name)
+	}
+	if env.locks[name] != nil {
+		return nil, ErrLocked
+	}
+	if _, ok := env.files[name]; !ok {
+		env.files[name] = &memFile{}
+	}
+	lock := &memFileLock{env: env, name: name}
+	env.locks[name] = lock
+	return lock, nil
+}
+
+var _ Env = (*MemEnv)(nil)
+
+func notExistError(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+type memWritableFile struct {
+	file *memFile
+}
+
+func (f *memWritableFile) Append(data string) error {
+	f.file.mu.Lock()
+	defer f.file.mu.Unlock()
+	f.file.data = append(f.file.data, data...)
+	return nil
+}
+
+func (f *memWritableFile) Close() error {
+	return nil
+}
+
+func (f *memWritableFile) Sync() error {
+	f.file.mu.Lock()
+	defer f.file.mu.Unlock()
+	f.file.synced = len(f.file.data)
+	return nil
+}
+
+type memRandomAccessFile struct {
+	file *memFile
+}
+
+// Read fails with io.EOF if fewer than n bytes are left, like LinuxFile.Read.
+func (f *memRandomAccessFile) Read(offset uint64, n uint32) ([]byte, error) {
+	f.file.mu.RLock()
+	defer f.file.mu.RUnlock()
+	if offset+uint64(n) > uint64(len(f.file.data)) {
+		return nil, io.EOF
+	}
+	buf := make([]byte, n)
+	copy(buf, f.file.data[offset:])
+	return buf, nil
+}
+
+func (f *memRandomAccessFile) Close() error {
+	return nil
+}
+
+type memFileLock struct {
+	env  *MemEnv
+	name string
+}
+
+func (fl *memFileLock) Unlock() error {
+	fl.env.mu.Lock()
+	defer fl.env.mu.Unlock()
+	// the lock may have been dropped by a crash, and taken again
+	if fl.env.locks[fl.name] == fl {
+		delete(fl.env.locks, fl.name)
+	}
+	return nil
+}
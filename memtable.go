@@ -6,7 +6,23 @@ type memTable struct {
 	table       *SkipList
 	memoryUsage uint64
 	logPath     string
+	logNumber   uint64
 	mu          sync.Mutex
+
+	// tableNumber is reserved when the memtable becomes immutable, so
+	// level-0 file numbers follow memtable age even with parallel flushes.
+	tableNumber uint64
+
+	// flushed is the level-0 table written from this memtable. It is set by a
+	// flush worker and installed into the version once all older memtables
+	// have been installed too.
+	flushed *fileMetaData
+
+	// family is the column family the memtable belongs to
+	family *columnFamilyData
+
+	// tombstones are the range deletions written to this memtable, guarded by mu
+	tombstones rangeTombstones
 }
 
 func newMemTable(logPath string) *memTable {
@@ -18,6 +34,11 @@ func newMemTable(logPath string) *memTable {
 }
 
 func (mem *memTable) add(seq SequenceNumber, valueType ValueType, key, value []byte) {
+	if valueType == KTypeRangeDeletion {
+		mem.addRangeTombstone(seq, key, value)
+		return
+	}
+
 	// construct internal key
 	internal_key := NewInternalKey(key, seq, valueType)
 	// insert into memiplist
@@ -30,23 +51,25 @@ func (mem *memTable) add(seq SequenceNumber, valueType ValueType, key, value []b
 }
 
 // Return value, status
-// status = ErrKeyNotFound means key not in memtable
+// status = ErrKeyNotFound means key not in memtable, or only merge operands added to ctx
 // status = errKeyDeleted  means key was been deleted
 // status = nil            menas find key and return value
-func (mem *memTable) get(key InternalKey) ([]byte, error) {
-	iter := mem.table.NewIterator()
-	iter.Seek(key)
-	if iter.Valid() {
-		lookuped_key := InternalKey(iter.Key())
-		if UserKeyCompare(lookuped_key.ExtractUserKey(), key.ExtractUserKey()) == 0 {
-			if lookuped_key.ExtractValueType() == KTypeDeletion {
-				return nil, errKeyDeleted
-			} else {
-				return iter.Value(), nil
-			}
-		}
-	}
-	return nil, ErrKeyNotFound
+func (mem *memTable) get(key InternalKey, ctx *mergeContext) ([]byte, error) {
+	tombstone := mem.rangeTombstones().maxCoveringSeq(key.ExtractUserKey(), key.ExtractSequenceNumber())
+	return ctx.lookup(mem.table.NewIterator(), key, tombstone)
+}
+
+func (mem *memTable) addRangeTombstone(seq SequenceNumber, start, end []byte) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	mem.tombstones = append(mem.tombstones, rangeTombstone{start: start, end: end, seq: seq})
+	mem.memoryUsage += uint64(len(start) + len(end) + 8)
+}
+
+func (mem *memTable) rangeTombstones() rangeTombstones {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	return mem.tombstones[:len(mem.tombstones):len(mem.tombstones)]
 }
 
 func (mem *memTable) approximateMemoryUsage() uint64 {
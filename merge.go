@@ -0,0 +1,181 @@
+package goleveldb
+
+import "time"
+
+// MergeOperator lets applications update a value without reading it first.
+// DB.Merge records an operand, and the operands of a key are combined with
+// its older value when the key is read or compacted.
+type MergeOperator interface {
+	// FullMerge applies operands, oldest first, to existingValue.
+	// existingValue is nil if the key has no value below the operands.
+	FullMerge(key, existingValue []byte, operands [][]byte) ([]byte, error)
+
+	// PartialMerge combines two operands, leftOperand being the older one,
+	// into a single operand. It returns false if they can not be combined
+	// without the value below them.
+	PartialMerge(key, leftOperand, rightOperand []byte) ([]byte, bool)
+}
+
+// mergeContext collects the merge operands of a key while its versions
+// are visited from the newest to the oldest.
+type mergeContext struct {
+	operator MergeOperator
+	key      UserKey
+	operands [][]byte      // newest first
+	keys     []InternalKey // internal key of each operand
+
+	// tombstone is the highest sequence number of the range tombstones met
+	// so far covering key. Older versions count as deleted.
+	tombstone SequenceNumber
+
+	// latest is the sequence number of the newest version visited, range
+	// tombstones included. Relocated blob values count as of their write.
+	latest SequenceNumber
+
+	// blobs resolves values stored in blob files. If nil, the encoded
+	// blob index is returned as the value.
+	blobs *blobCache
+	// found is the type of the version the value was read from.
+	found ValueType
+	// expireAt is the expiry time of the base value, zero if it has none.
+	expireAt time.Time
+}
+
+func newMergeContext(operator MergeOperator, key UserKey) *mergeContext {
+	var ctx mergeContext
+	ctx.operator = operator
+	ctx.key = key
+	return &ctx
+}
+
+// add visits the next older version of the key.
+// It returns done once the value of the key is known, along with the value,
+// or errKeyDeleted if the key does not exist.
+func (ctx *mergeContext) add(key InternalKey, value []byte) (bool, []byte, error) {
+	if seq := writtenSequence(key, value); seq > ctx.latest {
+		ctx.latest = seq
+	}
+	t := key.ExtractValueType()
+	if key.ExtractSequenceNumber() < ctx.tombstone {
+		t = KTypeDeletion
+	}
+	if t == KTypeMerge {
+		ctx.operands = append(ctx.operands, value)
+		ctx.keys = append(ctx.keys, key)
+		return false, nil, nil
+	}
+	ctx.found = t
+	if t == KTypeBlobIndex && ctx.blobs != nil {
+		var err error
+		if value, err = ctx.blobs.get(value); err != nil {
+			return true, nil, err
+		}
+		t = KTypeValue
+	}
+	existing, err := userValue(t, value)
+	if len(ctx.operands) == 0 {
+		return true, existing, err
+	}
+	if err == errKeyDeleted {
+		existing = nil
+	} else if t == KTypeValueWithTTL {
+		ctx.expireAt, _ = decodeTTLValue(value)
+	}
+	value, err = ctx.fullMerge(existing)
+	return true, value, err
+}
+
+// lookup visits the versions of key in one source, which iter reads and
+// whose range tombstones cover key up to sequence number tombstone.
+// It returns ErrKeyNotFound if older sources need to be searched.
+func (ctx *mergeContext) lookup(iter Iterator, key InternalKey, tombstone SequenceNumber) ([]byte, error) {
+	if tombstone > ctx.tombstone {
+		ctx.tombstone = tombstone
+	}
+	if tombstone > ctx.latest {
+		ctx.latest = tombstone
+	}
+	for iter.Seek(key); iter.Valid(); iter.Next() {
+		k := InternalKey(iter.Key())
+		if UserKeyCompare(k.ExtractUserKey(), key.ExtractUserKey()) != 0 {
+			break
+		}
+		if k.ExtractSequenceNumber() > key.ExtractSequenceNumber() {
+			// written after the snapshot read at
+			continue
+		}
+		if done, value, err := ctx.add(k, iter.Value()); done {
+			return value, err
+		}
+	}
+	if ctx.tombstone > 0 {
+		// older sources only hold versions below the tombstone
+		return ctx.finish()
+	}
+	return nil, ErrKeyNotFound
+}
+
+// finish returns the value of a key whose versions were all visited
+// without finding a value or deletion below the operands.
+func (ctx *mergeContext) finish() ([]byte, error) {
+	if ctx.tombstone > 0 {
+		_, value, err := ctx.add(NewInternalKey(ctx.key, 0, KTypeDeletion), nil)
+		return value, err
+	}
+	if len(ctx.operands) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	return ctx.fullMerge(nil)
+}
+
+// mergedEntry returns the entry replacing the operands merged into value.
+// It takes the place of the newest operand, and expires with the base value.
+func (ctx *mergeContext) mergedEntry(value []byte) (InternalKey, []byte) {
+	seq := ctx.keys[0].ExtractSequenceNumber()
+	if !ctx.expireAt.IsZero() {
+		return NewInternalKey(ctx.key, seq, KTypeValueWithTTL), encodeTTLValue(ctx.expireAt, value)
+	}
+	return NewInternalKey(ctx.key, seq, KTypeValue), value
+}
+
+func (ctx *mergeContext) fullMerge(existing []byte) ([]byte, error) {
+	if ctx.operator == nil {
+		return nil, ErrNoMergeOperator
+	}
+	operands := make([][]byte, len(ctx.operands))
+	for i := 0; i < len(ctx.operands); i++ {
+		operands[len(operands)-1-i] = ctx.operands[i]
+	}
+	return ctx.operator.FullMerge(ctx.key, existing, operands)
+}
+
+// partialMerge combines adjacent operands where the operator allows it.
+// It returns the remaining operands and their keys, newest first.
+func (ctx *mergeContext) partialMerge() ([]InternalKey, [][]byte) {
+	if ctx.operator == nil || len(ctx.operands) < 2 {
+		return ctx.keys, ctx.operands
+	}
+	var keys []InternalKey
+	var operands [][]byte
+	last := len(ctx.operands) - 1
+	acc_key, acc := ctx.keys[last], ctx.operands[last]
+	for i := last - 1; i >= 0; i-- {
+		if merged, ok := ctx.operator.PartialMerge(ctx.key, acc, ctx.operands[i]); ok {
+			// the combined operand takes the place of the newer one
+			acc_key, acc = ctx.keys[i], merged
+			continue
+		}
+		keys = append(keys, acc_key)
+		operands = append(operands, acc)
+		acc_key, acc = ctx.keys[i], ctx.operands[i]
+	}
+	keys = append(keys, acc_key)
+	operands = append(operands, acc)
+
+	// collected oldest first
+	for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+		keys[i], keys[j] = keys[j], keys[i]
+		operands[i], operands[j] = operands[j], operands[i]
+	}
+	return keys, operands
+}
@@ -1,9 +1,34 @@
 package goleveldb
 
+import "math"
+
+// CompactionStyle selects how sstables are merged in the background.
+type CompactionStyle uint8
+
+const (
+	// CompactionStyleLevel keeps one sorted run per level and merges
+	// a level into the next one when it grows too large.
+	CompactionStyleLevel CompactionStyle = iota
+
+	// CompactionStyleUniversal keeps a list of sorted runs ordered by age
+	// and merges adjacent runs of similar size. It writes less than the
+	// leveled style at the cost of more space and read amplification.
+	CompactionStyleUniversal
+
+	// CompactionStyleFIFO never merges sstables. Level-0 files are
+	// deleted oldest first once they take too much space or are too old.
+	// It suits data that can be thrown away, like metrics caches.
+	CompactionStyleFIFO
+)
+
 type Options struct {
 	// DirPath specifies the directory path where all the database files will be stored.
 	DirPath string
 
+	// Env is the file system all the database files are read from and written to.
+	// Default value is DefaultEnv, the file system of the operating system.
+	Env Env
+
 	// Sync is whether to synchronize writes through os buffer cache and down onto the actual disk.
 	// Setting sync is required for durability of a single write operation, but also results in slower writes.
 	//
@@ -35,6 +60,38 @@ type Options struct {
 	// Default value is 2GB / MaxFileSize
 	MaxOpenFiles uint32
 
+	// UseMmapReads maps sstables into memory instead of reading them into the heap,
+	// which spares the garbage collector and makes large tables faster to open.
+	// A table is unmapped once it is evicted from the cache and no iterator refers to it;
+	// the keys and values returned by Get and Scan are copied out of the mapping.
+	// Only the files of DefaultEnv can be mapped, other Envs read tables into the heap.
+	// Default value is false
+	UseMmapReads bool
+
+	// UseDirectIOForCompaction reads the inputs and writes the outputs of compactions with O_DIRECT,
+	// so that compactions do not evict the data of foreground reads from the page cache.
+	// Input tables not in the table cache are read without being added to it.
+	// File systems without direct I/O, and Envs other than DefaultEnv, use buffered I/O instead.
+	// Default value is false
+	UseDirectIOForCompaction bool
+
+	// DropPageCacheAfterFlush drops the pages of the sstables written by flushes
+	// from the page cache once they are synced, with posix_fadvise(POSIX_FADV_DONTNEED).
+	// The outputs of compactions keep their pages, see UseDirectIOForCompaction instead.
+	// Default value is false
+	DropPageCacheAfterFlush bool
+
+	// RateLimiter, if set, throttles the bytes written to sstables and blob files by flushes,
+	// compactions and blob garbage collection, and the bytes of the tables compactions read
+	// if it limits reads. Flushes are served first.
+	// Default value is nil
+	RateLimiter *RateLimiter
+
+	// Statistics, if set, collects counters and latency histograms of the DB.
+	// It may be shared by several DBs. Collecting costs a little time on every read and write.
+	// Default value is nil
+	Statistics *Statistics
+
 	// CompactionInterval indicates the time interval for periodic comparison in the background.
 	// Unit is MilliSecond. Default value is 1000ms
 	CompactionInterval uint32
@@ -43,6 +100,75 @@ type Options struct {
 	// This parameter can be changed dynamically.  Most clients should leave this parameter alone.
 	// Default value if 16
 	BlockRestartInterval uint32
+
+	// MaxBackgroundFlushes is the number of background workers flushing immutable memtables to level 0.
+	// It also bounds how many immutable memtables may wait for a flush before writes are stalled.
+	// Default value is 1
+	MaxBackgroundFlushes uint32
+
+	// MaxBackgroundCompactions is the number of background workers compacting sstables.
+	// Compactions running at the same time never share input files.
+	// Default value is 1
+	MaxBackgroundCompactions uint32
+
+	// CompactionStyle is the compaction strategy used by background workers.
+	// Default value is CompactionStyleLevel
+	CompactionStyle CompactionStyle
+
+	// UniversalSizeRatio is the percentage flexibility used by universal compaction when comparing run sizes.
+	// A sorted run joins a merge if the runs picked so far, enlarged by this percentage, are at least as large as it.
+	// Default value is 1
+	UniversalSizeRatio uint32
+
+	// UniversalMinMergeWidth is the minimum number of sorted runs merged by one universal compaction.
+	// Default value is 2
+	UniversalMinMergeWidth uint32
+
+	// UniversalMaxMergeWidth is the maximum number of sorted runs merged by one universal compaction.
+	// It is exceeded only to merge all level-0 runs together, or to reach a free output level.
+	// Default value is math.MaxUint32
+	UniversalMaxMergeWidth uint32
+
+	// FIFOMaxTableFilesSize is the total size in bytes of sstables kept by FIFO compaction.
+	// When exceeded, the oldest files are deleted.
+	// Default value is 1GB
+	FIFOMaxTableFilesSize uint64
+
+	// TTL is the age after which FIFO compaction deletes an sstable.
+	// Unit is Second. Default value is 0, which keeps files regardless of age.
+	TTL uint32
+
+	// CompactionFilter, if set, is called by compactions to drop or rewrite records.
+	// The same filter is used by concurrent compactions, so it must be safe for concurrent use.
+	// Default value is nil
+	CompactionFilter CompactionFilter
+
+	// CompactionFilterFactory, if set, creates a new CompactionFilter for each compaction.
+	// It takes precedence over CompactionFilter.
+	// Default value is nil
+	CompactionFilterFactory CompactionFilterFactory
+
+	// MergeOperator combines the operands written by DB.Merge with the value
+	// of their key. It is required by DB.Merge.
+	// Default value is nil
+	MergeOperator MergeOperator
+
+	// MinBlobSize is the size in bytes from which values are stored in blob files
+	// when their memtable is flushed, sstables keeping a small pointer to them instead.
+	// Compactions then move the pointers but no longer rewrite the values.
+	// The space of overwritten and deleted values is reclaimed by DB.GarbageCollectBlobs.
+	// Default value is 0, which keeps all values in the sstables.
+	MinBlobSize uint32
+
+	// BlobGCRatio is the fraction of garbage from which DB.GarbageCollectBlobs
+	// rewrites a blob file.
+	// Default value is 0.5
+	BlobGCRatio float64
+
+	// ColumnFamilyOptions are the options Open recovers column families with, by name.
+	// Column families not listed use these Options.
+	// Default value is nil
+	ColumnFamilyOptions map[string]Options
 }
 
 const (
@@ -57,14 +183,34 @@ const (
 func DefaultOptions() *Options {
 	var option Options
 	option.DirPath = "/goleveldb_tempdb"
+	option.Env = DefaultEnv
 	option.Sync = false
 
 	option.MemTableSize = 64 * MB
 	option.BlockSize = 4 * KB
 	option.MaxFileSize = 128 * MB
 	option.MaxOpenFiles = 2 * GB / option.MaxFileSize
+	option.UseMmapReads = false
+	option.UseDirectIOForCompaction = false
+	option.DropPageCacheAfterFlush = false
+	option.RateLimiter = nil
+	option.Statistics = nil
 
 	option.CompactionInterval = 1000
 	option.BlockRestartInterval = 16
+
+	option.MaxBackgroundFlushes = 1
+	option.MaxBackgroundCompactions = 1
+
+	option.CompactionStyle = CompactionStyleLevel
+	option.UniversalSizeRatio = 1
+	option.UniversalMinMergeWidth = 2
+	option.UniversalMaxMergeWidth = math.MaxUint32
+
+	option.FIFOMaxTableFilesSize = 1 * GB
+	option.TTL = 0
+
+	option.MinBlobSize = 0
+	option.BlobGCRatio = 0.5
 	return &option
 }
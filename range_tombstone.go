@@ -0,0 +1,98 @@
+package goleveldb
+
+const (
+	// kRangeDelBlockName is the metaindex entry of the range tombstone block.
+	kRangeDelBlockName = "goleveldb.rangedel"
+)
+
+// rangeTombstone deletes every entry of a user key in [start, end)
+// whose sequence number is lower than seq.
+type rangeTombstone struct {
+	start UserKey
+	end   UserKey // exclusive
+	seq   SequenceNumber
+}
+
+func (t *rangeTombstone) covers(key UserKey) bool {
+	return UserKeyCompare(t.start, key) <= 0 && UserKeyCompare(key, t.end) < 0
+}
+
+// smallestKey is the first internal key of t within a table.
+func (t *rangeTombstone) smallestKey() InternalKey {
+	return NewInternalKey(t.start, t.seq, KTypeRangeDeletion)
+}
+
+// largestKey bounds t within a table. The end is exclusive, so the key
+// sorts before every entry of the end key.
+func (t *rangeTombstone) largestKey() InternalKey {
+	return NewInternalKey(t.end, kMaxSequenceNumber, KTypeRangeDeletion)
+}
+
+// clip returns the part of t within [lower, upper), a nil bound being unbounded.
+func (t *rangeTombstone) clip(lower, upper UserKey) (rangeTombstone, bool) {
+	clipped := *t
+	if lower != nil && UserKeyCompare(clipped.start, lower) < 0 {
+		clipped.start = lower
+	}
+	if upper != nil && UserKeyCompare(clipped.end, upper) > 0 {
+		clipped.end = upper
+	}
+	return clipped, UserKeyCompare(clipped.start, clipped.end) < 0
+}
+
+type rangeTombstones []rangeTombstone
+
+// maxCoveringSeq returns the highest sequence number of the tombstones
+// visible at snapshot that cover key, or 0 if there are none.
+func (ts rangeTombstones) maxCoveringSeq(key UserKey, snapshot SequenceNumber) SequenceNumber {
+	var seq SequenceNumber = 0
+	for i := 0; i < len(ts); i++ {
+		if ts[i].seq <= snapshot && ts[i].seq > seq && ts[i].covers(key) {
+			seq = ts[i].seq
+		}
+	}
+	return seq
+}
+
+// coversRange reports whether one tombstone newer than seq and visible at
+// snapshot covers all user keys from smallest to largest.
+func (ts rangeTombstones) coversRange(smallest, largest UserKey, seq, snapshot SequenceNumber) bool {
+	for i := 0; i < len(ts); i++ {
+		if ts[i].seq > seq && ts[i].seq <= snapshot && ts[i].covers(smallest) && ts[i].covers(largest) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ts rangeTombstones) encodeTo(blockRestartInterval uint32) []byte {
+	builder := newBlockBuilder(blockRestartInterval)
+	for i := 0; i < len(ts); i++ {
+		builder.add(ts[i].smallestKey(), ts[i].end)
+	}
+	return builder.finish()
+}
+
+func decodeRangeTombstones(buf []byte) rangeTombstones {
+	var ts rangeTombstones
+	iter := newBlockIterator(newBlock(buf))
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		key := InternalKey(iter.Key())
+		ts = append(ts, rangeTombstone{
+			start: key.ExtractUserKey(),
+			end:   iter.Value(),
+			seq:   key.ExtractSequenceNumber(),
+		})
+	}
+	return ts
+}
+
+// extendRange widens the key range of meta to include t.
+func (meta *fileMetaData) extendRange(t *rangeTombstone) {
+	if smallest := t.smallestKey(); meta.smallest == nil || InternalKeyCompare(smallest, meta.smallest) < 0 {
+		meta.smallest = smallest
+	}
+	if largest := t.largestKey(); meta.largest == nil || InternalKeyCompare(largest, meta.largest) > 0 {
+		meta.largest = largest
+	}
+}
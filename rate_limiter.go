@@ -0,0 +1,125 @@
+package goleveldb
+
+import (
+	"sync"
+	"time"
+)
+
+// IOPriority orders the requests of background jobs to a RateLimiter.
+type IOPriority uint8
+
+const (
+	// IOPriorityLow is the priority of compactions.
+	IOPriorityLow IOPriority = iota
+
+	// IOPriorityHigh is the priority of flushes. They are served before
+	// compactions, as writes stall while memtables wait for a flush.
+	IOPriorityHigh
+
+	kNumIOPriorities
+)
+
+// kRateLimiterRefillPeriod is how often a RateLimiter refills its tokens.
+// It also bounds the bursts, a period's worth of bytes.
+const kRateLimiterRefillPeriod = 100 * time.Millisecond
+
+// RateLimiter is a token bucket throttling the bytes flushes and compactions
+// write, and optionally read, to a rate. A RateLimiter may be shared by
+// several DBs to bound their total I/O.
+type RateLimiter struct {
+	mu             sync.Mutex
+	bytesPerSecond int64
+	limitReads     bool
+	available      int64     // Tokens left in the current period
+	lastRefill     time.Time // Start of the current period
+	waiting        [kNumIOPriorities]int
+	total          int64 // Bytes requested so far
+}
+
+// NewRateLimiter returns a RateLimiter granting bytesPerSecond bytes per
+// second, or any number of bytes if bytesPerSecond is zero or less. If
+// limitReads is set, compactions are throttled on the tables they read too.
+func NewRateLimiter(bytesPerSecond int64, limitReads bool) *RateLimiter {
+	rl := &RateLimiter{bytesPerSecond: bytesPerSecond, limitReads: limitReads, lastRefill: time.Now()}
+	rl.available = rl.refillBytes()
+	return rl
+}
+
+// SetBytesPerSecond changes the rate, from the next refill on. A rate of
+// zero or less disables the throttling.
+func (rl *RateLimiter) SetBytesPerSecond(bytesPerSecond int64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.bytesPerSecond = bytesPerSecond
+}
+
+// BytesPerSecond returns the rate.
+func (rl *RateLimiter) BytesPerSecond() int64 {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.bytesPerSecond
+}
+
+// TotalBytesThrough returns the bytes requested since the RateLimiter was created.
+func (rl *RateLimiter) TotalBytesThrough() int64 {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.total
+}
+
+// Request blocks until bytes may be read or written. A request with low
+// priority waits as long as one with high priority does.
+func (rl *RateLimiter) Request(bytes int64, priority IOPriority) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.waiting[priority]++
+	defer func() { rl.waiting[priority]-- }()
+	rl.total += bytes
+
+	for bytes > 0 {
+		if rl.bytesPerSecond <= 0 {
+			// unlimited, also for requests waiting when the limit was lifted
+			return
+		}
+		rl.refill()
+		if rl.available > 0 && (priority == IOPriorityHigh || rl.waiting[IOPriorityHigh] == 0) {
+			// large requests are granted over several periods
+			granted := bytes
+			if granted > rl.available {
+				granted = rl.available
+			}
+			rl.available -= granted
+			bytes -= granted
+			continue
+		}
+		// waits for the next period, the tokens of this one being gone
+		// or left to requests with high priority
+		wait := time.Until(rl.lastRefill.Add(kRateLimiterRefillPeriod))
+		if wait < time.Millisecond {
+			wait = time.Millisecond
+		}
+		rl.mu.Unlock()
+		time.Sleep(wait)
+		rl.mu.Lock()
+	}
+}
+
+// refill starts a new period with fresh tokens once the current one is over.
+// REQUIRES: rl.mu held.
+func (rl *RateLimiter) refill() {
+	now := time.Now()
+	if now.Sub(rl.lastRefill) < kRateLimiterRefillPeriod {
+		return
+	}
+	rl.lastRefill = now
+	rl.available = rl.refillBytes()
+}
+
+// refillBytes returns the tokens of a period.
+func (rl *RateLimiter) refillBytes() int64 {
+	n := rl.bytesPerSecond * int64(kRateLimiterRefillPeriod) / int64(time.Second)
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
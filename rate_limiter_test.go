@@ -0,0 +1,64 @@
+package goleveldb
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := NewRateLimiter(1*MB, false)
+	begin := time.Now()
+	for i := 0; i < 10; i++ {
+		rl.Request(50*KB, IOPriorityLow)
+	}
+	// 500KB at 1MB/s, less the first period's burst
+	if elapsed := time.Since(begin); elapsed < 350*time.Millisecond {
+		t.Fatalf("Expect 500KB to take about 500ms, but take %v\n", elapsed)
+	}
+	if rl.TotalBytesThrough() != 500*KB {
+		t.Fatalf("Expect: %d, but get %d\n", 500*KB, rl.TotalBytesThrough())
+	}
+
+	// a higher rate takes effect at once
+	rl.SetBytesPerSecond(100 * MB)
+	begin = time.Now()
+	rl.Request(5*MB, IOPriorityLow)
+	if elapsed := time.Since(begin); elapsed > 200*time.Millisecond {
+		t.Fatalf("Expect 5MB to take about 50ms, but take %v\n", elapsed)
+	}
+
+	// and a rate of zero lifts the limit
+	rl.SetBytesPerSecond(0)
+	begin = time.Now()
+	rl.Request(1024*MB, IOPriorityLow)
+	if elapsed := time.Since(begin); elapsed > 100*time.Millisecond {
+		t.Fatalf("Expect 1GB to go through at once, but take %v\n", elapsed)
+	}
+}
+
+func TestRateLimiter_Priority(t *testing.T) {
+	rl := NewRateLimiter(1*MB, false)
+	rl.Request(100*KB, IOPriorityHigh) // uses up the first period
+
+	// the flushes are granted before the compaction, though they came later
+	var mu sync.Mutex
+	var order []IOPriority
+	var wg sync.WaitGroup
+	request := func(priority IOPriority) {
+		defer wg.Done()
+		rl.Request(100*KB, priority)
+		mu.Lock()
+		order = append(order, priority)
+		mu.Unlock()
+	}
+	wg.Add(3)
+	go request(IOPriorityLow)
+	time.Sleep(10 * time.Millisecond)
+	go request(IOPriorityHigh)
+	go request(IOPriorityHigh)
+	wg.Wait()
+	if order[2] != IOPriorityLow {
+		t.Fatalf("Expect the compaction to be served last, but get %v\n", order)
+	}
+}
@@ -0,0 +1,252 @@
+package goleveldb
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const kLostDirName = "lost"
+
+// Repair rebuilds the DB in option.DirPath when its manifest is lost or
+// damaged. Logs are converted to tables, every table is scanned for its key
+// range and highest sequence number and placed in level 0, and a new
+// manifest is written. Files that can not be read, the converted logs and
+// the old manifest are moved to the lost subdirectory.
+//
+// Tables do not record their column family, so the data of all tables is
+// recovered into the default column family. The records of the logs do, but
+// the names of the column families are only kept in the manifest: records of
+// column families other than the default one are recovered into column
+// families called lost-<id>. The DB must not be open while it is repaired.
+func Repair(option Options) error {
+	var db DB
+	var err error
+	db.option = option
+	env := option.env()
+	if db.fileLock, err = env.LockFile(lockFileName(option.DirPath)); err != nil {
+		return err
+	}
+	defer db.fileLock.Unlock()
+	if db.cache, err = newTableCache(&db.option); err != nil {
+		return err
+	}
+	db.blobs = newBlobCache(env, option.DirPath)
+	defer db.blobs.close()
+	db.families = make(map[uint32]*columnFamilyData)
+	db.defaultFamily = db.newColumnFamilyData(kDefaultColumnFamilyID, DefaultColumnFamilyName, db.option)
+	db.families[kDefaultColumnFamilyID] = db.defaultFamily
+	db.nextFamilyID = kDefaultColumnFamilyID + 1
+	cfd := db.defaultFamily
+
+	// sort the files out, marking their numbers as used
+	names, err := env.GetChildren(option.DirPath)
+	if err != nil {
+		return err
+	}
+	var tables, logs []uint64
+	for _, name := range names {
+		number, ext, ok := parseFileName(name)
+		if !ok {
+			continue
+		}
+		cfd.current.markFileNumberUsed(number)
+		switch ext {
+		case "ldb":
+			tables = append(tables, number)
+		case "log":
+			logs = append(logs, number)
+		case "blob":
+			cfd.blobFiles = append(cfd.blobFiles, number)
+		}
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i] < tables[j] })
+	sort.Slice(logs, func(i, j int) bool { return logs[i] < logs[j] })
+
+	// convert the logs to tables of the column families of their records
+	family_tables := map[uint32][]uint64{kDefaultColumnFamilyID: tables}
+	for _, number := range logs {
+		converted, err := db.convertLogToTables(number)
+		if err == nil {
+			for id, table := range converted {
+				family_tables[id] = append(family_tables[id], table)
+			}
+		}
+		if err := db.archiveFile(walFileName(option.DirPath, number)); err != nil {
+			return err
+		}
+	}
+
+	for id := uint32(0); id < db.nextFamilyID; id++ {
+		if family, ok := db.families[id]; ok {
+			if err := db.addRepairedTables(family, family_tables[id]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if env.FileExists(manifestFileName(option.DirPath)) {
+		if err := db.archiveFile(manifestFileName(option.DirPath)); err != nil {
+			return err
+		}
+	}
+	db.currentLogFileNumber = db.newFileNumber()
+	return db.saveManifestFile()
+}
+
+// addRepairedTables scans the tables numbers and places them in level 0 of
+// cfd. Level-0 files are searched from the highest number down, so the tables
+// are renumbered in the order of their highest sequence number: the newest
+// updates of a key are found first.
+func (db *DB) addRepairedTables(cfd *columnFamilyData, numbers []uint64) error {
+	type repairedTable struct {
+		meta *fileMetaData
+		seq  SequenceNumber
+	}
+	env := db.option.env()
+	var repaired []repairedTable
+	for _, number := range numbers {
+		meta, seq, err := db.scanTable(number)
+		if err != nil {
+			if err := db.archiveFile(sstableFileName(db.option.DirPath, number)); err != nil {
+				return err
+			}
+			continue
+		}
+		if meta.smallest == nil {
+			// nothing in it
+			if err := env.RemoveFile(sstableFileName(db.option.DirPath, number)); err != nil {
+				return err
+			}
+			continue
+		}
+		repaired = append(repaired, repairedTable{meta: meta, seq: seq})
+	}
+	sort.SliceStable(repaired, func(i, j int) bool {
+		return repaired[i].seq < repaired[j].seq
+	})
+
+	for _, table := range repaired {
+		number := db.newFileNumber()
+		if err := env.RenameFile(sstableFileName(db.option.DirPath, table.meta.number), sstableFileName(db.option.DirPath, number)); err != nil {
+			return err
+		}
+		table.meta.number = number
+		cfd.current.addFile(0, table.meta)
+		// sequence numbers are allocated from the default column family
+		if table.seq > db.defaultFamily.current.lastSequence {
+			db.defaultFamily.current.lastSequence = table.seq
+		}
+	}
+	return nil
+}
+
+// repairedFamily returns the column family id, which is created under the
+// name lost-<id> if it is not known.
+func (db *DB) repairedFamily(id uint32) *columnFamilyData {
+	if cfd, ok := db.families[id]; ok {
+		return cfd
+	}
+	name := fmt.Sprintf("%s-%d", kLostDirName, id)
+	cfd := db.newColumnFamilyData(id, name, db.familyOptions(name))
+	db.families[id] = cfd
+	if id >= db.nextFamilyID {
+		db.nextFamilyID = id + 1
+	}
+	return cfd
+}
+
+// convertLogToTables writes the records of the log number to a new table for
+// each column family, and returns the table numbers by column family id.
+// Records are read up to the first damaged one.
+func (db *DB) convertLogToTables(number uint64) (map[uint32]uint64, error) {
+	file, err := db.option.env().NewRandomAccessFile(walFileName(db.option.DirPath, number))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	mems := make(map[uint32]*memTable)
+	err = replayLog(file, func(seq SequenceNumber, batch *WriteBatch) {
+		for i := 0; i < batch.Count(); i++ {
+			entry := &batch.entries[i]
+			mem, ok := mems[entry.family]
+			if !ok {
+				mem = db.repairedFamily(entry.family).newMemTable(number)
+				mems[entry.family] = mem
+			}
+			mem.add(seq+SequenceNumber(i), entry.valueType, entry.key, entry.value)
+		}
+	})
+	if err != nil && !errors.Is(err, ErrCorruption) {
+		return nil, err
+	}
+
+	tables := make(map[uint32]uint64)
+	for id, mem := range mems {
+		if mem.approximateMemoryUsage() == 0 {
+			continue
+		}
+		cfd := db.families[id]
+		mem.tableNumber = db.newFileNumber()
+		meta, err := db.writeLevel0Table(cfd, mem)
+		if err != nil {
+			return nil, err
+		}
+		if meta.blobFile != 0 {
+			cfd.blobFiles = append(cfd.blobFiles, meta.blobFile)
+		}
+		tables[id] = meta.number
+	}
+	return tables, nil
+}
+
+// scanTable reads every entry of the table number, returning its metadata
+// and the highest sequence number in it.
+func (db *DB) scanTable(number uint64) (meta *fileMetaData, seq SequenceNumber, err error) {
+	// a damaged table may break the decoding anywhere
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: table %d: %v", ErrCorruption, number, r)
+		}
+	}()
+
+	filename := sstableFileName(db.option.DirPath, number)
+	size, err := db.option.env().GetFileSize(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	if size < uint64(kFooterEncodedLength) {
+		return nil, 0, fmt.Errorf("%w: table %d is too short", ErrCorruption, number)
+	}
+	table, err := openSSTable(db.option.env(), filename, false)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	meta = &fileMetaData{number: number, fileSize: size}
+	meta.creationTime = uint64(time.Now().Unix())
+	iter := newSSTableIterator(table)
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		internal_key := InternalKey(iter.Key())
+		if meta.smallest == nil {
+			meta.smallest = internal_key
+		}
+		meta.largest = internal_key
+	}
+	for i := 0; i < len(table.tombstones); i++ {
+		meta.extendRange(&table.tombstones[i])
+	}
+	return meta, table.largestSeq(), nil
+}
+
+// archiveFile moves path to the lost subdirectory.
+func (db *DB) archiveFile(path string) error {
+	dir := filepath.Join(db.option.DirPath, kLostDirName)
+	if err := db.option.env().CreateDir(dir); err != nil {
+		return err
+	}
+	return db.option.env().RenameFile(path, filepath.Join(dir, filepath.Base(path)))
+}
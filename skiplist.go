@@ -143,7 +143,7 @@ func (list *SkipList) findlast() *Node {
 }
 
 func (list *SkipList) keyIsAfterNode(key []byte, n *Node) bool {
-	return (n != nil) && (InternalKeyCompare(key, n.key) >= 0)
+	return (n != nil) && (InternalKeyCompare(key, n.key) > 0)
 }
 
 type SkipListIterator struct {
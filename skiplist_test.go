@@ -74,12 +74,12 @@ func TestConcurrentInsertThroughput(t *testing.T) {
 	fmt.Printf("Insert entrys num: %d, throughput: %d\n", test_num, insertThroughput)
 
 	for i := 0; i < test_num; i++ {
-		key := []byte(fmt.Sprintf("key%06d", i))
-		value := []byte(fmt.Sprintf("value%06d", i))
+		key := NewInternalKey([]byte(fmt.Sprintf("%06dtest", i)), SequenceNumber(i), KTypeValue)
+		value := []byte(fmt.Sprintf("value%06d", key_arrays[i]))
 		iter := list.NewIterator()
 		iter.Seek(key)
 
-		if !iter.Valid() || InternalKeyCompare(iter.Key(), value) != 0 {
+		if !iter.Valid() || InternalKeyCompare(iter.Key(), key) != 0 || Compare(iter.Value(), value) != 0 {
 			t.Fatalf("Get key %s failed! Expect %s, but %s\n", key, value, iter.Key())
 		}
 	}
@@ -0,0 +1,47 @@
+package goleveldb
+
+// snapshot pins the state of the DB at a sequence number. While it is
+// live, compactions keep every version it can read.
+type snapshot struct {
+	seq SequenceNumber
+}
+
+// acquireSnapshot returns a snapshot of the last published update.
+func (db *DB) acquireSnapshot() *snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	snap := &snapshot{seq: db.lastSequence()}
+	db.snapshots[snap.seq]++
+	return snap
+}
+
+// copySnapshot returns another snapshot of the state pinned by snap,
+// released on its own.
+func (db *DB) copySnapshot(snap *snapshot) *snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.snapshots[snap.seq]++
+	return &snapshot{seq: snap.seq}
+}
+
+func (db *DB) releaseSnapshot(snap *snapshot) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.snapshots[snap.seq]--; db.snapshots[snap.seq] <= 0 {
+		delete(db.snapshots, snap.seq)
+	}
+}
+
+// smallestSnapshot returns the sequence number of the oldest live snapshot,
+// or kMaxSequenceNumber if there is none.
+func (db *DB) smallestSnapshot() SequenceNumber {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	smallest := kMaxSequenceNumber
+	for seq := range db.snapshots {
+		if seq < smallest {
+			smallest = seq
+		}
+	}
+	return smallest
+}
@@ -2,6 +2,8 @@ package goleveldb
 
 import (
 	"encoding/binary"
+	"runtime"
+	"sync"
 )
 
 // Decode SSTable Entry from [offset:]byte
@@ -214,22 +216,54 @@ type sstable struct {
 	footer     footer
 	indexblock *block // the offset of block in datablocks
 	datablocks []byte
+	tombstones rangeTombstones // read from the range tombstone meta block
+	mapped     bool            // the blocks point into a mapping of the file, see Options.UseMmapReads
+
+	largestSeqOnce  sync.Once
+	largestSeqCache SequenceNumber
 }
 
-func openSSTable(filepath string) (*sstable, error) {
-	var table sstable
-	file, err := NewLinuxFile(filepath)
+// openSSTable reads the table at filepath into the heap, or maps it into
+// memory if use_mmap is set and env can map files.
+func openSSTable(env Env, filepath string, use_mmap bool) (*sstable, error) {
+	if mmap_env, ok := env.(mmapEnv); ok && use_mmap {
+		return openMappedSSTable(mmap_env, filepath)
+	}
+
+	size, err := env.GetFileSize(filepath)
+	if err != nil {
+		return nil, err
+	}
+	file, err := env.NewRandomAccessFile(filepath)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
-	size := uint64(file.Size())
+	return readSSTable(file, size)
+}
 
+// openDirectSSTable reads the table at filepath into the heap, around the page cache.
+func openDirectSSTable(env Env, filepath string) (*sstable, error) {
+	size, err := env.GetFileSize(filepath)
+	if err != nil {
+		return nil, err
+	}
+	file, err := openDirectFile(env, filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readSSTable(file, size)
+}
+
+// readSSTable reads the table of size bytes in file into the heap.
+func readSSTable(file RandomAccessFile, size uint64) (*sstable, error) {
 	// Read the footer
 	footer_data, err := file.Read(size-uint64(kFooterEncodedLength), uint32(kFooterEncodedLength))
 	if err != nil {
 		return nil, err
 	}
+	var table sstable
 	table.footer.decodeFrom(footer_data)
 
 	// Read all data blocks buf
@@ -244,24 +278,81 @@ func openSSTable(filepath string) (*sstable, error) {
 		return nil, err
 	}
 
+	table.init(index_block_buf)
+	return &table, nil
+}
+
+// openMappedSSTable maps the table at filepath into memory. The mapping is
+// released by the garbage collector once nothing refers to the table: the
+// table cache, iterators or lookups in progress.
+func openMappedSSTable(env mmapEnv, filepath string) (*sstable, error) {
+	data, unmap, err := env.mmapFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < kFooterEncodedLength {
+		unmap()
+		return nil, ErrCorruption
+	}
+	table := &sstable{mapped: true}
+	table.footer.decodeFrom(data[len(data)-kFooterEncodedLength:])
+	index := table.footer.indexblockHandle
+	if index.offset+index.size > uint64(len(data)) {
+		unmap()
+		return nil, ErrCorruption
+	}
+	table.datablocks = data[:index.offset]
+	table.init(data[index.offset : index.offset+index.size])
+	runtime.SetFinalizer(table, func(*sstable) { unmap() })
+	return table, nil
+}
+
+// init constructs the index block and reads the meta blocks.
+func (table *sstable) init(index_block_buf []byte) {
 	// Construct index block
 	table.indexblock = newBlock(index_block_buf)
 
-	return &table, nil
+	// Meta blocks lie between the data blocks and the index block
+	if handle := table.footer.metaIndexHandle; handle.size > 0 {
+		iter := newBlockIterator(newBlock(table.datablocks[handle.offset : handle.offset+handle.size]))
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			if string(iter.Key()) == kRangeDelBlockName {
+				var rangedel blockHandle
+				rangedel.decodeFrom(iter.Value())
+				table.tombstones = decodeRangeTombstones(table.datablocks[rangedel.offset : rangedel.offset+rangedel.size])
+			}
+		}
+	}
 }
 
 // Firstly, locate the block according to the index block,
 // and then search by sequential traversal.
-func (table *sstable) get(key InternalKey) ([]byte, error) {
-	iter := newSSTableIterator(table)
-	iter.Seek(key)
-	k := InternalKey(iter.Key())
-	if UserKeyCompare(k.ExtractUserKey(), key.ExtractUserKey()) != 0 {
-		return nil, ErrKeyNotFound
-	} else if k.ExtractValueType() == KTypeDeletion {
-		return nil, errKeyDeleted
+func (table *sstable) get(key InternalKey, ctx *mergeContext) ([]byte, error) {
+	tombstone := table.tombstones.maxCoveringSeq(key.ExtractUserKey(), key.ExtractSequenceNumber())
+	var iter Iterator = newSSTableIterator(table)
+	if table.mapped {
+		// the value and the merge operands outlive the lookup, not the table
+		iter = &copyingIterator{iter}
 	}
-	return iter.Value(), nil
+	return ctx.lookup(iter, key, tombstone)
+}
+
+// largestSeq returns the highest sequence number in the table.
+func (table *sstable) largestSeq() SequenceNumber {
+	table.largestSeqOnce.Do(func() {
+		iter := newSSTableIterator(table)
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			if seq := InternalKey(iter.Key()).ExtractSequenceNumber(); seq > table.largestSeqCache {
+				table.largestSeqCache = seq
+			}
+		}
+		for i := 0; i < len(table.tombstones); i++ {
+			if table.tombstones[i].seq > table.largestSeqCache {
+				table.largestSeqCache = table.tombstones[i].seq
+			}
+		}
+	})
+	return table.largestSeqCache
 }
 
 type sstableIterator struct {
@@ -289,6 +380,11 @@ func (iter *sstableIterator) SeekToFirst() {
 		iter.index_block_iter = newBlockIterator(iter.table.indexblock)
 	}
 	iter.index_block_iter.SeekToFirst()
+	if !iter.index_block_iter.Valid() {
+		// a table may hold range tombstones only
+		iter.data_block_iter = newBlockIterator(&block{})
+		return
+	}
 	var handle blockHandle
 	handle.decodeFrom(iter.index_block_iter.value)
 	block_data := newBlock(iter.table.datablocks[handle.offset : handle.offset+handle.size])
@@ -303,6 +399,10 @@ func (iter *sstableIterator) Seek(target interface{}) {
 
 	var handle blockHandle
 	iter.index_block_iter.Seek(target)
+	if !iter.index_block_iter.Valid() {
+		iter.data_block_iter = newBlockIterator(&block{})
+		return
+	}
 	handle.decodeFrom(iter.index_block_iter.value)
 	iter.parseDataBlock(&handle)
 
@@ -343,3 +443,17 @@ func (iter *sstableIterator) Value() []byte {
 }
 
 var _ Iterator = (*sstableIterator)(nil)
+
+// copyingIterator returns copies of the keys and values of the Iterator it
+// wraps, which are valid after the table is unmapped.
+type copyingIterator struct {
+	Iterator
+}
+
+func (iter *copyingIterator) Key() []byte {
+	return append([]byte(nil), iter.Iterator.Key()...)
+}
+
+func (iter *copyingIterator) Value() []byte {
+	return append([]byte(nil), iter.Iterator.Value()...)
+}
@@ -11,12 +11,19 @@ type tableBuilder struct {
 	pendingIndexEntry bool
 	pendingHandle     blockHandle
 	lastKey           InternalKey
+	tombstones        rangeTombstones
+	rateLimiter       *RateLimiter // Options.RateLimiter of the DB, may be nil
+	priority          IOPriority   // Of the writes, for rateLimiter
+	byFlush           bool         // Whether a flush writes the table, see Options.DropPageCacheAfterFlush
 }
 
-func newTableBuilder(options *Options, file WritableFile) *tableBuilder {
+func newTableBuilder(options *Options, file WritableFile, rate_limiter *RateLimiter, priority IOPriority, flush bool) *tableBuilder {
 	return &tableBuilder{
 		options:           options,
 		file:              file,
+		rateLimiter:       rate_limiter,
+		priority:          priority,
+		byFlush:           flush,
 		offset:            0,
 		dataBlockBuilder:  newBlockBuilder(options.BlockRestartInterval),
 		indexBlockBuilder: newBlockBuilder(1),
@@ -42,6 +49,11 @@ func (builder *tableBuilder) add(key InternalKey, value []byte) {
 	}
 }
 
+// addRangeTombstone stores t in the range tombstone meta block of the table.
+func (builder *tableBuilder) addRangeTombstone(t rangeTombstone) {
+	builder.tombstones = append(builder.tombstones, t)
+}
+
 func (builder *tableBuilder) flush() {
 	if builder.dataBlockBuilder.empty() {
 		return
@@ -50,8 +62,18 @@ func (builder *tableBuilder) flush() {
 	if builder.status == nil {
 		builder.pendingIndexEntry = true
 		if builder.options.Sync {
-			builder.file.Sync()
+			builder.status = builder.file.Sync()
+		}
+	}
+}
+
+// append writes data to the file, unless an earlier write failed.
+func (builder *tableBuilder) append(data []byte) {
+	if builder.status == nil {
+		if builder.rateLimiter != nil {
+			builder.rateLimiter.Request(int64(len(data)), builder.priority)
 		}
+		builder.status = builder.file.Append(string(data))
 	}
 }
 
@@ -64,15 +86,30 @@ func (builder *tableBuilder) writeblock(blockBuilder *blockBuilder) blockHandle
 	handle.size = uint64(blockSize)
 	builder.offset += uint64(blockSize)
 
-	builder.status = builder.file.Append(string(blockContent))
+	builder.append(blockContent)
 
 	blockBuilder.reset()
 	return handle
 }
 
-func (builder *tableBuilder) finish() {
+// finish completes and closes the table. It returns the first error met
+// while writing it.
+func (builder *tableBuilder) finish() error {
 	builder.flush()
 
+	// Write range tombstone block and the metaindex block pointing to it
+	var metaIndexHandle blockHandle
+	if len(builder.tombstones) > 0 {
+		rangedel := builder.tombstones.encodeTo(builder.options.BlockRestartInterval)
+		rangedelHandle := blockHandle{offset: builder.offset, size: uint64(len(rangedel))}
+		builder.offset += uint64(len(rangedel))
+		builder.append(rangedel)
+
+		metaIndexBuilder := newBlockBuilder(1)
+		metaIndexBuilder.add(InternalKey(kRangeDelBlockName), rangedelHandle.encodeTo())
+		metaIndexHandle = builder.writeblock(metaIndexBuilder)
+	}
+
 	// Write index block
 	if builder.pendingIndexEntry {
 		handle := builder.pendingHandle.encodeTo()
@@ -82,14 +119,23 @@ func (builder *tableBuilder) finish() {
 	indexblockHandle := builder.writeblock(builder.indexBlockBuilder)
 
 	// write footer block
-	footer := footer{indexblockHandle: indexblockHandle}
-	builder.status = builder.file.Append(string(footer.encodeTo()))
+	footer := footer{metaIndexHandle: metaIndexHandle, indexblockHandle: indexblockHandle}
+	builder.append(footer.encodeTo())
 
 	// flush disk
-	builder.file.Sync()
+	if builder.status == nil {
+		builder.status = builder.file.Sync()
+	}
+	if f, ok := builder.file.(pageCacheFile); ok && builder.status == nil && builder.byFlush && builder.options.DropPageCacheAfterFlush {
+		// only advice, a failure is harmless
+		f.dropPageCache()
+	}
 
 	// close sstable
-	builder.file.Close()
+	if err := builder.file.Close(); builder.status == nil {
+		builder.status = err
+	}
+	return builder.status
 }
 
 func (builder *tableBuilder) fileSize() uint64 {
@@ -191,5 +237,5 @@ func (builder *blockBuilder) reset() {
 }
 
 func (builder *blockBuilder) empty() bool {
-	return builder.currentSizeEstimate() == 0
+	return len(builder.buffer) == 0
 }
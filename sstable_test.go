@@ -34,17 +34,17 @@ func Test_SSTable_PutGet(t *testing.T) {
 		panic(err)
 	}
 	test_num := 500
-	builder := newTableBuilder(options, file)
+	builder := newTableBuilder(options, file, nil, IOPriorityLow, false)
 	for i := 0; i < test_num; i++ {
 		i_k := NewInternalKey([]byte(fmt.Sprintf("key%04d", i)), SequenceNumber(i), KTypeValue)
 		builder.add(i_k, []byte(fmt.Sprintf("v%d", i)))
 	}
 	builder.finish()
 
-	table, _ := openSSTable(sstableFileName(options.DirPath, 1))
+	table, _ := openSSTable(options.env(), sstableFileName(options.DirPath, 1), false)
 	for i := 0; i < test_num; i++ {
 		i_k := NewInternalKey([]byte(fmt.Sprintf("key%04d", i)), SequenceNumber(i), KTypeValue)
-		v, _ := table.get(i_k)
+		v, _ := table.get(i_k, newMergeContext(nil, i_k.ExtractUserKey()))
 		if !bytes.Equal(v, []byte(fmt.Sprintf("v%d", i))) {
 			t.Fatalf("lookup key%04d failed\n", i)
 		}
@@ -61,3 +61,40 @@ func Test_SSTable_PutGet(t *testing.T) {
 		i++
 	}
 }
+
+// droppingFile records whether its pages were dropped from the page cache.
+type droppingFile struct {
+	WritableFile
+	dropped bool
+}
+
+func (f *droppingFile) dropPageCache() error {
+	f.dropped = true
+	return nil
+}
+
+func Test_SSTable_DropPageCacheAfterFlush(t *testing.T) {
+	options := DefaultOptions()
+	options.DirPath = "/tmp/golevel-sstable"
+	options.Env = NewMemEnv()
+	options.DropPageCacheAfterFlush = true
+	if err := options.Env.CreateDir(options.DirPath); err != nil {
+		t.Fatal(err)
+	}
+	// the priority does not tell flushes from compactions
+	for i, flush := range []bool{true, false} {
+		file, err := options.Env.NewWritableFile(sstableFileName(options.DirPath, uint64(i+1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := &droppingFile{WritableFile: file}
+		builder := newTableBuilder(options, f, nil, IOPriorityHigh, flush)
+		builder.add(NewInternalKey([]byte("key"), 1, KTypeValue), []byte("value"))
+		if err := builder.finish(); err != nil {
+			t.Fatal(err)
+		}
+		if f.dropped != flush {
+			t.Fatalf("Expect the pages of a table written by a flush %v dropped: %v, but get %v\n", flush, flush, f.dropped)
+		}
+	}
+}
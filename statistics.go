@@ -0,0 +1,277 @@
+package goleveldb
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Statistics collects counters and latency histograms of the DBs using it,
+// see Options.Statistics. It is safe for concurrent use.
+type Statistics struct {
+	tickers      [kNumTickers]uint64 // Accessed atomically
+	tableLookups [NumLevels]uint64   // Accessed atomically
+	histograms   [kNumHistograms]histogram
+}
+
+// StatisticsData is a copy of the values of a Statistics.
+type StatisticsData struct {
+	BytesWritten uint64 // Bytes of the keys and values written
+	BytesRead    uint64 // Bytes of the values read by Get
+
+	WALSyncs uint64
+
+	MemtableHits   uint64 // Gets answered by a memtable
+	MemtableMisses uint64 // Gets searching the sstables
+
+	// TableLookups counts the sstables searched by Get, per level.
+	TableLookups [NumLevels]uint64
+
+	// Tables are cached whole, so the table cache plays the part of a block cache.
+	TableCacheHits   uint64
+	TableCacheMisses uint64
+
+	FlushBytesWritten      uint64
+	CompactionBytesRead    uint64
+	CompactionBytesWritten uint64
+
+	StallMicros uint64 // Time writes waited for flushes and compactions
+
+	GetMicros   HistogramData
+	WriteMicros HistogramData // Put, Delete, Merge and Write
+}
+
+// HistogramData summarizes the values added to a histogram.
+type HistogramData struct {
+	Count  uint64
+	Sum    uint64
+	Min    uint64
+	Max    uint64
+	Median float64
+	P95    float64
+	P99    float64
+}
+
+type ticker int
+
+const (
+	tickerBytesWritten ticker = iota
+	tickerBytesRead
+	tickerWALSyncs
+	tickerMemtableHits
+	tickerMemtableMisses
+	tickerTableCacheHits
+	tickerTableCacheMisses
+	tickerFlushBytesWritten
+	tickerCompactionBytesRead
+	tickerCompactionBytesWritten
+	tickerStallMicros
+	kNumTickers
+)
+
+type histogramType int
+
+const (
+	histogramGetMicros histogramType = iota
+	histogramWriteMicros
+	kNumHistograms
+)
+
+// NewStatistics returns a Statistics with all values zero.
+func NewStatistics() *Statistics {
+	return &Statistics{}
+}
+
+// The methods of Statistics may be called on a nil Statistics: the record
+// methods do nothing, so that DBs without Statistics need no checks.
+
+func (s *Statistics) record(t ticker, n uint64) {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.tickers[t], n)
+}
+
+func (s *Statistics) recordTableLookup(level int) {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.tableLookups[level], 1)
+}
+
+// recordSince adds the microseconds elapsed since begin to the ticker t.
+func (s *Statistics) recordSince(t ticker, begin time.Time) {
+	if s == nil {
+		return
+	}
+	s.record(t, uint64(time.Since(begin).Microseconds()))
+}
+
+// measure adds the microseconds elapsed since begin to the histogram h.
+func (s *Statistics) measure(h histogramType, begin time.Time) {
+	if s == nil {
+		return
+	}
+	s.histograms[h].add(uint64(time.Since(begin).Microseconds()))
+}
+
+// Data returns a copy of the current values, all zero on a nil Statistics.
+func (s *Statistics) Data() StatisticsData {
+	var data StatisticsData
+	if s == nil {
+		return data
+	}
+	data.BytesWritten = atomic.LoadUint64(&s.tickers[tickerBytesWritten])
+	data.BytesRead = atomic.LoadUint64(&s.tickers[tickerBytesRead])
+	data.WALSyncs = atomic.LoadUint64(&s.tickers[tickerWALSyncs])
+	data.MemtableHits = atomic.LoadUint64(&s.tickers[tickerMemtableHits])
+	data.MemtableMisses = atomic.LoadUint64(&s.tickers[tickerMemtableMisses])
+	for level := 0; level < int(NumLevels); level++ {
+		data.TableLookups[level] = atomic.LoadUint64(&s.tableLookups[level])
+	}
+	data.TableCacheHits = atomic.LoadUint64(&s.tickers[tickerTableCacheHits])
+	data.TableCacheMisses = atomic.LoadUint64(&s.tickers[tickerTableCacheMisses])
+	data.FlushBytesWritten = atomic.LoadUint64(&s.tickers[tickerFlushBytesWritten])
+	data.CompactionBytesRead = atomic.LoadUint64(&s.tickers[tickerCompactionBytesRead])
+	data.CompactionBytesWritten = atomic.LoadUint64(&s.tickers[tickerCompactionBytesWritten])
+	data.StallMicros = atomic.LoadUint64(&s.tickers[tickerStallMicros])
+	data.GetMicros = s.histograms[histogramGetMicros].data()
+	data.WriteMicros = s.histograms[histogramWriteMicros].data()
+	return data
+}
+
+// Reset sets all values back to zero.
+func (s *Statistics) Reset() {
+	if s == nil {
+		return
+	}
+	for i := range s.tickers {
+		atomic.StoreUint64(&s.tickers[i], 0)
+	}
+	for i := range s.tableLookups {
+		atomic.StoreUint64(&s.tableLookups[i], 0)
+	}
+	for i := range s.histograms {
+		s.histograms[i].reset()
+	}
+}
+
+// String formats the current values, one per line.
+func (s *Statistics) String() string {
+	data := s.Data()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "bytes.written: %d\n", data.BytesWritten)
+	fmt.Fprintf(&sb, "bytes.read: %d\n", data.BytesRead)
+	fmt.Fprintf(&sb, "wal.syncs: %d\n", data.WALSyncs)
+	fmt.Fprintf(&sb, "memtable.hits: %d\n", data.MemtableHits)
+	fmt.Fprintf(&sb, "memtable.misses: %d\n", data.MemtableMisses)
+	for level := 0; level < int(NumLevels); level++ {
+		fmt.Fprintf(&sb, "table.lookups.level%d: %d\n", level, data.TableLookups[level])
+	}
+	fmt.Fprintf(&sb, "table.cache.hits: %d\n", data.TableCacheHits)
+	fmt.Fprintf(&sb, "table.cache.misses: %d\n", data.TableCacheMisses)
+	fmt.Fprintf(&sb, "flush.bytes.written: %d\n", data.FlushBytesWritten)
+	fmt.Fprintf(&sb, "compaction.bytes.read: %d\n", data.CompactionBytesRead)
+	fmt.Fprintf(&sb, "compaction.bytes.written: %d\n", data.CompactionBytesWritten)
+	fmt.Fprintf(&sb, "stall.micros: %d\n", data.StallMicros)
+	for _, h := range []struct {
+		name string
+		data HistogramData
+	}{{"get.micros", data.GetMicros}, {"write.micros", data.WriteMicros}} {
+		fmt.Fprintf(&sb, "%s: count %d sum %d min %d max %d median %.1f p95 %.1f p99 %.1f\n",
+			h.name, h.data.Count, h.data.Sum, h.data.Min, h.data.Max, h.data.Median, h.data.P95, h.data.P99)
+	}
+	return sb.String()
+}
+
+// kHistogramBucketLimits are the upper bounds of the buckets of a histogram,
+// growing by a fifth from one bucket to the next.
+var kHistogramBucketLimits = func() []uint64 {
+	var limits []uint64
+	for limit := uint64(1); limit < 1e13; {
+		limits = append(limits, limit)
+		if next := limit * 6 / 5; next > limit {
+			limit = next
+		} else {
+			limit++
+		}
+	}
+	return append(limits, math.MaxUint64)
+}()
+
+// histogram counts values by bucket, to estimate their percentiles.
+type histogram struct {
+	mu      sync.Mutex
+	count   uint64
+	sum     uint64
+	min     uint64
+	max     uint64
+	buckets []uint64 // By index in kHistogramBucketLimits, allocated by the first add
+}
+
+func (h *histogram) add(value uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(kHistogramBucketLimits))
+	}
+	b := sort.Search(len(kHistogramBucketLimits), func(i int) bool { return kHistogramBucketLimits[i] >= value })
+	h.buckets[b]++
+	if h.count == 0 || value < h.min {
+		h.min = value
+	}
+	if value > h.max {
+		h.max = value
+	}
+	h.count++
+	h.sum += value
+}
+
+func (h *histogram) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.count, h.sum, h.min, h.max, h.buckets = 0, 0, 0, 0, nil
+}
+
+func (h *histogram) data() HistogramData {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return HistogramData{
+		Count:  h.count,
+		Sum:    h.sum,
+		Min:    h.min,
+		Max:    h.max,
+		Median: h.percentile(50),
+		P95:    h.percentile(95),
+		P99:    h.percentile(99),
+	}
+}
+
+// percentile interpolates the value below which p percent of the values lie,
+// assuming the values spread evenly within a bucket.
+// REQUIRES: h.mu held.
+func (h *histogram) percentile(p float64) float64 {
+	threshold := float64(h.count) * p / 100
+	var cumulative float64
+	for b, n := range h.buckets {
+		if n == 0 {
+			continue
+		}
+		cumulative += float64(n)
+		if cumulative < threshold {
+			continue
+		}
+		var left float64
+		if b > 0 {
+			left = float64(kHistogramBucketLimits[b-1])
+		}
+		right := float64(kHistogramBucketLimits[b])
+		r := left + (right-left)*(threshold-(cumulative-float64(n)))/float64(n)
+		return math.Max(float64(h.min), math.Min(float64(h.max), r))
+	}
+	return float64(h.max)
+}
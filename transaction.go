@@ -0,0 +1,352 @@
+package goleveldb
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// TransactionOptions configures a transaction started by DB.BeginTransaction.
+type TransactionOptions struct {
+	// Pessimistic makes the transaction lock every key it writes or reads
+	// with GetForUpdate, so that conflicts are found when the key is locked.
+	// An optimistic transaction takes no locks and detects conflicts when it
+	// commits, which is cheaper when transactions rarely touch the same keys.
+	// Default value is false
+	Pessimistic bool
+
+	// LockTimeout is how long a pessimistic transaction waits for a key
+	// locked by another transaction before failing with ErrLockTimeout.
+	// Two transactions waiting for each other are resolved this way.
+	// Default value is 1s
+	LockTimeout time.Duration
+}
+
+func DefaultTransactionOptions() TransactionOptions {
+	return TransactionOptions{
+		Pessimistic: false,
+		LockTimeout: time.Second,
+	}
+}
+
+// Transaction groups reads and writes that take effect atomically on Commit.
+// Reads see the DB as of BeginTransaction, plus the writes of the transaction.
+// Commit fails with ErrTransactionConflict if a key the transaction wrote or
+// read with GetForUpdate was written by someone else after it began.
+//
+// Only transactions lock keys, so DB.Put and the other writes outside of
+// transactions are detected as conflicts but never wait for locks.
+// A Transaction must not be used by several goroutines at once.
+type Transaction struct {
+	db     *DB
+	id     uint64
+	option TransactionOptions
+	snap   *snapshot
+	closed bool
+
+	batch    WriteBatch
+	buffered map[string]int        // Index in batch of the last write of each key
+	tracked  map[string]trackedKey // Keys checked for conflicts, locked if pessimistic
+}
+
+type trackedKey struct {
+	cfd *columnFamilyData
+	key []byte
+}
+
+// BeginTransaction starts a transaction reading the last published update.
+func (db *DB) BeginTransaction(option TransactionOptions) *Transaction {
+	var txn Transaction
+	txn.db = db
+	txn.id = atomic.AddUint64(&db.nextTransactionID, 1)
+	txn.option = option
+	txn.snap = db.acquireSnapshot()
+	txn.buffered = make(map[string]int)
+	txn.tracked = make(map[string]trackedKey)
+	return &txn
+}
+
+// Get returns the value for key in the default column family.
+func (txn *Transaction) Get(key []byte) ([]byte, error) {
+	return txn.GetCF(txn.db.DefaultColumnFamily(), key)
+}
+
+// GetCF returns the value for key in the column family cf, as written by
+// the transaction or else as of the start of the transaction.
+func (txn *Transaction) GetCF(cf *ColumnFamilyHandle, key []byte) ([]byte, error) {
+	if txn.closed {
+		return nil, ErrTransactionClosed
+	}
+	if i, ok := txn.buffered[lockKey(cf.ID(), key)]; ok {
+		entry := &txn.batch.entries[i]
+		if entry.valueType == KTypeDeletion {
+			return nil, ErrKeyNotFound
+		}
+		return entry.value, nil
+	}
+	return txn.db.get(cf.cfd, key, txn.snap)
+}
+
+// Scan returns an iterator over the default column family, positioned at
+// the first key not less than key, see ScanCF.
+func (txn *Transaction) Scan(key []byte) (*DBIterator, error) {
+	return txn.ScanCF(txn.db.DefaultColumnFamily(), key)
+}
+
+// ScanCF returns an iterator over the column family cf as of the start of the
+// transaction, with the writes of the transaction applied, positioned at the
+// first key not less than key. Writes made after ScanCF are not seen by it.
+// The iterator must be closed after use.
+func (txn *Transaction) ScanCF(cf *ColumnFamilyHandle, key []byte) (*DBIterator, error) {
+	if txn.closed {
+		return nil, ErrTransactionClosed
+	}
+	// the iterator may outlive the transaction
+	iter, err := txn.db.newDBIterator(cf.cfd, key, txn.db.copySnapshot(txn.snap))
+	if err != nil {
+		return nil, err
+	}
+
+	// the last write of each key, sorted by key
+	var writes []transactionWrite
+	for i := 0; i < txn.batch.Count(); i++ {
+		entry := &txn.batch.entries[i]
+		if entry.family != cf.ID() || txn.buffered[lockKey(entry.family, entry.key)] != i {
+			continue
+		}
+		writes = append(writes, transactionWrite{
+			key:     NewInternalKey(entry.key, txn.snap.seq, entry.valueType),
+			value:   entry.value,
+			deleted: entry.valueType == KTypeDeletion,
+		})
+	}
+	sort.Slice(writes, func(i, j int) bool {
+		return UserKeyCompare(writes[i].key.ExtractUserKey(), writes[j].key.ExtractUserKey()) < 0
+	})
+
+	merged := &transactionIterator{base: iter.Iterator, writes: writes}
+	merged.Seek(NewInternalKey(key, txn.snap.seq, KTypeValue))
+	iter.Iterator = merged
+	return iter, nil
+}
+
+// GetForUpdate reads key from the default column family like Get, and makes
+// the transaction conflict with any other write of key.
+func (txn *Transaction) GetForUpdate(key []byte) ([]byte, error) {
+	return txn.GetForUpdateCF(txn.db.DefaultColumnFamily(), key)
+}
+
+// GetForUpdateCF reads key from the column family cf like GetCF, and makes
+// the transaction conflict with any other write of key.
+func (txn *Transaction) GetForUpdateCF(cf *ColumnFamilyHandle, key []byte) ([]byte, error) {
+	if txn.closed {
+		return nil, ErrTransactionClosed
+	}
+	if err := txn.track(cf, key); err != nil {
+		return nil, err
+	}
+	return txn.GetCF(cf, key)
+}
+
+// Put sets the value for key in the default column family.
+func (txn *Transaction) Put(key, value []byte) error {
+	return txn.PutCF(txn.db.DefaultColumnFamily(), key, value)
+}
+
+// PutCF sets the value for key in the column family cf.
+func (txn *Transaction) PutCF(cf *ColumnFamilyHandle, key, value []byte) error {
+	return txn.write(cf, KTypeValue, key, value)
+}
+
+// Delete deletes key from the default column family.
+func (txn *Transaction) Delete(key []byte) error {
+	return txn.DeleteCF(txn.db.DefaultColumnFamily(), key)
+}
+
+// DeleteCF deletes key from the column family cf.
+func (txn *Transaction) DeleteCF(cf *ColumnFamilyHandle, key []byte) error {
+	return txn.write(cf, KTypeDeletion, key, []byte{})
+}
+
+func (txn *Transaction) write(cf *ColumnFamilyHandle, valueType ValueType, key, value []byte) error {
+	if txn.closed {
+		return ErrTransactionClosed
+	}
+	if err := txn.track(cf, key); err != nil {
+		return err
+	}
+	txn.buffered[lockKey(cf.ID(), key)] = txn.batch.Count()
+	txn.batch.add(cf.ID(), valueType, key, value)
+	return nil
+}
+
+// track adds key to the keys checked for conflicts on Commit. A pessimistic
+// transaction also locks key and checks it at once.
+func (txn *Transaction) track(cf *ColumnFamilyHandle, key []byte) error {
+	k := lockKey(cf.ID(), key)
+	if _, ok := txn.tracked[k]; ok {
+		return nil
+	}
+	if !txn.option.Pessimistic {
+		txn.tracked[k] = trackedKey{cfd: cf.cfd, key: key}
+		return nil
+	}
+
+	if err := txn.db.locks.lock(txn.id, k, txn.option.LockTimeout); err != nil {
+		return err
+	}
+	txn.tracked[k] = trackedKey{cfd: cf.cfd, key: key}
+	// no other transaction can write key any more, but it may have
+	// been written between the start of txn and the lock
+	return txn.validate(txn.tracked[k])
+}
+
+// validate returns ErrTransactionConflict if key was written after txn began.
+func (txn *Transaction) validate(tk trackedKey) error {
+	seq, err := txn.db.latestSequence(tk.cfd, tk.key)
+	if err != nil {
+		return err
+	}
+	if seq > txn.snap.seq {
+		return ErrTransactionConflict
+	}
+	return nil
+}
+
+// Commit atomically applies the writes of the transaction.
+// The transaction is closed afterwards, even if Commit fails.
+func (txn *Transaction) Commit() error {
+	if txn.closed {
+		return ErrTransactionClosed
+	}
+	defer txn.close()
+
+	db := txn.db
+	db.muWrite.Lock()
+	defer db.muWrite.Unlock()
+	// no write can be published while muWrite is held. The locks of a
+	// pessimistic transaction keep other transactions out, but not the
+	// writes outside of transactions.
+	for _, tk := range txn.tracked {
+		if err := txn.validate(tk); err != nil {
+			return err
+		}
+	}
+	return db.writeBatch(&txn.batch)
+}
+
+// Rollback discards the writes of the transaction and closes it.
+func (txn *Transaction) Rollback() error {
+	if txn.closed {
+		return ErrTransactionClosed
+	}
+	txn.close()
+	return nil
+}
+
+func (txn *Transaction) close() {
+	txn.closed = true
+	if txn.option.Pessimistic {
+		for k := range txn.tracked {
+			txn.db.locks.unlock(txn.id, k)
+		}
+	}
+	txn.db.releaseSnapshot(txn.snap)
+}
+
+// transactionIterator merges the uncommitted writes of a transaction over an
+// iterator of the DB. A write hides the versions of its key in the DB, and
+// keys the transaction deleted are skipped.
+type transactionIterator struct {
+	base   Iterator
+	writes []transactionWrite
+	pos    int // Position in writes
+
+	fromWrites bool // The current entry is writes[pos]
+	valid      bool
+}
+
+type transactionWrite struct {
+	key     InternalKey // Uncommitted, so tagged with the transaction snapshot
+	value   []byte
+	deleted bool
+}
+
+func (iter *transactionIterator) Valid() bool {
+	return iter.valid
+}
+
+func (iter *transactionIterator) SeekToFirst() {
+	iter.base.SeekToFirst()
+	iter.pos = 0
+	iter.settle()
+}
+
+func (iter *transactionIterator) Seek(target interface{}) {
+	iter.base.Seek(target)
+	user_key := target.(InternalKey).ExtractUserKey()
+	iter.pos = sort.Search(len(iter.writes), func(i int) bool {
+		return UserKeyCompare(iter.writes[i].key.ExtractUserKey(), user_key) >= 0
+	})
+	iter.settle()
+}
+
+func (iter *transactionIterator) Next() {
+	if !iter.valid {
+		return
+	}
+	if iter.fromWrites {
+		iter.pos++
+	} else {
+		iter.base.Next()
+	}
+	iter.settle()
+}
+
+// settle picks the smaller key of the DB and of the writes, skipping
+// the versions hidden by a write and the keys deleted by the transaction.
+func (iter *transactionIterator) settle() {
+	for {
+		base_valid := iter.base.Valid()
+		if iter.pos >= len(iter.writes) {
+			iter.fromWrites = false
+			iter.valid = base_valid
+			return
+		}
+		write := &iter.writes[iter.pos]
+		if base_valid {
+			cmp := UserKeyCompare(InternalKey(iter.base.Key()).ExtractUserKey(), write.key.ExtractUserKey())
+			if cmp < 0 {
+				iter.fromWrites = false
+				iter.valid = true
+				return
+			}
+			if cmp == 0 {
+				iter.base.Next()
+			}
+		}
+		if write.deleted {
+			iter.pos++
+			continue
+		}
+		iter.fromWrites = true
+		iter.valid = true
+		return
+	}
+}
+
+func (iter *transactionIterator) Key() []byte {
+	if iter.fromWrites {
+		return iter.writes[iter.pos].key
+	}
+	return iter.base.Key()
+}
+
+func (iter *transactionIterator) Value() []byte {
+	if iter.fromWrites {
+		return iter.writes[iter.pos].value
+	}
+	return iter.base.Value()
+}
+
+var _ Iterator = (*transactionIterator)(nil)
@@ -0,0 +1,238 @@
+package goleveldb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func openTransactionDB(t *testing.T) *DB {
+	path := "/tmp/goleveldb-mydb"
+	os.RemoveAll(path)
+	option := DefaultOptions()
+	option.DirPath = path
+
+	db, err := Open(*option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+		_ = os.RemoveAll(path)
+	})
+	return db
+}
+
+func expectValue(t *testing.T, value []byte, err error, expected string) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != expected {
+		t.Fatalf("Expect: %s, but get %s\n", expected, value)
+	}
+}
+
+func TestTransaction_Optimistic(t *testing.T) {
+	db := openTransactionDB(t)
+	if err := db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := db.BeginTransaction(DefaultTransactionOptions())
+	if err := txn.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	// read your own writes
+	value, err := txn.Get([]byte("b"))
+	expectValue(t, value, err, "2")
+	if _, err := txn.Get([]byte("a")); err != ErrKeyNotFound {
+		t.Fatalf("Expect: %v, but get %v\n", ErrKeyNotFound, err)
+	}
+	// nothing is visible before commit
+	value, err = db.Get([]byte("a"))
+	expectValue(t, value, err, "1")
+	if _, err := db.Get([]byte("b")); err != ErrKeyNotFound {
+		t.Fatalf("Expect: %v, but get %v\n", ErrKeyNotFound, err)
+	}
+	// writes after the transaction began are not seen
+	if err := db.Put([]byte("c"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := txn.Get([]byte("c")); err != ErrKeyNotFound {
+		t.Fatalf("Expect: %v, but get %v\n", ErrKeyNotFound, err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get([]byte("a")); err != ErrKeyNotFound {
+		t.Fatalf("Expect: %v, but get %v\n", ErrKeyNotFound, err)
+	}
+	value, err = db.Get([]byte("b"))
+	expectValue(t, value, err, "2")
+	if err := txn.Commit(); err != ErrTransactionClosed {
+		t.Fatalf("Expect: %v, but get %v\n", ErrTransactionClosed, err)
+	}
+
+	// a key read for update and written by someone else conflicts
+	txn = db.BeginTransaction(DefaultTransactionOptions())
+	value, err = txn.GetForUpdate([]byte("c"))
+	expectValue(t, value, err, "3")
+	if err := txn.Put([]byte("d"), []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("c"), []byte("5")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); err != ErrTransactionConflict {
+		t.Fatalf("Expect: %v, but get %v\n", ErrTransactionConflict, err)
+	}
+	if _, err := db.Get([]byte("d")); err != ErrKeyNotFound {
+		t.Fatalf("Expect: %v, but get %v\n", ErrKeyNotFound, err)
+	}
+
+	// so does a range deletion of a written key
+	txn = db.BeginTransaction(DefaultTransactionOptions())
+	if err := txn.Put([]byte("c"), []byte("6")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteRange([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); err != ErrTransactionConflict {
+		t.Fatalf("Expect: %v, but get %v\n", ErrTransactionConflict, err)
+	}
+}
+
+func TestTransaction_Pessimistic(t *testing.T) {
+	db := openTransactionDB(t)
+	option := DefaultTransactionOptions()
+	option.Pessimistic = true
+	option.LockTimeout = 50 * time.Millisecond
+
+	txn1 := db.BeginTransaction(option)
+	txn2 := db.BeginTransaction(option)
+	if err := txn1.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn2.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	// each waits for the other, and gives up
+	if err := txn1.Put([]byte("b"), []byte("1")); err != ErrLockTimeout {
+		t.Fatalf("Expect: %v, but get %v\n", ErrLockTimeout, err)
+	}
+	if _, err := txn2.GetForUpdate([]byte("a")); err != ErrLockTimeout {
+		t.Fatalf("Expect: %v, but get %v\n", ErrLockTimeout, err)
+	}
+	if err := txn2.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lock of b was released with txn2
+	if err := txn1.Put([]byte("b"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		waiting := option
+		waiting.LockTimeout = 10 * time.Second
+		txn3 := db.BeginTransaction(waiting)
+		// waits for txn1, then finds a newer write than its snapshot
+		_, err := txn3.GetForUpdate([]byte("a"))
+		txn3.Rollback()
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := txn1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != ErrTransactionConflict {
+		t.Fatalf("Expect: %v, but get %v\n", ErrTransactionConflict, err)
+	}
+	value, err := db.Get([]byte("a"))
+	expectValue(t, value, err, "1")
+	value, err = db.Get([]byte("b"))
+	expectValue(t, value, err, "1")
+
+	// a write outside of transactions takes no lock, Commit finds it
+	txn4 := db.BeginTransaction(option)
+	if _, err := txn4.GetForUpdate([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn4.Put([]byte("a"), []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("a"), []byte("db")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn4.Commit(); err != ErrTransactionConflict {
+		t.Fatalf("Expect: %v, but get %v\n", ErrTransactionConflict, err)
+	}
+	value, err = db.Get([]byte("a"))
+	expectValue(t, value, err, "db")
+}
+
+func TestTransaction_Scan(t *testing.T) {
+	db := openTransactionDB(t)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := db.Put([]byte(key), []byte("db"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	txn := db.BeginTransaction(DefaultTransactionOptions())
+	defer txn.Rollback()
+	if err := txn.Put([]byte("b"), []byte("txnb")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Delete([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put([]byte("e"), []byte("txne")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put([]byte("0"), []byte("txn0")); err != nil {
+		t.Fatal(err)
+	}
+	// neither writes after the transaction began
+	if err := db.Put([]byte("a"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("ab"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"a=dba", "b=txnb", "d=dbd", "e=txne"}
+	iter, err := txn.Scan([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	var got []string
+	for ; iter.Valid(); iter.Next() {
+		key := InternalKey(iter.Key()).ExtractUserKey()
+		got = append(got, string(key)+"="+string(iter.Value()))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("Expect: %v, but get %v\n", expected, got)
+	}
+
+	// nor are the writes of the transaction outside of it
+	iter, err = db.Scan([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	got = nil
+	for ; iter.Valid(); iter.Next() {
+		got = append(got, string(InternalKey(iter.Key()).ExtractUserKey()))
+	}
+	if fmt.Sprint(got) != "[a ab b c d]" {
+		t.Fatalf("Expect: [a ab b c d], but get %v\n", got)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"sort"
+	"sync"
+	"time"
 )
 
 type fileMetaData struct {
@@ -12,29 +14,53 @@ type fileMetaData struct {
 	number   uint64      // file number
 	smallest InternalKey // Smallest internal key served by table
 	largest  InternalKey // Largest internal key served by table
+
+	creationTime uint64 // Unix time in seconds when the table was written
+
+	blobFile uint64 // Blob file written along with a flushed table, not persisted
+
+	beingCompacted bool // Reserved by a running compaction, not persisted
+}
+
+// kFileMetaDataFixedSize is the size of the fixed fields of an encoded
+// fileMetaData, which grew with the manifest format.
+var kFileMetaDataFixedSize = [...]uint32{
+	kManifestFormatLegacy: 16, // no creation time
+	kManifestFormatV1:     24,
 }
 
 func (meta *fileMetaData) encodeTo() []byte {
-	buf := make([]byte, 16)
+	buf := make([]byte, 24)
 	binary.LittleEndian.PutUint64(buf[0:8], meta.fileSize)
 	binary.LittleEndian.PutUint64(buf[8:16], meta.number)
+	binary.LittleEndian.PutUint64(buf[16:24], meta.creationTime)
 	buf = append(buf, PutLengthPrefixedSlice(meta.smallest)...)
 	buf = append(buf, PutLengthPrefixedSlice(meta.largest)...)
 	return buf
 }
 
-func (meta *fileMetaData) decodeFrom(data []byte) uint32 {
+// decodeFrom decodes a fileMetaData written in the manifest format and
+// returns its length. Tables recorded without a creation time count as
+// written now.
+func (meta *fileMetaData) decodeFrom(data []byte, format uint32) uint32 {
 	meta.fileSize = binary.LittleEndian.Uint64(data[0:8])
 	meta.number = binary.LittleEndian.Uint64(data[8:16])
+	if format >= kManifestFormatV1 {
+		meta.creationTime = binary.LittleEndian.Uint64(data[16:24])
+	} else {
+		meta.creationTime = uint64(time.Now().Unix())
+	}
+	fixed := kFileMetaDataFixedSize[format]
 	var n1, n2 uint32
-	meta.smallest, n1 = GetLengthPrefixedSlice(data[16:])
-	meta.largest, n2 = GetLengthPrefixedSlice(data[16+n1:])
-	return 16 + n1 + n2
+	meta.smallest, n1 = GetLengthPrefixedSlice(data[fixed:])
+	meta.largest, n2 = GetLengthPrefixedSlice(data[fixed+n1:])
+	return fixed + n1 + n2
 }
 
 type version struct {
 	cache *tableCache
 
+	muFileNumber   sync.Mutex // Guards nextFileNumber against concurrent background jobs
 	nextFileNumber uint64
 	lastSequence   SequenceNumber
 	files          [NumLevels][]*fileMetaData
@@ -50,6 +76,24 @@ func newVersion(cache *tableCache) *version {
 	return &version
 }
 
+// newFileNumber allocates a file number for a new table or log file.
+func (v *version) newFileNumber() uint64 {
+	v.muFileNumber.Lock()
+	defer v.muFileNumber.Unlock()
+	number := v.nextFileNumber
+	v.nextFileNumber++
+	return number
+}
+
+// markFileNumberUsed makes sure number is never allocated by newFileNumber.
+func (v *version) markFileNumberUsed(number uint64) {
+	v.muFileNumber.Lock()
+	defer v.muFileNumber.Unlock()
+	if number >= v.nextFileNumber {
+		v.nextFileNumber = number + 1
+	}
+}
+
 func (v *version) numLevelFiles(l uint32) uint32 {
 	return uint32(len(v.files[l]))
 }
@@ -59,7 +103,9 @@ func (v *version) addFile(level int, meta *fileMetaData) {
 		v.files[level] = append(v.files[level], meta)
 	} else {
 		numfiles := len(v.files[level])
-		index := v.findFile(v.files[level], meta.smallest.ExtractUserKey())
+		index := sort.Search(numfiles, func(i int) bool {
+			return InternalKeyCompare(v.files[level][i].smallest, meta.smallest) > 0
+		})
 		if index >= numfiles {
 			v.files[level] = append(v.files[level], meta)
 		} else {
@@ -91,12 +137,14 @@ func (v *version) deleteFile(level int, meta *fileMetaData, disk bool) error {
 	}
 	if disk {
 		v.cache.evict(meta.number)
-		return RemoveFile(sstableFileName(v.cache.option.DirPath, meta.number))
+		return v.cache.option.env().RemoveFile(sstableFileName(v.cache.option.DirPath, meta.number))
 	}
 	return nil
 }
 
-func (v *version) get(internal_key InternalKey) ([]byte, error) {
+// get looks internal_key up in the sstables, continuing the merge operands
+// already collected in ctx from the memtables.
+func (v *version) get(internal_key InternalKey, ctx *mergeContext) ([]byte, error) {
 	var filemetas []*fileMetaData
 	user_key := internal_key.ExtractUserKey()
 	for level := 0; level < int(NumLevels); level++ {
@@ -119,20 +167,20 @@ func (v *version) get(internal_key InternalKey) ([]byte, error) {
 				return filemetas[i].number > filemetas[j].number
 			})
 		} else {
+			// a file ending with a range tombstone may share its largest
+			// user key with the smallest one of the next file
 			index := v.findFile(v.files[level], user_key)
-			if index >= numfiles {
-				filemetas = nil
-			} else {
+			for ; index < numfiles; index++ {
 				if UserKeyCompare(user_key, v.files[level][index].smallest.ExtractUserKey()) < 0 {
-					filemetas = nil
-				} else {
-					filemetas = append(filemetas, v.files[level][index])
+					break
 				}
+				filemetas = append(filemetas, v.files[level][index])
 			}
 		}
 		numfiles = len(filemetas)
 		for idx := 0; idx < numfiles; idx++ {
-			value, err := v.cache.get(filemetas[idx].number, internal_key)
+			v.cache.dbOption.Statistics.recordTableLookup(level)
+			value, err := v.cache.get(filemetas[idx].number, internal_key, ctx)
 			if err == nil {
 				return value, nil
 			} else if err == errKeyDeleted {
@@ -143,13 +191,21 @@ func (v *version) get(internal_key InternalKey) ([]byte, error) {
 			return nil, err
 		}
 	}
-	return nil, ErrKeyNotFound
+	return ctx.finish()
 }
 
 func (v *version) encodeTo() []byte {
 	buf := make([]byte, 16)
+	v.muFileNumber.Lock()
 	binary.LittleEndian.PutUint64(buf, v.nextFileNumber)
+	v.muFileNumber.Unlock()
 	binary.LittleEndian.PutUint64(buf[8:], uint64(v.lastSequence))
+	return append(buf, v.encodeFilesTo()...)
+}
+
+// encodeFilesTo encodes the files of every level.
+func (v *version) encodeFilesTo() []byte {
+	var buf []byte
 	for level := 0; level < len(v.files); level++ {
 		level_size := len(v.files[level])
 		tmp := make([]byte, 4)
@@ -162,23 +218,32 @@ func (v *version) encodeTo() []byte {
 	return buf
 }
 
-func (v *version) decodeFrom(data []byte) {
+// decodeFrom decodes a version written by encodeTo in the manifest format
+// and returns its length.
+func (v *version) decodeFrom(data []byte, format uint32) uint32 {
 	v.nextFileNumber = binary.LittleEndian.Uint64(data)
 	v.lastSequence = SequenceNumber(binary.LittleEndian.Uint64(data[8:]))
-	offset := uint32(16)
+	return 16 + v.decodeFilesFrom(data[16:], format)
+}
+
+// decodeFilesFrom decodes the files written by encodeFilesTo in the manifest
+// format and returns their length.
+func (v *version) decodeFilesFrom(data []byte, format uint32) uint32 {
+	offset := uint32(0)
 	size := uint32(len(data))
-	for level := 0; offset < size; level++ {
+	for level := 0; level < int(NumLevels) && offset < size; level++ {
 		var metas []*fileMetaData
 		level_size := binary.LittleEndian.Uint32(data[offset:])
 		offset += 4
 		for idx := 0; idx < int(level_size); idx++ {
 			var meta fileMetaData
-			n := meta.decodeFrom(data[offset:])
+			n := meta.decodeFrom(data[offset:], format)
 			offset += n
 			metas = append(metas, &meta)
 		}
 		v.files[level] = metas
 	}
+	return offset
 }
 
 // Find the first file which largest key >= userkey
@@ -205,7 +270,7 @@ func (v *version) info() {
 	for i := 0; i < len(v.files); i++ {
 		n := len(v.files[i])
 		if n == 0 {
-			break
+			continue
 		}
 		fmt.Println("==========")
 		fmt.Printf("Level %d:\n", i)
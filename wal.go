@@ -72,13 +72,15 @@ type walWriter struct {
 	dest        WritableFile
 	blockOffset uint32
 	sync        bool
+	stats       *Statistics // Counts the syncs, may be nil
 	mu          sync.Mutex
 }
 
-func newWALWriter(dest WritableFile, sync bool) *walWriter {
+func newWALWriter(dest WritableFile, sync bool, stats *Statistics) *walWriter {
 	return &walWriter{
 		dest:        dest,
-		sync:        false,
+		sync:        sync,
+		stats:       stats,
 		blockOffset: 0,
 	}
 }
@@ -96,7 +98,9 @@ func (writer *walWriter) addRecord(data []byte) error {
 			if leftover > 0 {
 				// Fill the trailer (literal below relies on kHeaderSize being 7)
 				p := []byte("\x00\x00\x00\x00\x00\x00")[0:leftover]
-				writer.dest.Append(string(p))
+				if err := writer.dest.Append(string(p)); err != nil {
+					return err
+				}
 			}
 			writer.blockOffset = 0
 		}
@@ -164,6 +168,7 @@ func (writer *walWriter) emitPhysicalRecord(t recordType, ptr []byte, length uin
 }
 
 func (writer *walWriter) syncWrites() error {
+	writer.stats.record(tickerWALSyncs, 1)
 	return writer.dest.Sync()
 }
 
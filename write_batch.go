@@ -0,0 +1,206 @@
+package goleveldb
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// WriteBatch collects updates, possibly to several column families,
+// that DB.Write applies atomically.
+//
+// A batch is written to the log as a single record:
+//
+//	sequence: fixed64, sequence number of the first entry
+//	count: fixed32
+//	entries: count times
+//	  column_family_id: varint32
+//	  type: byte
+//	  key: length prefixed
+//	  value: length prefixed
+type WriteBatch struct {
+	entries []batchEntry
+}
+
+type batchEntry struct {
+	family    uint32
+	valueType ValueType
+	key       []byte
+	value     []byte
+}
+
+const kBatchHeaderSize = 12
+
+// Put adds setting the value for key in the default column family.
+func (batch *WriteBatch) Put(key, value []byte) {
+	batch.add(kDefaultColumnFamilyID, KTypeValue, key, value)
+}
+
+// PutCF adds setting the value for key in the column family cf.
+func (batch *WriteBatch) PutCF(cf *ColumnFamilyHandle, key, value []byte) {
+	batch.add(cf.ID(), KTypeValue, key, value)
+}
+
+// Delete adds deleting key from the default column family.
+func (batch *WriteBatch) Delete(key []byte) {
+	batch.add(kDefaultColumnFamilyID, KTypeDeletion, key, []byte{})
+}
+
+// DeleteCF adds deleting key from the column family cf.
+func (batch *WriteBatch) DeleteCF(cf *ColumnFamilyHandle, key []byte) {
+	batch.add(cf.ID(), KTypeDeletion, key, []byte{})
+}
+
+// Count returns the number of updates in the batch.
+func (batch *WriteBatch) Count() int {
+	return len(batch.entries)
+}
+
+// Clear removes all updates from the batch.
+func (batch *WriteBatch) Clear() {
+	batch.entries = batch.entries[:0]
+}
+
+func (batch *WriteBatch) add(family uint32, valueType ValueType, key, value []byte) {
+	batch.entries = append(batch.entries, batchEntry{
+		family:    family,
+		valueType: valueType,
+		key:       key,
+		value:     value,
+	})
+}
+
+func (batch *WriteBatch) encodeTo(seq SequenceNumber) []byte {
+	buf := make([]byte, kBatchHeaderSize)
+	binary.LittleEndian.PutUint64(buf, uint64(seq))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(batch.entries)))
+	for i := 0; i < len(batch.entries); i++ {
+		entry := &batch.entries[i]
+		tmp := make([]byte, 5)
+		n := EncodeUVarint32(tmp, entry.family)
+		buf = append(buf, tmp[:n]...)
+		buf = append(buf, byte(entry.valueType))
+		buf = append(buf, PutLengthPrefixedSlice(entry.key)...)
+		buf = append(buf, PutLengthPrefixedSlice(entry.value)...)
+	}
+	return buf
+}
+
+// decodeWriteBatch returns the sequence number of the first entry of the
+// batch encoded in data, and the batch.
+// A damaged record returns ErrByteCoding.
+func decodeWriteBatch(data []byte) (seq SequenceNumber, decoded *WriteBatch, err error) {
+	if len(data) < kBatchHeaderSize {
+		return 0, nil, ErrByteCoding
+	}
+	// the lengths in a damaged record may point anywhere
+	defer func() {
+		if recover() != nil {
+			seq, decoded, err = 0, nil, ErrByteCoding
+		}
+	}()
+	var batch WriteBatch
+	seq = SequenceNumber(binary.LittleEndian.Uint64(data))
+	count := binary.LittleEndian.Uint32(data[8:])
+	offset := uint32(kBatchHeaderSize)
+	for i := uint32(0); i < count; i++ {
+		if offset >= uint32(len(data)) {
+			return 0, nil, ErrByteCoding
+		}
+		family, n := DecodeUVarint32(data[offset:])
+		offset += n
+		valueType := ValueType(data[offset])
+		offset += 1
+		key, n := GetLengthPrefixedSlice(data[offset:])
+		offset += n
+		value, n := GetLengthPrefixedSlice(data[offset:])
+		offset += n
+		batch.add(family, valueType, key, value)
+	}
+	return seq, &batch, nil
+}
+
+// Every log starts with a record naming the format of the records after it:
+//
+//	magic: fixed64
+//	format: fixed32
+//
+// Logs written before the header existed hold a single KVEntry per record,
+// and are read in kLogFormatLegacy.
+const (
+	kLogMagic      uint64 = 0x676f4c62646c6f47
+	kLogHeaderSize        = 12
+
+	kLogFormatLegacy uint32 = 0 // a KVEntry of the default column family per record
+	kLogFormatBatch  uint32 = 1 // a WriteBatch per record
+
+	kLogFormatVersion = kLogFormatBatch // The format logs are written in
+)
+
+// encodeLogHeader returns the first record of a new log.
+func encodeLogHeader() []byte {
+	buf := make([]byte, kLogHeaderSize)
+	EncodeFixed64(buf, kLogMagic)
+	EncodeFixed32(buf[8:], kLogFormatVersion)
+	return buf
+}
+
+// decodeLegacyRecord returns the KVEntry of a kLogFormatLegacy log record
+// as a batch. A damaged record returns ErrByteCoding.
+func decodeLegacyRecord(data []byte) (seq SequenceNumber, decoded *WriteBatch, err error) {
+	// the lengths in a damaged record may point anywhere
+	defer func() {
+		if recover() != nil {
+			seq, decoded, err = 0, nil, ErrByteCoding
+		}
+	}()
+	key_size, n := DecodeUVarint32(data)
+	offset := uint64(n) + uint64(key_size) + 8
+	value_size, n := DecodeUVarint32(data[offset:])
+	if offset+uint64(n)+uint64(value_size) != uint64(len(data)) {
+		return 0, nil, ErrByteCoding
+	}
+	entry := KVEntry(data)
+	internal_key := entry.ExtractInternalKey()
+	value := entry.ExtractValue()
+	var batch WriteBatch
+	batch.add(kDefaultColumnFamilyID, internal_key.ExtractValueType(), internal_key.ExtractUserKey(), value)
+	return internal_key.ExtractSequenceNumber(), &batch, nil
+}
+
+// replayLog reads the batches of a log in order, passing each to apply.
+// A record cut short ends the log: a crash interrupted its write, or the
+// writer of a live log is not done with it. A record that can not be
+// decoded fails with ErrCorruption, unless it is the last one.
+func replayLog(file RandomAccessFile, apply func(seq SequenceNumber, batch *WriteBatch)) error {
+	reader := newWALReader(file)
+	format := kLogFormatLegacy
+	var damaged error
+	for first := true; ; first = false {
+		record, err := reader.readRecord()
+		if err != nil {
+			return nil
+		}
+		if damaged != nil {
+			return damaged
+		}
+		if first && len(record) == kLogHeaderSize && DecodeFixed64(record) == kLogMagic {
+			if format = DecodeFixed32(record[8:]); format > kLogFormatVersion {
+				return ErrUnsupportedFormat
+			}
+			continue
+		}
+		var seq SequenceNumber
+		var batch *WriteBatch
+		if format == kLogFormatLegacy {
+			seq, batch, err = decodeLegacyRecord(record)
+		} else {
+			seq, batch, err = decodeWriteBatch(record)
+		}
+		if err != nil {
+			// only fatal if more records follow
+			damaged = fmt.Errorf("%w: log record at offset %d", ErrCorruption, reader.lastRecordOffset)
+			continue
+		}
+		apply(seq, batch)
+	}
+}
@@ -0,0 +1,97 @@
+package goleveldb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func Test_writeBatchEncoding(t *testing.T) {
+	var batch WriteBatch
+	batch.Put([]byte("key1"), []byte("value1"))
+	batch.Delete([]byte("key2"))
+	batch.add(7, KTypeMerge, []byte("key3"), []byte("operand"))
+
+	seq, decoded, err := decodeWriteBatch(batch.encodeTo(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 100 || decoded.Count() != batch.Count() {
+		t.Fatalf("decoded sequence %d with %d entries", seq, decoded.Count())
+	}
+	for i := 0; i < batch.Count(); i++ {
+		expect, get := batch.entries[i], decoded.entries[i]
+		if expect.family != get.family || expect.valueType != get.valueType ||
+			!bytes.Equal(expect.key, get.key) || !bytes.Equal(expect.value, get.value) {
+			t.Fatalf("entry %d Expect: %v, but get %v\n", i, expect, get)
+		}
+	}
+
+	if _, _, err := decodeWriteBatch([]byte("short")); err != ErrByteCoding {
+		t.Fatalf("Expect: %v, but get %v\n", ErrByteCoding, err)
+	}
+}
+
+func Test_replayLog(t *testing.T) {
+	env := NewMemEnv()
+	writeLog := func(name string, records ...[]byte) RandomAccessFile {
+		file, err := env.NewWritableFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer := newWALWriter(file, false, nil)
+		for _, record := range records {
+			if err := writer.addRecord(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.close(); err != nil {
+			t.Fatal(err)
+		}
+		reader, err := env.NewRandomAccessFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reader
+	}
+	var batch WriteBatch
+	batch.Put([]byte("key1"), []byte("value1"))
+	batch.add(7, KTypeMerge, []byte("key2"), []byte("operand"))
+	var seqs []SequenceNumber
+	apply := func(seq SequenceNumber, batch *WriteBatch) { seqs = append(seqs, seq) }
+
+	// logs of the first release hold a KVEntry per record
+	legacy := writeLog("legacy",
+		NewKVEntry(5, KTypeValue, []byte("key1"), []byte("value1")),
+		NewKVEntry(6, KTypeDeletion, []byte("key1"), []byte{}))
+	if err := replayLog(legacy, func(seq SequenceNumber, batch *WriteBatch) {
+		entry := batch.entries[0]
+		if batch.Count() != 1 || entry.family != kDefaultColumnFamilyID || string(entry.key) != "key1" {
+			t.Fatalf("unexpected legacy entry %v", entry)
+		}
+		apply(seq, batch)
+	}); err != nil || len(seqs) != 2 || seqs[0] != 5 || seqs[1] != 6 {
+		t.Fatalf("Expect sequences [5 6], but get %v: %v\n", seqs, err)
+	}
+
+	// a damaged last record is where a crash cut the log off
+	seqs = nil
+	log := writeLog("tail", encodeLogHeader(), batch.encodeTo(1), batch.encodeTo(3)[:20])
+	if err := replayLog(log, apply); err != nil || len(seqs) != 1 {
+		t.Fatalf("Expect 1 batch, but get %d: %v\n", len(seqs), err)
+	}
+
+	// a damaged record followed by more is corruption
+	seqs = nil
+	log = writeLog("middle", encodeLogHeader(), batch.encodeTo(1), batch.encodeTo(3)[:20], batch.encodeTo(5))
+	if err := replayLog(log, apply); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("Expect: %v, but get %v\n", ErrCorruption, err)
+	}
+
+	// logs written by a newer release are refused
+	header := encodeLogHeader()
+	EncodeFixed32(header[8:], kLogFormatVersion+1)
+	if err := replayLog(writeLog("newer", header, batch.encodeTo(1)), apply); err != ErrUnsupportedFormat {
+		t.Fatalf("Expect: %v, but get %v\n", ErrUnsupportedFormat, err)
+	}
+}